@@ -10,6 +10,7 @@ require (
 	github.com/oschwald/geoip2-golang v1.11.0
 	github.com/pojntfx/hydrapp/hydrapp v0.0.0-20250304054433-5ab54845c5c9
 	github.com/pojntfx/panrpc/go v0.0.0-20250114165542-9cc31cf01885
+	golang.org/x/net v0.35.0
 	golang.org/x/sys v0.30.0
 	nhooyr.io/websocket v1.8.17
 )
@@ -35,7 +36,6 @@ require (
 	github.com/rogpeppe/go-internal v1.11.0 // indirect
 	golang.org/x/crypto v0.35.0 // indirect
 	golang.org/x/image v0.24.0 // indirect
-	golang.org/x/net v0.35.0 // indirect
 	golang.org/x/text v0.22.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
@@ -4,6 +4,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	_ "embed"
@@ -43,13 +44,27 @@ func main() {
 			panic(err)
 		}
 
-		if err := utils.TraceDevice(mtu, flag.Arg(0)); err != nil {
+		snapLen := 0
+		if flag.NArg() > 3 {
+			snapLen, err = strconv.Atoi(flag.Arg(3))
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		if err := utils.TraceDevice(mtu, flag.Arg(0), flag.Arg(2), snapLen); err != nil {
 			panic(err)
 		}
 
 		return
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "lookup" {
+		lookup(os.Args[2:])
+
+		return
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -120,3 +135,38 @@ func main() {
 		}
 	}
 }
+
+// lookup looks up the addresses in `args`, or in stdin if there are none, with the same databases and rules as the app
+func lookup(args []string) {
+	flags := flag.NewFlagSet("lookup", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %v lookup [flags] [ip...]\n\nLooks up IP addresses from the arguments, or whitespace-separated from stdin if there are none.\n\n", os.Args[0])
+
+		flags.PrintDefaults()
+	}
+	format := flags.String("format", string(backend.LookupFormatJSON), "Output format (json or csv)")
+
+	if err := flags.Parse(args); err != nil {
+		panic(err)
+	}
+
+	ips := flags.Args()
+	if len(ips) == 0 {
+		scanner := bufio.NewScanner(os.Stdin)
+		scanner.Split(bufio.ScanWords)
+
+		for scanner.Scan() {
+			ips = append(ips, scanner.Text())
+		}
+
+		if err := scanner.Err(); err != nil {
+			panic(err)
+		}
+	}
+
+	if err := backend.Lookup(context.Background(), ips, backend.LookupFormat(*format), os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "Could not look up addresses:", err)
+
+		os.Exit(1)
+	}
+}
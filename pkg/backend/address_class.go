@@ -0,0 +1,77 @@
+package backend
+
+import "net"
+
+type addressClass string
+
+const (
+	addressClassPublic        addressClass = "public"
+	addressClassPrivate       addressClass = "private"       // RFC 1918
+	addressClassShared        addressClass = "shared"        // RFC 6598, e.g. CGNAT
+	addressClassLoopback      addressClass = "loopback"      // RFC 1122 and RFC 4291
+	addressClassLinkLocal     addressClass = "linkLocal"     // RFC 3927 and RFC 4291
+	addressClassUniqueLocal   addressClass = "uniqueLocal"   // RFC 4193
+	addressClassMulticast     addressClass = "multicast"     // RFC 5771 and RFC 4291
+	addressClassBroadcast     addressClass = "broadcast"     // RFC 919
+	addressClassDocumentation addressClass = "documentation" // RFC 5737 and RFC 3849
+	addressClassBenchmarking  addressClass = "benchmarking"  // RFC 2544
+	addressClassReserved      addressClass = "reserved"      // Other special-purpose addresses
+)
+
+type addressClassNetwork struct {
+	network *net.IPNet
+	class   addressClass
+}
+
+// See https://www.iana.org/assignments/iana-ipv4-special-registry/ and https://www.iana.org/assignments/iana-ipv6-special-registry/
+var addressClassNetworks = func() []addressClassNetwork {
+	networks := []addressClassNetwork{}
+	for _, candidate := range []struct {
+		cidr  string
+		class addressClass
+	}{
+		{"0.0.0.0/8", addressClassReserved},
+		{"10.0.0.0/8", addressClassPrivate},
+		{"100.64.0.0/10", addressClassShared},
+		{"127.0.0.0/8", addressClassLoopback},
+		{"169.254.0.0/16", addressClassLinkLocal},
+		{"172.16.0.0/12", addressClassPrivate},
+		{"192.0.0.0/24", addressClassReserved},
+		{"192.0.2.0/24", addressClassDocumentation},
+		{"192.168.0.0/16", addressClassPrivate},
+		{"198.18.0.0/15", addressClassBenchmarking},
+		{"198.51.100.0/24", addressClassDocumentation},
+		{"203.0.113.0/24", addressClassDocumentation},
+		{"224.0.0.0/4", addressClassMulticast},
+		{"255.255.255.255/32", addressClassBroadcast},
+		{"240.0.0.0/4", addressClassReserved},
+
+		{"::/128", addressClassReserved},
+		{"::1/128", addressClassLoopback},
+		{"100::/64", addressClassReserved},
+		{"2001:db8::/32", addressClassDocumentation},
+		{"fc00::/7", addressClassUniqueLocal},
+		{"fe80::/10", addressClassLinkLocal},
+		{"ff00::/8", addressClassMulticast},
+	} {
+		_, network, err := net.ParseCIDR(candidate.cidr)
+		if err != nil {
+			panic(err)
+		}
+
+		networks = append(networks, addressClassNetwork{network, candidate.class})
+	}
+
+	return networks
+}()
+
+// getAddressClass returns whether an address is public or which kind of special-purpose address it is
+func getAddressClass(ip net.IP) addressClass {
+	for _, candidate := range addressClassNetworks {
+		if candidate.network.Contains(ip) {
+			return candidate.class
+		}
+	}
+
+	return addressClassPublic
+}
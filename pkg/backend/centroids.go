@@ -0,0 +1,62 @@
+package backend
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/csv"
+	"strconv"
+)
+
+type locationPrecision string
+
+const (
+	locationPrecisionCity        locationPrecision = "city"        // Coordinates of the city from the database
+	locationPrecisionSubdivision locationPrecision = "subdivision" // Coordinates of the subdivision from the database, or its centroid
+	locationPrecisionCountry     locationPrecision = "country"     // Coordinates of the country from the database, or its centroid
+	locationPrecisionHome        locationPrecision = "home"        // Home location of private and special-purpose addresses
+	locationPrecisionOverride    locationPrecision = "override"    // Coordinates of a location override
+	locationPrecisionUnknown     locationPrecision = "unknown"     // No coordinates are known
+)
+
+type centroid struct {
+	longitude float64
+	latitude  float64
+}
+
+var (
+	//go:embed country_centroids.csv
+	countryCentroidsCSV []byte
+
+	//go:embed subdivision_centroids.csv
+	subdivisionCentroidsCSV []byte
+
+	// Centroids by ISO 3166-1 alpha-2 code
+	countryCentroids = parseCentroids(countryCentroidsCSV)
+
+	// Centroids by ISO 3166-2 code; this only covers the subdivisions of some large countries
+	subdivisionCentroids = parseCentroids(subdivisionCentroidsCSV)
+)
+
+func parseCentroids(b []byte) map[string]centroid {
+	records, err := csv.NewReader(bytes.NewReader(b)).ReadAll()
+	if err != nil {
+		panic(err)
+	}
+
+	centroids := map[string]centroid{}
+	for _, record := range records[1:] {
+		latitude, err := strconv.ParseFloat(record[1], 64)
+		if err != nil {
+			panic(err)
+		}
+
+		longitude, err := strconv.ParseFloat(record[2], 64)
+		if err != nil {
+			panic(err)
+		}
+
+		centroids[record[0]] = centroid{longitude, latitude}
+	}
+
+	return centroids
+}
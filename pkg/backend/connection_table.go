@@ -0,0 +1,110 @@
+package backend
+
+import (
+	"container/list"
+	"time"
+)
+
+const (
+	defaultConnectionIdleTimeout = time.Second * 10
+	connectionExpiryInterval     = time.Second / 2
+)
+
+type connectionEntry struct {
+	id            string
+	connection    tracedConnection
+	lastSeen      time.Time // When the last packet was observed, used to expire the connection
+	lastTimestamp int64     // Capture timestamp of the last packet, which differs from `lastSeen` for replayed files
+}
+
+// connectionTable keeps connections ordered from the most to the least recently seen one. Since all connections
+// share the same idle timeout, both idle connections and the least recently seen connections are at the back of
+// the order and can be removed without scanning the table. It isn't safe for concurrent use
+type connectionTable struct {
+	entries map[string]*list.Element
+	order   *list.List
+
+	onRemove func(connection tracedConnection, lastTimestamp int64) // Called for every connection which is removed, may be nil
+}
+
+func newConnectionTable(onRemove func(connection tracedConnection, lastTimestamp int64)) *connectionTable {
+	return &connectionTable{
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+
+		onRemove: onRemove,
+	}
+}
+
+// Observe adds the bytes of `flow` to its connection, or to the connection of its reply direction, and creates the
+// connection if there is none
+func (t *connectionTable) Observe(flow tracedConnection, key flowKey, now time.Time) {
+	id := getTracedConnectionID(flow, key)
+
+	element, ok := t.entries[id]
+	reversed := false
+	if !ok {
+		element, ok = t.entries[getTracedConnectionID(reverseTracedConnection(flow), key)]
+		reversed = ok
+	}
+
+	if !ok {
+		t.entries[id] = t.order.PushFront(&connectionEntry{id, flow, now, flow.Timestamp})
+
+		return
+	}
+
+	entry := element.Value.(*connectionEntry)
+	entry.connection = mergeTracedConnection(entry.connection, flow, reversed)
+	entry.lastSeen = now
+	entry.lastTimestamp = max(entry.lastTimestamp, flow.Timestamp)
+
+	t.order.MoveToFront(element)
+}
+
+func (t *connectionTable) remove(element *list.Element) {
+	entry := element.Value.(*connectionEntry)
+
+	t.order.Remove(element)
+	delete(t.entries, entry.id)
+
+	if t.onRemove != nil {
+		t.onRemove(entry.connection, entry.lastTimestamp)
+	}
+}
+
+// Evict removes the least recently seen connections until at most `size` are left; a `size` of 0 keeps all connections
+func (t *connectionTable) Evict(size int) {
+	for size > 0 && t.order.Len() > size {
+		t.remove(t.order.Back())
+	}
+}
+
+// Expire removes the connections which haven't been seen since `before`
+func (t *connectionTable) Expire(before time.Time) {
+	for oldest := t.order.Back(); oldest != nil && oldest.Value.(*connectionEntry).lastSeen.Before(before); oldest = t.order.Back() {
+		t.remove(oldest)
+	}
+}
+
+func (t *connectionTable) List() []tracedConnection {
+	connections := make([]tracedConnection, 0, t.order.Len())
+	for element := t.order.Front(); element != nil; element = element.Next() {
+		connections = append(connections, element.Value.(*connectionEntry).connection)
+	}
+
+	return connections
+}
+
+func (t *connectionTable) Clear() {
+	if t.onRemove != nil {
+		for element := t.order.Back(); element != nil; element = element.Prev() {
+			entry := element.Value.(*connectionEntry)
+
+			t.onRemove(entry.connection, entry.lastTimestamp)
+		}
+	}
+
+	t.entries = map[string]*list.Element{}
+	t.order.Init()
+}
@@ -0,0 +1,168 @@
+package backend
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestConnectionTable(t *testing.T) {
+	var (
+		start = time.Unix(1000, 0)
+
+		a      = newTestFlow("10.0.0.1", "1.1.1.1", 50000, 443, 1)
+		aReply = newTestFlow("1.1.1.1", "10.0.0.1", 443, 50000, 2)
+		b      = newTestFlow("10.0.0.1", "8.8.8.8", 50001, 53, 10)
+		c      = newTestFlow("10.0.0.1", "9.9.9.9", 50002, 853, 100)
+		aAgain = newTestFlow("10.0.0.1", "1.1.1.1", 50000, 443, 4)
+	)
+
+	type step struct {
+		observe tracedConnection
+		at      time.Duration // Offset from `start` at which `observe` is seen
+
+		evict  int           // Evicts down to this size after observing if set
+		expire time.Duration // Expires connections seen before this offset after observing if set
+		clear  bool          // Clears the table after observing if set
+	}
+
+	tests := []struct {
+		name    string
+		steps   []step
+		want    []int // Lengths of the listed connections, from the most to the least recently seen one
+		removed []int // Lengths of the removed connections, in the order in which they were removed
+	}{
+		{
+			name: "observing refreshes the order",
+			steps: []step{
+				{observe: a},
+				{observe: b, at: time.Second},
+				{observe: c, at: 2 * time.Second},
+				{observe: aAgain, at: 3 * time.Second},
+			},
+			want:    []int{5, 100, 10},
+			removed: []int{},
+		},
+		{
+			name: "eviction removes the least recently seen connections",
+			steps: []step{
+				{observe: a},
+				{observe: b, at: time.Second},
+				{observe: c, at: 2 * time.Second},
+				{observe: aAgain, at: 3 * time.Second, evict: 1},
+			},
+			want:    []int{5},
+			removed: []int{10, 100},
+		},
+		{
+			name: "expiry removes idle connections",
+			steps: []step{
+				{observe: a},
+				{observe: b, at: time.Second},
+				{observe: c, at: 2 * time.Second, expire: 2 * time.Second},
+			},
+			want:    []int{100},
+			removed: []int{1, 10},
+		},
+		{
+			name: "expiry keeps connections which were seen again",
+			steps: []step{
+				{observe: a},
+				{observe: b, at: time.Second},
+				{observe: aReply, at: 2 * time.Second, expire: 2 * time.Second},
+			},
+			want:    []int{3},
+			removed: []int{10},
+		},
+		{
+			name: "replies are merged into their connection",
+			steps: []step{
+				{observe: a},
+				{observe: aReply, at: time.Second},
+				{observe: aAgain, at: 2 * time.Second},
+			},
+			want:    []int{7},
+			removed: []int{},
+		},
+		{
+			name: "clearing removes all connections",
+			steps: []step{
+				{observe: a},
+				{observe: b, at: time.Second},
+				{observe: aReply, at: 2 * time.Second, clear: true},
+			},
+			want:    []int{},
+			removed: []int{10, 3},
+		},
+		{
+			name: "connections are removed once",
+			steps: []step{
+				{observe: a},
+				{observe: b, at: time.Second, evict: 1},
+				{observe: c, at: 2 * time.Second, expire: 2 * time.Second},
+				{observe: c, at: 3 * time.Second, evict: 1, expire: time.Second},
+				{observe: b, at: 4 * time.Second, clear: true},
+				{observe: b, at: 5 * time.Second, expire: 6 * time.Second, clear: true},
+			},
+			want:    []int{},
+			removed: []int{1, 10, 200, 10, 10},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			removed := []int{}
+			table := newConnectionTable(func(connection tracedConnection, lastTimestamp int64) {
+				removed = append(removed, connection.Length)
+			})
+
+			for _, step := range tt.steps {
+				table.Observe(step.observe, flowKeyFiveTuple, start.Add(step.at))
+
+				if step.evict > 0 {
+					table.Evict(step.evict)
+				}
+
+				if step.expire > 0 {
+					table.Expire(start.Add(step.expire))
+				}
+
+				if step.clear {
+					table.Clear()
+				}
+			}
+
+			if got := getPacketLengths(table.List()); !slices.Equal(got, tt.want) {
+				t.Errorf("got connections %v, want %v", got, tt.want)
+			}
+
+			if !slices.Equal(removed, tt.removed) {
+				t.Errorf("got removed connections %v, want %v", removed, tt.removed)
+			}
+
+			if len(table.entries) != table.order.Len() {
+				t.Errorf("table indexes %v connections, but orders %v", len(table.entries), table.order.Len())
+			}
+		})
+	}
+}
+
+func TestConnectionTableReplyBytes(t *testing.T) {
+	table := newConnectionTable(nil)
+
+	table.Observe(newTestFlow("10.0.0.1", "1.1.1.1", 50000, 443, 1), flowKeyFiveTuple, time.Unix(0, 0))
+	table.Observe(newTestFlow("1.1.1.1", "10.0.0.1", 443, 50000, 2), flowKeyFiveTuple, time.Unix(1, 0))
+
+	// A size of 0 keeps all connections
+	table.Evict(0)
+
+	connections := table.List()
+	if len(connections) != 1 {
+		t.Fatalf("got %v connections, want 1", len(connections))
+	}
+
+	// The connection keeps the direction in which it was first seen
+	if got := connections[0]; got.SrcIP != "10.0.0.1" || got.BytesSent != 1 || got.BytesReceived != 2 {
+		t.Errorf("reply was not counted as received: %+v", got)
+	}
+}
@@ -0,0 +1,614 @@
+package backend
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+const (
+	minDatabaseUpdateInterval = time.Hour
+
+	downloadProgressInterval = time.Second / 4
+
+	tarMagicOffset = 257
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	tarMagic  = []byte("ustar")
+)
+
+// databaseAutoUpdate configures the background updater for the GeoIP database. The MaxMind license key is stored in
+// plaintext in the configuration file, which is only readable by the current user
+type databaseAutoUpdate struct {
+	Enabled  bool  `json:"enabled"`
+	Interval int64 `json:"interval"` // Interval between checks in seconds
+
+	AccountID  string `json:"accountID"`
+	LicenseKey string `json:"licenseKey"`
+}
+
+func (d databaseAutoUpdate) validate() error {
+	if d.Enabled && time.Duration(d.Interval)*time.Second < minDatabaseUpdateInterval {
+		return errors.Join(ErrInvalidDatabaseUpdateInterval, fmt.Errorf("interval must be at least %v seconds", int64(minDatabaseUpdateInterval.Seconds())))
+	}
+
+	return nil
+}
+
+type databaseUpdateStatus struct {
+	LastCheck  int64  `json:"lastCheck"`  // Unix milliseconds of the last check for a new database, or 0
+	LastUpdate int64  `json:"lastUpdate"` // Unix milliseconds of the last successful download of a new database, or 0
+	LastError  string `json:"lastError"`  // Error of the last check, or empty if it succeeded
+}
+
+// getChecksumURL returns the URL of the `.sha256` checksum for an archive URL, e.g. the MaxMind `suffix=tar.gz` query
+// becomes `suffix=tar.gz.sha256`, and all other URLs get the suffix appended to their path
+func getChecksumURL(u url.URL) url.URL {
+	query := u.Query()
+	if suffix := query.Get("suffix"); suffix != "" {
+		query.Set("suffix", suffix+".sha256")
+
+		u.RawQuery = query.Encode()
+
+		return u
+	}
+
+	u.Path += ".sha256"
+	u.RawPath = ""
+
+	return u
+}
+
+// expandDownloadURL replaces the `{year}` and `{month}` placeholders in `downloadURL`, which are
+// used by providers that publish a new file every month
+func expandDownloadURL(downloadURL string, now time.Time) string {
+	return strings.NewReplacer(
+		"{year}", now.UTC().Format("2006"),
+		"{month}", now.UTC().Format("01"),
+	).Replace(downloadURL)
+}
+
+// extractDatabase writes the first `.mmdb` file in the `.tar.gz` archive `r` to `out`. If `r` is a `.gz` file
+// without a tar archive in it, such as the `.mmdb.gz` files DB-IP distributes, it is decompressed as-is
+func extractDatabase(r io.Reader, out io.Writer) error {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	br := bufio.NewReader(gr)
+	if header, err := br.Peek(tarMagicOffset + len(tarMagic)); err != nil || !bytes.Equal(header[tarMagicOffset:], tarMagic) {
+		_, err = io.Copy(out, br)
+
+		return err
+	}
+
+	tr := tar.NewReader(br)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return ErrDatabaseNotInArchive
+			}
+
+			return err
+		}
+
+		if !strings.HasSuffix(hdr.Name, ".mmdb") {
+			continue
+		}
+
+		_, err = io.Copy(out, tr)
+
+		return err
+	}
+}
+
+// validateDatabase checks if the file at `path` is a GeoIP database
+func validateDatabase(path string) error {
+	db, err := geoip2.Open(path)
+	if err != nil {
+		return errors.Join(ErrInvalidDatabase, err)
+	}
+
+	return db.Close()
+}
+
+// fetchDatabaseChecksum returns the expected SHA-256 digest of the archive at `u`, or nil if the server doesn't provide one
+func fetchDatabaseChecksum(ctx context.Context, client *http.Client, u url.URL) ([]byte, error) {
+	checksumURL := getChecksumURL(u)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, checksumURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Join(ErrUnexpectedHTTPStatus, fmt.Errorf("could not fetch checksum: %v", res.Status))
+	}
+
+	// The checksum file has the same format as the output of `sha256sum`
+	b, err := io.ReadAll(io.LimitReader(res.Body, 4096))
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return nil, ErrInvalidDatabaseChecksum
+	}
+
+	checksum, err := hex.DecodeString(fields[0])
+	if err != nil || len(checksum) != sha256.Size {
+		return nil, ErrInvalidDatabaseChecksum
+	}
+
+	return checksum, nil
+}
+
+// databaseUpdateState is stored next to a database so that the update schedule and the validators for
+// conditional and resumed downloads survive restarts
+type databaseUpdateState struct {
+	Status           databaseUpdateStatus `json:"status"`
+	ETag             string               `json:"etag"`
+	PartialValidator string               `json:"partialValidator"`
+}
+
+// geoIPDatabase is a GeoIP database file together with its reader and the state of its updates
+type geoIPDatabase struct {
+	path      string
+	statePath string
+	reader    *geoIPReader
+
+	updateLock       sync.Mutex
+	etag             string
+	partialValidator string
+
+	status     databaseUpdateStatus
+	statusLock sync.Mutex
+}
+
+func newGeoIPDatabase(path string, lookup func(db *geoip2.Reader, ip net.IP, locale string) geoIPRecord) *geoIPDatabase {
+	d := &geoIPDatabase{
+		path:      path,
+		statePath: path + ".update.json",
+		reader:    newGeoIPReader(path, geoIPCacheSize, lookup),
+	}
+
+	var state databaseUpdateState
+	if err := loadConfig(d.statePath, &state); err != nil {
+		log.Println("Could not load database update state, checking for updates immediately:", err)
+	} else {
+		d.status = state.Status
+		d.etag = state.ETag
+		d.partialValidator = state.PartialValidator
+	}
+
+	return d
+}
+
+// saveState persists the update status and validators; `updateLock` must be held
+func (d *geoIPDatabase) saveState() error {
+	return saveConfig(d.statePath, databaseUpdateState{
+		Status:           d.getStatus(),
+		ETag:             d.etag,
+		PartialValidator: d.partialValidator,
+	})
+}
+
+func (d *geoIPDatabase) exists() bool {
+	_, err := os.Stat(d.path)
+
+	return err == nil
+}
+
+func (d *geoIPDatabase) getStatus() databaseUpdateStatus {
+	d.statusLock.Lock()
+	defer d.statusLock.Unlock()
+
+	return d.status
+}
+
+// progressReader reports the progress of reading `r`, throttled to `downloadProgressInterval`
+type progressReader struct {
+	ctx context.Context
+	r   io.Reader
+
+	downloaded int64
+	total      int64
+	progress   func(ctx context.Context, downloaded, total int64) error
+
+	lastProgress time.Time
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.downloaded += int64(n)
+
+	if p.progress != nil && (err == io.EOF || time.Since(p.lastProgress) >= downloadProgressInterval) {
+		p.lastProgress = time.Now()
+
+		if err := p.progress(p.ctx, p.downloaded, p.total); err != nil {
+			return n, err
+		}
+	}
+
+	return n, err
+}
+
+// update downloads the database archive from `downloadURL` if it has changed since the last download, verifies and
+// extracts it, and atomically replaces the database. It returns false if the database hasn't changed. If `progress`
+// is set, it is called with the downloaded and total bytes of the archive while downloading; `total` is -1 if it is
+// unknown
+func (d *geoIPDatabase) update(
+	ctx context.Context,
+	client *http.Client,
+	downloadURL, accountID, licenseKey string,
+	progress func(ctx context.Context, downloaded, total int64) error,
+) (updated bool, err error) {
+	d.updateLock.Lock()
+	defer d.updateLock.Unlock()
+
+	defer func() {
+		d.statusLock.Lock()
+
+		now := time.Now().UnixMilli()
+
+		d.status.LastCheck = now
+		if err != nil {
+			d.status.LastError = err.Error()
+		} else {
+			d.status.LastError = ""
+
+			if updated {
+				d.status.LastUpdate = now
+			}
+		}
+
+		d.statusLock.Unlock()
+
+		if err := d.saveState(); err != nil {
+			log.Println("Could not save database update state:", err)
+		}
+	}()
+
+	downloadURL = expandDownloadURL(downloadURL, time.Now())
+
+	log.Println("Downloading database from base URL", downloadURL)
+
+	if err := os.MkdirAll(filepath.Dir(d.path), os.ModePerm); err != nil {
+		return false, err
+	}
+
+	u, err := url.Parse(downloadURL)
+	if err != nil {
+		return false, err
+	}
+
+	// Databases which don't require an account, such as DB-IP Lite, are downloaded without credentials
+	if accountID != "" || licenseKey != "" {
+		u.User = url.UserPassword(accountID, licenseKey)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+
+	// Running traces keep using the old database until the new one is complete and verified. Interrupted downloads
+	// keep the partial archive so that they can be resumed if it hasn't changed on the server in the meantime
+	archivePath := d.path + ".tar.gz.part"
+
+	offset := int64(0)
+	if info, err := os.Stat(archivePath); err == nil && d.partialValidator != "" {
+		offset = info.Size()
+
+		req.Header.Set("Range", fmt.Sprintf("bytes=%v-", offset))
+		req.Header.Set("If-Range", d.partialValidator)
+	} else if info, err := os.Stat(d.path); err == nil {
+		// The modification time of the database is set to the `Last-Modified` header of the archive it was extracted from
+		if d.etag != "" {
+			req.Header.Set("If-None-Match", d.etag)
+		}
+
+		req.Header.Set("If-Modified-Since", info.ModTime().UTC().Format(http.TimeFormat))
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	flags := os.O_CREATE | os.O_RDWR
+	switch res.StatusCode {
+	case http.StatusNotModified:
+		log.Println("Database is up to date")
+
+		return false, nil
+
+	case http.StatusPartialContent:
+		log.Println("Resuming database download at byte", offset)
+
+		flags |= os.O_APPEND
+
+	case http.StatusOK:
+		offset = 0
+
+		flags |= os.O_TRUNC
+
+	case http.StatusRequestedRangeNotSatisfiable:
+		d.partialValidator = ""
+
+		return false, errors.Join(ErrUnexpectedHTTPStatus, fmt.Errorf("could not resume database download: %v", res.Status), os.Remove(archivePath))
+
+	default:
+		return false, errors.Join(ErrUnexpectedHTTPStatus, fmt.Errorf("could not download database: %v", res.Status))
+	}
+
+	d.partialValidator = res.Header.Get("ETag")
+	if d.partialValidator == "" {
+		d.partialValidator = res.Header.Get("Last-Modified")
+	}
+
+	archive, err := os.OpenFile(archivePath, flags, 0600)
+	if err != nil {
+		return false, err
+	}
+	defer archive.Close()
+
+	total := int64(-1)
+	if res.ContentLength >= 0 {
+		total = offset + res.ContentLength
+	}
+
+	if _, err := io.Copy(archive, &progressReader{
+		ctx:        ctx,
+		r:          res.Body,
+		downloaded: offset,
+		total:      total,
+		progress:   progress,
+	}); err != nil {
+		return false, err
+	}
+
+	// From here on, the archive is complete and must not be resumed, even if it turns out to be invalid
+	d.partialValidator = ""
+	defer os.Remove(archivePath)
+
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, archive); err != nil {
+		return false, err
+	}
+
+	expectedChecksum, err := fetchDatabaseChecksum(ctx, client, *u)
+	if err != nil {
+		return false, err
+	}
+
+	if expectedChecksum == nil {
+		log.Println("Server provides no database checksum, skipping verification")
+	} else if actualChecksum := hash.Sum(nil); !bytes.Equal(actualChecksum, expectedChecksum) {
+		return false, errors.Join(ErrDatabaseChecksumMismatch, fmt.Errorf("expected %x, got %x", expectedChecksum, actualChecksum))
+	}
+
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	tmpPath := d.path + ".tmp"
+
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return false, err
+	}
+
+	if err := extractDatabase(archive, out); err != nil {
+		return false, errors.Join(err, out.Close(), os.Remove(tmpPath))
+	}
+
+	if err := out.Close(); err != nil {
+		return false, errors.Join(err, os.Remove(tmpPath))
+	}
+
+	if err := validateDatabase(tmpPath); err != nil {
+		return false, errors.Join(err, os.Remove(tmpPath))
+	}
+
+	if lastModified, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		if err := os.Chtimes(tmpPath, lastModified, lastModified); err != nil {
+			return false, errors.Join(err, os.Remove(tmpPath))
+		}
+	}
+
+	if err := d.reader.Update(func(path string) error {
+		return os.Rename(tmpPath, path)
+	}); err != nil {
+		return false, err
+	}
+
+	d.etag = res.Header.Get("ETag")
+
+	return true, nil
+}
+
+// upload receives a database from the client, either as a `.mmdb` file or as a `.tar.gz` archive containing one,
+// and replaces the database if it is valid
+func (d *geoIPDatabase) upload(
+	ctx context.Context,
+	read func(ctx context.Context) ([]byte, error),
+) error {
+	d.updateLock.Lock()
+	defer d.updateLock.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(d.path), os.ModePerm); err != nil {
+		return err
+	}
+
+	// Running traces keep using the old database until the new one is complete and verified
+	upload, err := os.CreateTemp(filepath.Dir(d.path), "*.upload")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = upload.Close()
+		_ = os.Remove(upload.Name())
+	}()
+
+	for {
+		chunk, err := read(ctx)
+		if err != nil {
+			return err
+		}
+
+		if len(chunk) == 0 {
+			break
+		}
+
+		if _, err := upload.Write(chunk); err != nil {
+			return err
+		}
+	}
+
+	if _, err := upload.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	tmpPath := d.path + ".tmp"
+
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	uploadReader := bufio.NewReader(upload)
+	if magic, err := uploadReader.Peek(len(gzipMagic)); err == nil && bytes.Equal(magic, gzipMagic) {
+		err = extractDatabase(uploadReader, out)
+	} else {
+		_, err = io.Copy(out, uploadReader)
+	}
+	if err != nil {
+		return errors.Join(err, out.Close(), os.Remove(tmpPath))
+	}
+
+	if err := out.Close(); err != nil {
+		return errors.Join(err, os.Remove(tmpPath))
+	}
+
+	if err := validateDatabase(tmpPath); err != nil {
+		return errors.Join(
+			fmt.Errorf("uploaded file is neither a MaxMind database (.mmdb) nor a MaxMind archive containing one (.tar.gz)"),
+			err,
+			os.Remove(tmpPath),
+		)
+	}
+
+	if err := d.reader.Update(func(path string) error {
+		return os.Rename(tmpPath, path)
+	}); err != nil {
+		return err
+	}
+
+	d.statusLock.Lock()
+	d.status.LastUpdate = time.Now().UnixMilli()
+	d.statusLock.Unlock()
+
+	// The validators describe the last downloaded archive, not the uploaded database
+	d.etag = ""
+
+	if err := d.saveState(); err != nil {
+		log.Println("Could not save database update state:", err)
+	}
+
+	return nil
+}
+
+// runDatabaseAutoUpdate checks for new databases whenever the configured interval has passed since the last check,
+// which is persisted so that restarts don't trigger a check
+func (l *local) runDatabaseAutoUpdate(ctx context.Context) {
+	for {
+		l.dbAutoUpdateLock.Lock()
+		autoUpdate := l.dbAutoUpdate
+		l.dbAutoUpdateLock.Unlock()
+
+		lastCheck := time.UnixMilli(l.cityDB.getStatus().LastCheck)
+
+		var (
+			timer *time.Timer
+			due   <-chan time.Time
+		)
+		if autoUpdate.Enabled {
+			timer = time.NewTimer(time.Until(lastCheck.Add(time.Duration(autoUpdate.Interval) * time.Second)))
+
+			due = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-l.dbAutoUpdateChanged:
+		case <-due:
+			s := l.getSettings()
+
+			if _, err := l.cityDB.update(ctx, l.httpClient, s.DBDownloadURL, autoUpdate.AccountID, autoUpdate.LicenseKey, nil); err != nil {
+				log.Println("Could not update database:", err)
+			}
+
+			// The ASN database is optional, so it is only updated if it has been downloaded or uploaded before
+			if l.asnDB.exists() {
+				if _, err := l.asnDB.update(ctx, l.httpClient, s.ASNDBDownloadURL, autoUpdate.AccountID, autoUpdate.LicenseKey, nil); err != nil {
+					log.Println("Could not update ASN database:", err)
+				}
+			}
+
+			// The same applies to the DB-IP database, which doesn't require an account
+			if l.dbipDB.exists() {
+				if _, err := l.dbipDB.update(ctx, l.httpClient, s.DBIPDBDownloadURL, "", "", nil); err != nil {
+					log.Println("Could not update DB-IP database:", err)
+				}
+			}
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package backend
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestDatabase returns an empty MaxMind database of type `databaseType`, consisting of the data section
+// separator and the metadata
+func newTestDatabase(databaseType string) []byte {
+	encodeString := func(s string) []byte {
+		return append([]byte{0x40 | byte(len(s))}, s...)
+	}
+
+	db := make([]byte, 16)
+	db = append(db, "\xab\xcd\xefMaxMind.com"...)
+	db = append(db, 0xe4) // Map with 4 entries
+	db = append(db, encodeString("database_type")...)
+	db = append(db, encodeString(databaseType)...)
+	db = append(db, encodeString("node_count")...)
+	db = append(db, 0xc0) // uint32 0
+	db = append(db, encodeString("record_size")...)
+	db = append(db, 0xa1, 24) // uint16 24
+	db = append(db, encodeString("ip_version")...)
+	db = append(db, 0xa1, 4) // uint16 4
+
+	return db
+}
+
+// newTestArchive returns a `.tar.gz` archive like the ones MaxMind distributes, with an incompressible file in
+// front of the database so that the archive can be interrupted before the database has been sent
+func newTestArchive(t *testing.T, db []byte) []byte {
+	t.Helper()
+
+	padding := make([]byte, 256*1024)
+	if _, err := rand.Read(padding); err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	gw := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gw)
+
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{
+		{"GeoLite2-City_20250101/COPYRIGHT.txt", padding},
+		{"GeoLite2-City_20250101/GeoLite2-City.mmdb", db},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.data))}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tw.Write(file.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.Bytes()
+}
+
+// testDatabaseServer serves an archive and its checksum like the MaxMind download endpoint
+type testDatabaseServer struct {
+	*httptest.Server
+
+	archive  atomic.Pointer[[]byte]
+	etag     atomic.Pointer[string]
+	checksum atomic.Pointer[string] // Overrides the checksum of the archive if set
+
+	// serveArchive handles requests for the archive if it is set, otherwise `http.ServeContent` does
+	serveArchive atomic.Pointer[func(w http.ResponseWriter, r *http.Request, archive []byte)]
+
+	requests atomic.Pointer[[]*http.Request]
+}
+
+func newTestDatabaseServer(t *testing.T, archive []byte, etag string) *testDatabaseServer {
+	t.Helper()
+
+	s := &testDatabaseServer{}
+	s.setArchive(archive, etag)
+	s.requests.Store(&[]*http.Request{})
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		archive := *s.archive.Load()
+
+		if strings.HasSuffix(r.URL.Query().Get("suffix"), ".sha256") {
+			checksum := fmt.Sprintf("%x", sha256.Sum256(archive))
+			if c := s.checksum.Load(); c != nil {
+				checksum = *c
+			}
+
+			fmt.Fprintf(w, "%v  GeoLite2-City_20250101.tar.gz\n", checksum)
+
+			return
+		}
+
+		requests := append(*s.requests.Load(), r.Clone(context.Background()))
+		s.requests.Store(&requests)
+
+		if serve := s.serveArchive.Load(); serve != nil {
+			(*serve)(w, r, archive)
+
+			return
+		}
+
+		w.Header().Set("ETag", *s.etag.Load())
+		http.ServeContent(w, r, "", time.Unix(1735689600, 0), bytes.NewReader(archive))
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *testDatabaseServer) setArchive(archive []byte, etag string) {
+	s.archive.Store(&archive)
+	s.etag.Store(&etag)
+}
+
+func (s *testDatabaseServer) lastRequest(t *testing.T) *http.Request {
+	t.Helper()
+
+	requests := *s.requests.Load()
+	if len(requests) == 0 {
+		t.Fatal("no archive was requested")
+	}
+
+	return requests[len(requests)-1]
+}
+
+func (s *testDatabaseServer) downloadURL() string {
+	return s.URL + "/geoip_download?edition_id=GeoLite2-City&suffix=tar.gz"
+}
+
+func newTestGeoIPDatabase(t *testing.T, dir string) *geoIPDatabase {
+	t.Helper()
+
+	return newGeoIPDatabase(filepath.Join(dir, "GeoLite2-City.mmdb"), lookupLocation)
+}
+
+func TestGeoIPDatabaseUpdateResumesDownload(t *testing.T) {
+	db := newTestDatabase("GeoLite2-City")
+	archive := newTestArchive(t, db)
+
+	server := newTestDatabaseServer(t, archive, `"v1"`)
+
+	// The first download is interrupted after half of the archive has been sent
+	interrupted := func(w http.ResponseWriter, r *http.Request, archive []byte) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", fmt.Sprintf("%v", len(archive)))
+		w.WriteHeader(http.StatusOK)
+
+		_, _ = w.Write(archive[:len(archive)/2])
+	}
+	server.serveArchive.Store(&interrupted)
+
+	d := newTestGeoIPDatabase(t, t.TempDir())
+	if _, err := d.update(context.Background(), server.Client(), server.downloadURL(), "", "", nil); err == nil {
+		t.Fatal("expected the interrupted download to fail")
+	}
+
+	if info, err := os.Stat(d.path + ".tar.gz.part"); err != nil || info.Size() != int64(len(archive)/2) {
+		t.Fatalf("expected the partial archive to be kept, got %v and error %v", info, err)
+	}
+
+	server.serveArchive.Store(nil)
+
+	var (
+		lastDownloaded int64
+		lastTotal      int64
+	)
+	updated, err := d.update(context.Background(), server.Client(), server.downloadURL(), "", "", func(ctx context.Context, downloaded, total int64) error {
+		lastDownloaded, lastTotal = downloaded, total
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !updated {
+		t.Error("expected the database to be updated")
+	}
+
+	req := server.lastRequest(t)
+	if got, want := req.Header.Get("Range"), fmt.Sprintf("bytes=%v-", len(archive)/2); got != want {
+		t.Errorf("got Range %q, want %q", got, want)
+	}
+	if got, want := req.Header.Get("If-Range"), `"v1"`; got != want {
+		t.Errorf("got If-Range %q, want %q", got, want)
+	}
+
+	if lastDownloaded != int64(len(archive)) || lastTotal != int64(len(archive)) {
+		t.Errorf("got progress %v/%v, want %v/%v", lastDownloaded, lastTotal, len(archive), len(archive))
+	}
+
+	if got, err := os.ReadFile(d.path); err != nil || !bytes.Equal(got, db) {
+		t.Errorf("database was not extracted from the resumed archive: %v", err)
+	}
+
+	if _, err := os.Stat(d.path + ".tar.gz.part"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the partial archive to be removed, got %v", err)
+	}
+}
+
+func TestGeoIPDatabaseUpdateRestartsChangedDownload(t *testing.T) {
+	archive := newTestArchive(t, newTestDatabase("GeoLite2-City"))
+
+	server := newTestDatabaseServer(t, archive, `"v1"`)
+
+	interrupted := func(w http.ResponseWriter, r *http.Request, archive []byte) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", fmt.Sprintf("%v", len(archive)))
+		w.WriteHeader(http.StatusOK)
+
+		_, _ = w.Write(archive[:len(archive)/2])
+	}
+	server.serveArchive.Store(&interrupted)
+
+	d := newTestGeoIPDatabase(t, t.TempDir())
+	if _, err := d.update(context.Background(), server.Client(), server.downloadURL(), "", "", nil); err == nil {
+		t.Fatal("expected the interrupted download to fail")
+	}
+
+	// The archive changed on the server, so `If-Range` doesn't match and the full archive is sent
+	db := newTestDatabase("GeoIP2-City")
+	server.setArchive(newTestArchive(t, db), `"v2"`)
+	server.serveArchive.Store(nil)
+
+	if _, err := d.update(context.Background(), server.Client(), server.downloadURL(), "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := os.ReadFile(d.path); err != nil || !bytes.Equal(got, db) {
+		t.Errorf("database was not extracted from the changed archive: %v", err)
+	}
+}
+
+func TestGeoIPDatabaseUpdateNotModified(t *testing.T) {
+	dir := t.TempDir()
+
+	server := newTestDatabaseServer(t, newTestArchive(t, newTestDatabase("GeoLite2-City")), `"v1"`)
+
+	if updated, err := newTestGeoIPDatabase(t, dir).update(context.Background(), server.Client(), server.downloadURL(), "", "", nil); err != nil || !updated {
+		t.Fatalf("got %v and error %v, want an updated database", updated, err)
+	}
+
+	notModified := func(w http.ResponseWriter, r *http.Request, archive []byte) {
+		w.WriteHeader(http.StatusNotModified)
+	}
+	server.serveArchive.Store(&notModified)
+
+	// The validators are persisted, so they are also sent after a restart
+	d := newTestGeoIPDatabase(t, dir)
+	if d.getStatus().LastCheck == 0 {
+		t.Error("expected the last check to be persisted")
+	}
+
+	updated, err := d.update(context.Background(), server.Client(), server.downloadURL(), "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if updated {
+		t.Error("expected the database not to be updated")
+	}
+
+	req := server.lastRequest(t)
+	if got, want := req.Header.Get("If-None-Match"), `"v1"`; got != want {
+		t.Errorf("got If-None-Match %q, want %q", got, want)
+	}
+	if got, want := req.Header.Get("If-Modified-Since"), time.Unix(1735689600, 0).UTC().Format(http.TimeFormat); got != want {
+		t.Errorf("got If-Modified-Since %q, want %q", got, want)
+	}
+}
+
+func TestGeoIPDatabaseUpdateChecksumMismatch(t *testing.T) {
+	oldDB := newTestDatabase("GeoLite2-City")
+
+	server := newTestDatabaseServer(t, newTestArchive(t, oldDB), `"v1"`)
+
+	d := newTestGeoIPDatabase(t, t.TempDir())
+	if _, err := d.update(context.Background(), server.Client(), server.downloadURL(), "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	server.setArchive(newTestArchive(t, newTestDatabase("GeoIP2-City")), `"v2"`)
+
+	checksum := fmt.Sprintf("%x", sha256.Sum256([]byte("not the archive")))
+	server.checksum.Store(&checksum)
+
+	if _, err := d.update(context.Background(), server.Client(), server.downloadURL(), "", "", nil); !errors.Is(err, ErrDatabaseChecksumMismatch) {
+		t.Fatalf("got %v, want %v", err, ErrDatabaseChecksumMismatch)
+	}
+
+	if got, err := os.ReadFile(d.path); err != nil || !bytes.Equal(got, oldDB) {
+		t.Errorf("expected the old database to be kept: %v", err)
+	}
+
+	if _, err := os.Stat(d.path + ".tar.gz.part"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the invalid archive to be removed, got %v", err)
+	}
+
+	if status := d.getStatus(); status.LastError == "" {
+		t.Error("expected the checksum mismatch to be reported in the status")
+	}
+}
+
+func TestGeoIPDatabaseUpdateCancel(t *testing.T) {
+	oldDB := newTestDatabase("GeoLite2-City")
+	archive := newTestArchive(t, oldDB)
+
+	server := newTestDatabaseServer(t, archive, `"v1"`)
+
+	d := newTestGeoIPDatabase(t, t.TempDir())
+	if _, err := d.update(context.Background(), server.Client(), server.downloadURL(), "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server stalls after sending half of the new archive until the client goes away
+	server.setArchive(newTestArchive(t, newTestDatabase("GeoIP2-City")), `"v2"`)
+	stalled := func(w http.ResponseWriter, r *http.Request, archive []byte) {
+		w.Header().Set("ETag", `"v2"`)
+		w.Header().Set("Content-Length", fmt.Sprintf("%v", len(archive)))
+		w.WriteHeader(http.StatusOK)
+
+		_, _ = w.Write(archive[:len(archive)/2])
+		w.(http.Flusher).Flush()
+
+		<-r.Context().Done()
+	}
+	server.serveArchive.Store(&stalled)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := d.update(ctx, server.Client(), server.downloadURL(), "", "", func(ctx context.Context, downloaded, total int64) error {
+		if downloaded > 0 {
+			cancel()
+		}
+
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+
+	if got, err := os.ReadFile(d.path); err != nil || !bytes.Equal(got, oldDB) {
+		t.Errorf("expected the old database to be kept: %v", err)
+	}
+
+	if info, err := os.Stat(d.path + ".tar.gz.part"); err != nil || info.Size() == 0 {
+		t.Errorf("expected the partial archive to be kept for resuming, got %v and error %v", info, err)
+	}
+}
@@ -0,0 +1,789 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Filter expressions select packets and connections, e.g. `country != "Germany" and proto == "TCP" and bytes > 1MB`
+// or `dst in 1.1.1.0/24`. Comparisons can be combined with `and`, `or`, `not` and parentheses. Fields of an
+// endpoint can be prefixed with `src.` or `dst.`; without a prefix, a comparison matches if it matches either
+// endpoint, and a negated comparison (`!=` or `not in`) matches if it matches neither of them
+
+type filterKind string
+
+const (
+	filterKindString filterKind = "text"
+	filterKindNumber filterKind = "number"
+	filterKindIP     filterKind = "IP address"
+	filterKindBool   filterKind = "boolean"
+	filterKindTags   filterKind = "tags"
+)
+
+type filterField struct {
+	kind     filterKind
+	endpoint bool     // Whether the field belongs to an endpoint; it is read from the source of the connection
+	values   []string // Valid values of an enumerated field, if any
+
+	str  func(c *tracedConnection) string // Text and IP address fields
+	num  func(c *tracedConnection) float64
+	flag func(c *tracedConnection) bool
+	tags func(c *tracedConnection) []string
+}
+
+var (
+	filterFields = map[string]filterField{
+		"ip":                {kind: filterKindIP, endpoint: true, str: func(c *tracedConnection) string { return c.SrcIP }},
+		"port":              {kind: filterKindNumber, endpoint: true, num: func(c *tracedConnection) float64 { return float64(c.SrcPort) }},
+		"country":           {kind: filterKindString, endpoint: true, str: func(c *tracedConnection) string { return c.SrcCountryName }},
+		"city":              {kind: filterKindString, endpoint: true, str: func(c *tracedConnection) string { return c.SrcCityName }},
+		"continent":         {kind: filterKindString, endpoint: true, str: func(c *tracedConnection) string { return c.SrcContinentName }},
+		"subdivision":       {kind: filterKindString, endpoint: true, str: func(c *tracedConnection) string { return c.SrcSubdivisionName }},
+		"postalcode":        {kind: filterKindString, endpoint: true, str: func(c *tracedConnection) string { return c.SrcPostalCode }},
+		"timezone":          {kind: filterKindString, endpoint: true, str: func(c *tracedConnection) string { return c.SrcTimeZone }},
+		"registeredcountry": {kind: filterKindString, endpoint: true, str: func(c *tracedConnection) string { return c.SrcRegisteredCountryName }},
+		"accuracy":          {kind: filterKindNumber, endpoint: true, num: func(c *tracedConnection) float64 { return float64(c.SrcAccuracyRadius) }},
+		"anycast":           {kind: filterKindBool, endpoint: true, flag: func(c *tracedConnection) bool { return c.SrcIsAnycast }},
+		"asn":               {kind: filterKindNumber, endpoint: true, num: func(c *tracedConnection) float64 { return float64(c.SrcASN) }},
+		"org":               {kind: filterKindString, endpoint: true, str: func(c *tracedConnection) string { return c.SrcOrg }},
+		"label":             {kind: filterKindString, endpoint: true, str: func(c *tracedConnection) string { return c.SrcLabel }},
+		"tag":               {kind: filterKindTags, endpoint: true, tags: func(c *tracedConnection) []string { return c.SrcTags }},
+		"class": {
+			kind:     filterKindString,
+			endpoint: true,
+			values: []string{
+				string(addressClassPublic),
+				string(addressClassPrivate),
+				string(addressClassShared),
+				string(addressClassLoopback),
+				string(addressClassLinkLocal),
+				string(addressClassUniqueLocal),
+				string(addressClassMulticast),
+				string(addressClassBroadcast),
+				string(addressClassDocumentation),
+				string(addressClassBenchmarking),
+				string(addressClassReserved),
+			},
+			str: func(c *tracedConnection) string { return string(c.SrcAddressClass) },
+		},
+		"precision": {
+			kind:     filterKindString,
+			endpoint: true,
+			values: []string{
+				string(locationPrecisionCity),
+				string(locationPrecisionSubdivision),
+				string(locationPrecisionCountry),
+				string(locationPrecisionHome),
+				string(locationPrecisionOverride),
+				string(locationPrecisionUnknown),
+			},
+			str: func(c *tracedConnection) string { return string(c.SrcLocationPrecision) },
+		},
+
+		"proto":   {kind: filterKindString, str: func(c *tracedConnection) string { return c.NextLayerType }},
+		"network": {kind: filterKindString, values: []string{"IPv4", "IPv6"}, str: func(c *tracedConnection) string { return c.LayerType }},
+		"direction": {
+			kind:   filterKindString,
+			values: []string{string(directionInbound), string(directionOutbound), string(directionLocal), string(directionTransit)},
+			str:    func(c *tracedConnection) string { return string(c.Direction) },
+		},
+		"bytes":     {kind: filterKindNumber, num: func(c *tracedConnection) float64 { return float64(c.Length) }},
+		"sent":      {kind: filterKindNumber, num: func(c *tracedConnection) float64 { return float64(c.BytesSent) }},
+		"received":  {kind: filterKindNumber, num: func(c *tracedConnection) float64 { return float64(c.BytesReceived) }},
+		"timestamp": {kind: filterKindNumber, num: func(c *tracedConnection) float64 { return float64(c.Timestamp) }},
+	}
+
+	// Byte units of numbers, e.g. `1.5MB`
+	filterUnits = map[string]float64{
+		"b":   1,
+		"kb":  1000,
+		"mb":  1000 * 1000,
+		"gb":  1000 * 1000 * 1000,
+		"tb":  1000 * 1000 * 1000 * 1000,
+		"kib": 1024,
+		"mib": 1024 * 1024,
+		"gib": 1024 * 1024 * 1024,
+		"tib": 1024 * 1024 * 1024 * 1024,
+	}
+
+	filterOperators = map[filterKind][]string{
+		filterKindString: {"==", "!=", "in", "not in", "contains"},
+		filterKindNumber: {"==", "!=", "<", "<=", ">", ">=", "in", "not in"},
+		filterKindIP:     {"==", "!=", "in", "not in"},
+		filterKindBool:   {"==", "!="},
+		filterKindTags:   {"==", "!=", "in", "not in", "contains"},
+	}
+)
+
+type filterSide int
+
+const (
+	filterSideEither filterSide = iota
+	filterSideSource
+	filterSideDestination
+)
+
+// filterTarget is a connection which is being matched, and its reverse, which is created when it is first needed to
+// read the fields of the destination
+type filterTarget struct {
+	connection *tracedConnection
+	reversed   *tracedConnection
+}
+
+func (t *filterTarget) reverse() *tracedConnection {
+	if t.reversed == nil {
+		reversed := reverseTracedConnection(*t.connection)
+		t.reversed = &reversed
+	}
+
+	return t.reversed
+}
+
+type filterNode interface {
+	match(t *filterTarget) bool
+}
+
+type filterAnd []filterNode
+
+func (n filterAnd) match(t *filterTarget) bool {
+	for _, node := range n {
+		if !node.match(t) {
+			return false
+		}
+	}
+
+	return true
+}
+
+type filterOr []filterNode
+
+func (n filterOr) match(t *filterTarget) bool {
+	for _, node := range n {
+		if node.match(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type filterNot struct {
+	node filterNode
+}
+
+func (n filterNot) match(t *filterTarget) bool {
+	return !n.node.match(t)
+}
+
+type filterComparison struct {
+	side    filterSide
+	negated bool
+	matches func(c *tracedConnection) bool // Compares the field of the source
+}
+
+func (n filterComparison) match(t *filterTarget) bool {
+	var rv bool
+	switch n.side {
+	case filterSideSource:
+		rv = n.matches(t.connection)
+	case filterSideDestination:
+		rv = n.matches(t.reverse())
+	default:
+		rv = n.matches(t.connection) || n.matches(t.reverse())
+	}
+
+	return rv != n.negated
+}
+
+// connectionFilter is a parsed filter expression. A nil filter matches all connections
+type connectionFilter struct {
+	root filterNode
+}
+
+func (f *connectionFilter) Match(connection tracedConnection) bool {
+	if f == nil {
+		return true
+	}
+
+	return f.root.match(&filterTarget{connection: &connection})
+}
+
+// Filter returns the connections which match the filter
+func (f *connectionFilter) Filter(connections []tracedConnection) []tracedConnection {
+	if f == nil {
+		return connections
+	}
+
+	filtered := []tracedConnection{}
+	for _, connection := range connections {
+		if f.Match(connection) {
+			filtered = append(filtered, connection)
+		}
+	}
+
+	return filtered
+}
+
+type filterTokenKind int
+
+const (
+	filterTokenEnd filterTokenKind = iota
+	filterTokenWord
+	filterTokenString
+	filterTokenOperator
+	filterTokenOpen
+	filterTokenClose
+	filterTokenComma
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string // Unquoted text of strings
+	pos  int    // 1-based position in the expression
+}
+
+func (t filterToken) String() string {
+	switch t.kind {
+	case filterTokenEnd:
+		return "the end of the filter"
+	case filterTokenString:
+		return strconv.Quote(t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+// is returns true if the token is the keyword or operator `text`
+func (t filterToken) is(text string) bool {
+	return (t.kind == filterTokenWord || t.kind == filterTokenOperator) && strings.EqualFold(t.text, text)
+}
+
+func newFilterError(pos int, format string, a ...any) error {
+	return errors.Join(ErrInvalidFilter, fmt.Errorf("at position %v: "+format, append([]any{pos}, a...)...))
+}
+
+func isFilterWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("._:/-", r)
+}
+
+func tokenizeFilter(expression string) ([]filterToken, error) {
+	tokens := []filterToken{}
+	for i := 0; i < len(expression); {
+		r, size := utf8.DecodeRuneInString(expression[i:])
+		pos := i + 1
+
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+
+		case r == '(':
+			tokens = append(tokens, filterToken{filterTokenOpen, "(", pos})
+			i++
+
+		case r == ')':
+			tokens = append(tokens, filterToken{filterTokenClose, ")", pos})
+			i++
+
+		case r == ',':
+			tokens = append(tokens, filterToken{filterTokenComma, ",", pos})
+			i++
+
+		case r == '"':
+			quoted, err := strconv.QuotedPrefix(expression[i:])
+			if err != nil {
+				return nil, newFilterError(pos, "unterminated or invalid string")
+			}
+
+			text, err := strconv.Unquote(quoted)
+			if err != nil {
+				return nil, newFilterError(pos, "invalid string %v", quoted)
+			}
+
+			tokens = append(tokens, filterToken{filterTokenString, text, pos})
+			i += len(quoted)
+
+		case r == '\'':
+			return nil, newFilterError(pos, "strings must be quoted with double quotes")
+
+		case strings.ContainsRune("=!<>&|", r):
+			operator := expression[i : i+1]
+			if i+1 < len(expression) && slices.Contains([]string{"==", "!=", "<=", ">=", "&&", "||"}, expression[i:i+2]) {
+				operator = expression[i : i+2]
+			}
+
+			switch operator {
+			case "=":
+				return nil, newFilterError(pos, "unknown operator \"=\", did you mean \"==\"?")
+			case "&", "|":
+				return nil, newFilterError(pos, "unknown operator %q, did you mean %q?", operator, operator+operator)
+			}
+
+			tokens = append(tokens, filterToken{filterTokenOperator, operator, pos})
+			i += len(operator)
+
+		default:
+			start := i
+			for i < len(expression) {
+				r, size := utf8.DecodeRuneInString(expression[i:])
+				if !isFilterWordRune(r) {
+					break
+				}
+
+				i += size
+			}
+
+			if i == start {
+				return nil, newFilterError(pos, "unexpected character %q", r)
+			}
+
+			tokens = append(tokens, filterToken{filterTokenWord, expression[start:i], pos})
+		}
+	}
+
+	return append(tokens, filterToken{kind: filterTokenEnd, pos: len(expression) + 1}), nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	next   int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.next]
+}
+
+func (p *filterParser) advance() filterToken {
+	token := p.tokens[p.next]
+	if token.kind != filterTokenEnd {
+		p.next++
+	}
+
+	return token
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	node, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := filterOr{node}
+	for p.peek().is("or") || p.peek().is("||") {
+		p.advance()
+
+		node, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+
+	return nodes, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	node, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := filterAnd{node}
+	for p.peek().is("and") || p.peek().is("&&") {
+		p.advance()
+
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+
+	return nodes, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	token := p.peek()
+
+	switch {
+	case token.is("not") || token.is("!"):
+		p.advance()
+
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return filterNot{node}, nil
+
+	case token.kind == filterTokenOpen:
+		p.advance()
+
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if closing := p.advance(); closing.kind != filterTokenClose {
+			return nil, newFilterError(closing.pos, "expected \")\" to close the \"(\" at position %v, got %v", token.pos, closing)
+		}
+
+		return node, nil
+
+	default:
+		return p.parseComparison()
+	}
+}
+
+// resolveFilterField returns the field named by `token` and the endpoint it is read from
+func resolveFilterField(token filterToken) (filterField, filterSide, error) {
+	name := strings.ToLower(token.text)
+	if token.kind != filterTokenWord || name == "and" || name == "or" || name == "not" {
+		return filterField{}, 0, newFilterError(token.pos, "expected a field, got %v", token)
+	}
+
+	side := filterSideEither
+	switch {
+	case name == "src" || name == "dst":
+		name += ".ip"
+	case name == "host":
+		name = "ip"
+	}
+
+	prefix, unprefixed, ok := strings.Cut(name, ".")
+	if ok && (prefix == "src" || prefix == "dst") {
+		name = unprefixed
+		side = filterSideSource
+		if prefix == "dst" {
+			side = filterSideDestination
+		}
+	}
+
+	field, ok := filterFields[name]
+	if !ok {
+		names := []string{}
+		for name := range filterFields {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+
+		if suggestion := suggestFilterField(name, names); suggestion != "" {
+			return filterField{}, 0, newFilterError(token.pos, "unknown field %q, did you mean %q?", token.text, suggestion)
+		}
+
+		return filterField{}, 0, newFilterError(token.pos, "unknown field %q, expected one of %v", token.text, strings.Join(names, ", "))
+	}
+
+	if side != filterSideEither && !field.endpoint {
+		return filterField{}, 0, newFilterError(token.pos, "field %q doesn't belong to an endpoint, so it can't be prefixed with %q", name, prefix+".")
+	}
+
+	if !field.endpoint {
+		side = filterSideSource
+	}
+
+	return field, side, nil
+}
+
+// suggestFilterField returns the name in `names` which is closest to `name`, or an empty string if none of them are close
+func suggestFilterField(name string, names []string) string {
+	suggestion := ""
+	best := 3
+	for _, candidate := range names {
+		if distance := getEditDistance(name, candidate); distance < best {
+			suggestion = candidate
+			best = distance
+		}
+	}
+
+	return suggestion
+}
+
+// getEditDistance returns the Levenshtein distance between `a` and `b`
+func getEditDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		curr := make([]int, len(b)+1)
+		curr[0] = i
+
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+
+		prev = curr
+	}
+
+	return prev[len(b)]
+}
+
+func (p *filterParser) parseOperator() (string, filterToken, error) {
+	token := p.advance()
+
+	switch {
+	case token.kind == filterTokenOperator && token.text != "&&" && token.text != "||" && token.text != "!":
+		return token.text, token, nil
+
+	case token.is("in") || token.is("contains"):
+		return strings.ToLower(token.text), token, nil
+
+	case token.is("not"):
+		if in := p.advance(); !in.is("in") {
+			return "", token, newFilterError(in.pos, "expected \"in\" after \"not\", got %v", in)
+		}
+
+		return "not in", token, nil
+	}
+
+	return "", token, newFilterError(token.pos, "expected an operator such as ==, !=, <, >, in or contains, got %v", token)
+}
+
+// parseValues returns the value of a comparison, or all values of a list such as `(80, 443)` after `in`
+func (p *filterParser) parseValues(list bool) ([]filterToken, error) {
+	if !list || p.peek().kind != filterTokenOpen {
+		value := p.advance()
+		if value.kind != filterTokenWord && value.kind != filterTokenString {
+			return nil, newFilterError(value.pos, "expected a value, got %v", value)
+		}
+
+		return []filterToken{value}, nil
+	}
+
+	open := p.advance()
+
+	values := []filterToken{}
+	for {
+		value := p.advance()
+		if value.kind != filterTokenWord && value.kind != filterTokenString {
+			return nil, newFilterError(value.pos, "expected a value in the list, got %v", value)
+		}
+
+		values = append(values, value)
+
+		switch separator := p.advance(); separator.kind {
+		case filterTokenComma:
+			continue
+		case filterTokenClose:
+			return values, nil
+		default:
+			return nil, newFilterError(separator.pos, "expected \",\" or \")\" to close the list at position %v, got %v", open.pos, separator)
+		}
+	}
+}
+
+func parseFilterNumber(value filterToken) (float64, error) {
+	text := strings.ToLower(value.text)
+	end := strings.LastIndexFunc(text, func(r rune) bool {
+		return unicode.IsDigit(r) || r == '.'
+	}) + 1
+
+	if end == 0 {
+		return 0, newFilterError(value.pos, "expected a number such as 443 or 1.5MB, got %v", value)
+	}
+
+	multiplier := 1.0
+	if unit := text[end:]; unit != "" {
+		var ok bool
+		if multiplier, ok = filterUnits[unit]; !ok {
+			return 0, newFilterError(value.pos, "unknown unit %q in %v, expected one of B, KB, MB, GB, TB, KiB, MiB, GiB or TiB", value.text[end:], value)
+		}
+	}
+
+	n, err := strconv.ParseFloat(text[:end], 64)
+	if err != nil {
+		return 0, newFilterError(value.pos, "expected a number such as 443 or 1.5MB, got %v", value)
+	}
+
+	return n * multiplier, nil
+}
+
+func (p *filterParser) parseComparison() (filterNode, error) {
+	fieldToken := p.advance()
+
+	field, side, err := resolveFilterField(fieldToken)
+	if err != nil {
+		return nil, err
+	}
+
+	operator, operatorToken, err := p.parseOperator()
+	if err != nil {
+		return nil, err
+	}
+
+	if !slices.Contains(filterOperators[field.kind], operator) {
+		return nil, newFilterError(operatorToken.pos, "operator %q can't be used with the %v field %q, expected one of %v", operator, field.kind, fieldToken.text, strings.Join(filterOperators[field.kind], ", "))
+	}
+
+	values, err := p.parseValues(operator == "in" || operator == "not in")
+	if err != nil {
+		return nil, err
+	}
+
+	comparison := filterComparison{
+		side:    side,
+		negated: operator == "!=" || operator == "not in",
+	}
+
+	switch field.kind {
+	case filterKindString, filterKindTags:
+		texts := []string{}
+		for _, value := range values {
+			if len(field.values) > 0 && operator != "contains" && !slices.ContainsFunc(field.values, func(v string) bool {
+				return strings.EqualFold(v, value.text)
+			}) {
+				return nil, newFilterError(value.pos, "invalid value %v for field %q, expected one of %v", value, fieldToken.text, strings.Join(field.values, ", "))
+			}
+
+			texts = append(texts, strings.ToLower(value.text))
+		}
+
+		matchesText := func(text string) bool {
+			text = strings.ToLower(text)
+			if operator == "contains" {
+				return strings.Contains(text, texts[0])
+			}
+
+			return slices.Contains(texts, text)
+		}
+
+		if field.kind == filterKindTags {
+			comparison.matches = func(c *tracedConnection) bool {
+				return slices.ContainsFunc(field.tags(c), matchesText)
+			}
+		} else {
+			comparison.matches = func(c *tracedConnection) bool {
+				return matchesText(field.str(c))
+			}
+		}
+
+	case filterKindNumber:
+		numbers := []float64{}
+		for _, value := range values {
+			n, err := parseFilterNumber(value)
+			if err != nil {
+				return nil, err
+			}
+
+			numbers = append(numbers, n)
+		}
+
+		comparison.matches = func(c *tracedConnection) bool {
+			n := field.num(c)
+
+			switch operator {
+			case "<":
+				return n < numbers[0]
+			case "<=":
+				return n <= numbers[0]
+			case ">":
+				return n > numbers[0]
+			case ">=":
+				return n >= numbers[0]
+			default:
+				return slices.Contains(numbers, n)
+			}
+		}
+
+	case filterKindIP:
+		networks := []*net.IPNet{}
+		for _, value := range values {
+			if ip := net.ParseIP(value.text); ip != nil {
+				bits := 8 * net.IPv6len
+				if ip4 := ip.To4(); ip4 != nil {
+					ip = ip4
+					bits = 8 * net.IPv4len
+				}
+
+				networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+				continue
+			}
+
+			_, network, err := net.ParseCIDR(value.text)
+			if err != nil {
+				return nil, newFilterError(value.pos, "expected an IP address such as 1.1.1.1 or a network such as 1.1.1.0/24, got %v", value)
+			}
+
+			if operator == "==" || operator == "!=" {
+				return nil, newFilterError(value.pos, "%v is a network, use \"in\" to compare with it", value)
+			}
+
+			networks = append(networks, network)
+		}
+
+		comparison.matches = func(c *tracedConnection) bool {
+			ip := net.ParseIP(field.str(c))
+			if ip == nil {
+				return false
+			}
+
+			return slices.ContainsFunc(networks, func(network *net.IPNet) bool {
+				return network.Contains(ip)
+			})
+		}
+
+	case filterKindBool:
+		flag, err := strconv.ParseBool(strings.ToLower(values[0].text))
+		if err != nil {
+			return nil, newFilterError(values[0].pos, "expected true or false, got %v", values[0])
+		}
+
+		comparison.matches = func(c *tracedConnection) bool {
+			return field.flag(c) == flag
+		}
+	}
+
+	return comparison, nil
+}
+
+// parseFilter parses a filter expression. An empty expression returns a nil filter, which matches all connections
+func parseFilter(expression string) (*connectionFilter, error) {
+	if strings.TrimSpace(expression) == "" {
+		return nil, nil
+	}
+
+	tokens, err := tokenizeFilter(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: tokens}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if token := p.peek(); token.kind != filterTokenEnd {
+		if token.kind == filterTokenClose {
+			return nil, newFilterError(token.pos, "unexpected \")\" without a matching \"(\"")
+		}
+
+		return nil, newFilterError(token.pos, "expected \"and\", \"or\" or the end of the filter, got %v", token)
+	}
+
+	return &connectionFilter{root}, nil
+}
@@ -0,0 +1,255 @@
+package backend
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newTestFilterConnection returns an outbound HTTPS connection from Frankfurt, Germany to a Cloudflare address in
+// the United States
+func newTestFilterConnection() tracedConnection {
+	c := newTestFlow("10.0.0.1", "1.1.1.1", 50000, 443, 1500)
+
+	c.Timestamp = 1700000000000
+	c.Direction = directionOutbound
+	c.BytesReceived = 3000
+
+	c.SrcCountryName = "Germany"
+	c.SrcCityName = "Frankfurt am Main"
+	c.SrcAddressClass = addressClassPrivate
+	c.SrcLocationPrecision = locationPrecisionHome
+	c.SrcTags = []string{"home"}
+
+	c.DstCountryName = "United States"
+	c.DstAddressClass = addressClassPublic
+	c.DstLocationPrecision = locationPrecisionCountry
+	c.DstIsAnycast = true
+	c.DstASN = 13335
+	c.DstOrg = "Cloudflare, Inc."
+	c.DstLabel = "DNS"
+	c.DstTags = []string{"dns", "cdn"}
+
+	return c
+}
+
+func TestParseFilter(t *testing.T) {
+	connection := newTestFilterConnection()
+
+	tests := []struct {
+		name    string
+		filter  string
+		matches bool
+	}{
+		{"empty", "", true},
+		{"whitespace", "  \t", true},
+
+		// `and` binds stronger than `or`, and `not` binds stronger than both
+		{"and before or", "proto == UDP and port == 443 or country == Germany", true},
+		{"or after and", "proto == TCP or port == 1 and country == France", true},
+		{"parentheses", "(proto == TCP or port == 1) and country == France", false},
+		{"symbols", "proto == UDP && port == 443 || country == Germany", true},
+		{"keywords are case-insensitive", "proto == TCP AND NOT port == 1", true},
+		{"not before and", "not proto == UDP and port == 443", true},
+		{"not before or", "not proto == TCP or port == 443", true},
+		{"not parentheses", "not (proto == TCP and port == 443)", false},
+		{"double negation", "! !proto == TCP", true},
+
+		// Endpoint fields without a prefix match if either endpoint matches, and negations if neither does
+		{"either endpoint", "country == \"United States\"", true},
+		{"source endpoint", "src.country == \"United States\"", false},
+		{"destination endpoint", "dst.country == \"United States\"", true},
+		{"neither endpoint", "country != Germany", false},
+		{"not either endpoint", "not country == Germany", false},
+		{"source endpoint negated", "src.country != \"United States\"", true},
+		{"destination endpoint negated", "dst.country != Germany", true},
+		{"connection field", "direction == outbound", true},
+
+		{"ip", "ip == 1.1.1.1", true},
+		{"host", "host == 10.0.0.1", true},
+		{"src", "src == 10.0.0.1", true},
+		{"dst", "dst == 10.0.0.1", false},
+		{"ip not equal", "ip != 8.8.8.8", true},
+		{"cidr", "dst in 1.1.1.0/24", true},
+		{"cidr source", "src in 1.1.1.0/24", false},
+		{"cidr list", "src in (192.168.0.0/16, 10.0.0.0/8)", true},
+		{"cidr and address list", "ip in (8.8.8.8, 1.1.1.1)", true},
+		{"cidr negated", "ip not in 10.0.0.0/8", false},
+		{"cidr negated destination", "dst not in 10.0.0.0/8", true},
+		{"cidr ipv6", "ip in 2001:db8::/32", false},
+		{"cidr quoted", "dst in \"1.0.0.0/8\"", true},
+
+		{"port", "port == 443", true},
+		{"port list", "dst.port in (80, 443)", true},
+		{"port not in list", "dst.port not in (80, 443)", false},
+		{"port greater", "src.port > 1024", true},
+		{"port less", "port < 100", false},
+		{"port less or equal", "dst.port <= 443", true},
+		{"port greater or equal", "dst.port >= 444", false},
+		{"asn", "asn == 13335", true},
+
+		{"bytes", "bytes == 1500", true},
+		{"bytes unit", "bytes > 1KB", true},
+		{"bytes binary unit", "bytes > 1.5KiB", false},
+		{"bytes unit case", "bytes >= 1500b", true},
+		{"sent", "sent == 1500 and received == 3kb", true},
+		{"timestamp", "timestamp >= 1700000000000", true},
+
+		{"string is case-insensitive", "country == \"germany\"", true},
+		{"string unquoted", "proto == tcp", true},
+		{"string contains", "city contains frank", true},
+		{"string contains quoted", "org contains \"Cloud\"", true},
+		{"string in", "country in (France, Germany)", true},
+		{"string not in", "country not in (France, Germany)", false},
+		{"string escape", "label == \"D\\x4eS\"", true},
+		{"multibyte", "city == \"Zürich\"", false},
+		{"enumerated", "class == private", true},
+		{"enumerated source", "src.class == public", false},
+		{"enumerated precision", "precision == country", true},
+		{"network", "network == ipv4", true},
+		{"tag", "tag == cdn", true},
+		{"tag source", "src.tag == cdn", false},
+		{"tag contains", "tag contains ho", true},
+		{"tag not in", "tag not in (vpn, tor)", true},
+		{"anycast", "anycast == true", true},
+		{"anycast source", "src.anycast == true", false},
+		{"anycast negated", "dst.anycast != TRUE", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := parseFilter(tt.filter)
+			if err != nil {
+				t.Fatalf("could not parse %q: %v", tt.filter, err)
+			}
+
+			if got := filter.Match(connection); got != tt.matches {
+				t.Errorf("%q: got %v, want %v", tt.filter, got, tt.matches)
+			}
+		})
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []struct {
+		filter string
+		err    string
+	}{
+		{"country", "at position 8: expected an operator"},
+		{"countr == Germany", "at position 1: unknown field \"countr\", did you mean \"country\"?"},
+		{"foo == bar", "at position 1: unknown field \"foo\", expected one of accuracy, anycast"},
+		{"src.bytes > 5", "at position 1: field \"bytes\" doesn't belong to an endpoint"},
+		{"and == 5", "at position 1: expected a field, got \"and\""},
+		{"== TCP", "at position 1: expected a field"},
+		{"proto = TCP", "at position 7: unknown operator \"=\", did you mean \"==\"?"},
+		{"proto == TCP & port == 80", "at position 14: unknown operator \"&\", did you mean \"&&\"?"},
+		{"proto == TCP and", "at position 17: expected a field, got the end of the filter"},
+		{"not", "at position 4: expected a field, got the end of the filter"},
+		{"(proto == TCP", "at position 14: expected \")\" to close the \"(\" at position 1"},
+		{"proto == TCP)", "at position 13: unexpected \")\" without a matching \"(\""},
+		{"port == 80 port == 443", "at position 12: expected \"and\", \"or\" or the end of the filter, got \"port\""},
+		{"proto not 5", "at position 11: expected \"in\" after \"not\""},
+		{"proto TCP", "at position 7: expected an operator"},
+		{"proto ==", "at position 9: expected a value, got the end of the filter"},
+		{"port in (80, 443", "at position 17: expected \",\" or \")\" to close the list at position 9"},
+		{"port in ()", "at position 10: expected a value in the list"},
+		{"port in (80,)", "at position 13: expected a value in the list"},
+		{"bytes > abc", "at position 9: expected a number such as 443 or 1.5MB, got \"abc\""},
+		{"bytes > 1.2.3", "at position 9: expected a number"},
+		{"bytes > 5XB", "at position 9: unknown unit \"XB\""},
+		{"bytes contains 5", "at position 7: operator \"contains\" can't be used with the number field \"bytes\""},
+		{"anycast > true", "at position 9: operator \">\" can't be used with the boolean field \"anycast\""},
+		{"anycast == maybe", "at position 12: expected true or false, got \"maybe\""},
+		{"ip == foo", "at position 7: expected an IP address"},
+		{"ip == 10.0.0.0/8", "at position 7: \"10.0.0.0/8\" is a network, use \"in\" to compare with it"},
+		{"ip in 10.0.0.0/33", "at position 7: expected an IP address"},
+		{"direction == sideways", "at position 14: invalid value \"sideways\" for field \"direction\", expected one of inbound"},
+		{"class in (private, nowhere)", "at position 20: invalid value \"nowhere\" for field \"class\""},
+		{"proto == 'TCP'", "at position 10: strings must be quoted with double quotes"},
+		{"proto == \"TCP", "at position 10: unterminated or invalid string"},
+		{"proto == #", "at position 10: unexpected character '#'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			_, err := parseFilter(tt.filter)
+			if !errors.Is(err, ErrInvalidFilter) {
+				t.Fatalf("got %v, want %v", err, ErrInvalidFilter)
+			}
+
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got %q, want it to contain %q", err.Error(), tt.err)
+			}
+		})
+	}
+}
+
+func TestConnectionFilterFilter(t *testing.T) {
+	connection := newTestFilterConnection()
+	reply := newTestFlow("1.1.1.1", "10.0.0.1", 443, 50000, 64)
+
+	filter, err := parseFilter("src.port == 443")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := filter.Filter([]tracedConnection{connection, reply}); len(got) != 1 || got[0].SrcIP != "1.1.1.1" {
+		t.Errorf("got %+v, want only the reply", got)
+	}
+
+	var all *connectionFilter
+	if got := all.Filter([]tracedConnection{connection, reply}); len(got) != 2 {
+		t.Errorf("got %v connections, want 2", len(got))
+	}
+}
+
+var filterErrorPosition = regexp.MustCompile(`at position (\d+): `)
+
+func FuzzParseFilter(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		"country != \"Germany\" and proto == \"TCP\" and bytes > 1MB",
+		"dst in 1.1.1.0/24",
+		"not (src.port in (80, 443) || dst.port < 1024) && tag contains vpn",
+		"ip not in (10.0.0.0/8, 2001:db8::/32) or anycast == true",
+		"bytes >= 1.5GiB and timestamp < 1700000000000",
+		"city == \"Zürich\" and class == private",
+		"((proto == TCP)",
+		"port in (80,",
+		"proto = 'TCP'",
+		"\"\\x",
+	} {
+		f.Add(seed)
+	}
+
+	connection := newTestFilterConnection()
+
+	f.Fuzz(func(t *testing.T, expression string) {
+		filter, err := parseFilter(expression)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidFilter) {
+				t.Fatalf("%q: error %v is not an invalid filter error", expression, err)
+			}
+
+			match := filterErrorPosition.FindStringSubmatch(err.Error())
+			if match == nil {
+				t.Fatalf("%q: error %q has no position", expression, err)
+			}
+
+			if pos, _ := strconv.Atoi(match[1]); pos < 1 || pos > len(expression)+1 {
+				t.Fatalf("%q: position %v is outside of the filter", expression, pos)
+			}
+
+			return
+		}
+
+		if filter == nil && strings.TrimSpace(expression) != "" {
+			t.Fatalf("%q: got no filter for a non-empty expression", expression)
+		}
+
+		_ = filter.Match(connection)
+		_ = filter.Match(tracedConnection{})
+	})
+}
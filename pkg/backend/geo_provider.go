@@ -0,0 +1,379 @@
+package backend
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// GeoProvider looks up the location of public addresses
+type GeoProvider interface {
+	// Open prepares the provider for lookups and returns an error if it isn't available, e.g. because its database is missing
+	Open() error
+
+	// Lookup returns the location of `ip`, with a precision of `locationPrecisionUnknown` or no precision at all if it isn't known
+	Lookup(ip net.IP) geoIPRecord
+
+	Close() error
+}
+
+type geoProviderType string
+
+const (
+	geoProviderTypeMaxMind     geoProviderType = "maxmind"     // GeoLite2 City or GeoIP2 City database
+	geoProviderTypeDBIP        geoProviderType = "dbip"        // DB-IP Lite City database, which doesn't require an account
+	geoProviderTypeIP2Location geoProviderType = "ip2location" // IP2Location LITE CSV file, e.g. DB5 or DB11
+	geoProviderTypeCSV         geoProviderType = "csv"         // User-provided CSV file with non-overlapping `cidr,latitude,longitude[,country,city]` rows
+	geoProviderTypeHTTP        geoProviderType = "http"        // HTTP service which returns JSON for a URL containing `{ip}`
+)
+
+type geoProviderConfig struct {
+	Type geoProviderType `json:"type"`
+	Path string          `json:"path"` // Path of the file for the `ip2location` and `csv` providers
+	URL  string          `json:"url"`  // URL template for the `http` provider
+}
+
+func (c geoProviderConfig) validate() error {
+	switch c.Type {
+	case geoProviderTypeMaxMind, geoProviderTypeDBIP:
+		return nil
+
+	case geoProviderTypeIP2Location, geoProviderTypeCSV:
+		if strings.TrimSpace(c.Path) == "" {
+			return errors.Join(ErrInvalidGeoProvider, fmt.Errorf("%v provider requires a path", c.Type))
+		}
+
+		return nil
+
+	case geoProviderTypeHTTP:
+		if !strings.Contains(c.URL, "{ip}") {
+			return errors.Join(ErrInvalidGeoProvider, fmt.Errorf("%v provider requires a URL containing {ip}", c.Type))
+		}
+
+		return nil
+
+	default:
+		return errors.Join(
+			ErrInvalidGeoProvider,
+			fmt.Errorf(
+				"provider type must be one of %v, %v, %v, %v or %v",
+				geoProviderTypeMaxMind,
+				geoProviderTypeDBIP,
+				geoProviderTypeIP2Location,
+				geoProviderTypeCSV,
+				geoProviderTypeHTTP,
+			),
+		)
+	}
+}
+
+// sharedGeoProvider is a provider owned by the service, which isn't closed when the active providers change
+type sharedGeoProvider struct {
+	GeoProvider
+}
+
+func (p sharedGeoProvider) Close() error {
+	return nil
+}
+
+// lookupGeoProviders returns the first known location of `ip` in `providers`
+func lookupGeoProviders(providers []GeoProvider, ip net.IP) geoIPRecord {
+	for _, provider := range providers {
+		if record := provider.Lookup(ip); record.precision != "" && record.precision != locationPrecisionUnknown {
+			return record
+		}
+	}
+
+	return geoIPRecord{precision: locationPrecisionUnknown}
+}
+
+func closeGeoProviders(providers []GeoProvider) error {
+	errs := []error{}
+	for _, provider := range providers {
+		errs = append(errs, provider.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+type geoRange struct {
+	from   netip.Addr
+	to     netip.Addr
+	record geoIPRecord
+}
+
+// rangeGeoProvider looks up addresses in a table of address ranges loaded from a file
+type rangeGeoProvider struct {
+	path   string
+	parse  func(r io.Reader) ([]geoRange, error)
+	ranges []geoRange
+	lock   sync.RWMutex
+}
+
+func newCSVGeoProvider(path string) *rangeGeoProvider {
+	return &rangeGeoProvider{
+		path:  path,
+		parse: parseCSVGeoRanges,
+	}
+}
+
+func newIP2LocationGeoProvider(path string) *rangeGeoProvider {
+	return &rangeGeoProvider{
+		path:  path,
+		parse: parseIP2LocationGeoRanges,
+	}
+}
+
+// Open loads the file if it hasn't been loaded yet
+func (p *rangeGeoProvider) Open() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.ranges != nil {
+		return nil
+	}
+
+	f, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ranges, err := p.parse(bufio.NewReader(f))
+	if err != nil {
+		return errors.Join(ErrInvalidGeoProvider, fmt.Errorf("could not parse %v", p.path), err)
+	}
+
+	slices.SortFunc(ranges, func(a, b geoRange) int {
+		return a.from.Compare(b.from)
+	})
+
+	p.ranges = ranges
+
+	return nil
+}
+
+func (p *rangeGeoProvider) Lookup(ip net.IP) geoIPRecord {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return geoIPRecord{}
+	}
+	addr = addr.Unmap()
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	// Find the last range which starts at or before `addr`
+	i, found := slices.BinarySearchFunc(p.ranges, addr, func(candidate geoRange, target netip.Addr) int {
+		return candidate.from.Compare(target)
+	})
+	if !found {
+		i--
+	}
+
+	if i < 0 || i >= len(p.ranges) || p.ranges[i].to.Less(addr) || p.ranges[i].from.BitLen() != addr.BitLen() {
+		return geoIPRecord{}
+	}
+
+	return p.ranges[i].record
+}
+
+func (p *rangeGeoProvider) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.ranges = nil
+
+	return nil
+}
+
+// getLastAddr returns the last address in `prefix`
+func getLastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Masked().Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+
+	addr, _ := netip.AddrFromSlice(b)
+
+	return addr
+}
+
+// parseCSVGeoRanges parses `cidr,latitude,longitude[,country,city]` rows; lines starting with `#` are ignored
+func parseCSVGeoRanges(r io.Reader) ([]geoRange, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	ranges := []geoRange{}
+	for line := 1; ; line++ {
+		fields, err := reader.Read()
+		if err != nil {
+			if err == io.EOF {
+				return ranges, nil
+			}
+
+			return nil, err
+		}
+
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %v: expected at least 3 fields, got %v", line, len(fields))
+		}
+
+		prefix, err := netip.ParsePrefix(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", line, err)
+		}
+		if addr := prefix.Addr(); addr.Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96)
+		}
+
+		latitude, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", line, err)
+		}
+
+		longitude, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", line, err)
+		}
+
+		record := geoIPRecord{
+			longitude: longitude,
+			latitude:  latitude,
+			precision: locationPrecisionCity,
+		}
+		if len(fields) > 3 {
+			record.countryName = fields[3]
+		}
+		if len(fields) > 4 {
+			record.cityName = fields[4]
+		}
+
+		ranges = append(ranges, geoRange{
+			from:   prefix.Masked().Addr(),
+			to:     getLastAddr(prefix),
+			record: record,
+		})
+	}
+}
+
+// parseIP2LocationAddr parses the decimal address notation of IP2Location files, which use
+// IPv4-mapped IPv6 addresses for IPv4 in their IPv6 files
+func parseIP2LocationAddr(s string) (netip.Addr, error) {
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok || n.Sign() < 0 || n.BitLen() > 128 {
+		return netip.Addr{}, fmt.Errorf("invalid address %q", s)
+	}
+
+	if n.BitLen() <= 32 {
+		return netip.AddrFrom4([4]byte(n.FillBytes(make([]byte, 4)))), nil
+	}
+
+	return netip.AddrFrom16([16]byte(n.FillBytes(make([]byte, 16)))).Unmap(), nil
+}
+
+// getIP2LocationField returns an empty string for fields which are marked as unknown with `-`
+func getIP2LocationField(field string) string {
+	if field == "-" {
+		return ""
+	}
+
+	return field
+}
+
+// parseIP2LocationGeoRanges parses IP2Location LITE CSV files. All editions start with the `ip_from`, `ip_to`,
+// `country_code` and `country_name` columns; DB3 and higher add `region_name` and `city_name`, and DB5 and higher
+// add `latitude` and `longitude`. Editions without coordinates fall back to the country centroid
+func parseIP2LocationGeoRanges(r io.Reader) ([]geoRange, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	ranges := []geoRange{}
+	for line := 1; ; line++ {
+		fields, err := reader.Read()
+		if err != nil {
+			if err == io.EOF {
+				return ranges, nil
+			}
+
+			return nil, err
+		}
+
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("line %v: expected at least 4 fields, got %v", line, len(fields))
+		}
+
+		from, err := parseIP2LocationAddr(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", line, err)
+		}
+
+		to, err := parseIP2LocationAddr(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", line, err)
+		}
+
+		// Ranges without a country, e.g. reserved ranges, are marked with `-`
+		if fields[2] == "-" {
+			continue
+		}
+
+		record := geoIPRecord{
+			countryName: fields[3],
+			precision:   locationPrecisionUnknown,
+		}
+		if len(fields) > 5 {
+			record.subdivisionName = getIP2LocationField(fields[4])
+			record.cityName = getIP2LocationField(fields[5])
+		}
+
+		if len(fields) > 7 {
+			latitude, err := strconv.ParseFloat(fields[6], 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %w", line, err)
+			}
+
+			longitude, err := strconv.ParseFloat(fields[7], 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %w", line, err)
+			}
+
+			if longitude != 0 || latitude != 0 {
+				record.longitude, record.latitude, record.precision = longitude, latitude, locationPrecisionCity
+			}
+		}
+
+		if record.precision == locationPrecisionUnknown {
+			if c, ok := countryCentroids[fields[2]]; ok {
+				record.longitude, record.latitude, record.precision = c.longitude, c.latitude, locationPrecisionCountry
+			}
+		}
+
+		// DB9 and higher add `zip_code`, DB11 and higher add `time_zone` with an UTC offset such as `+01:00`
+		if len(fields) > 8 {
+			record.postalCode = getIP2LocationField(fields[8])
+		}
+		if len(fields) > 9 {
+			record.timeZone = getIP2LocationField(fields[9])
+		}
+
+		ranges = append(ranges, geoRange{
+			from:   from,
+			to:     to,
+			record: record,
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	httpGeoProviderRequestsPerMinute = 40 // Stays below the limits of common free services
+	httpGeoProviderQueueLen          = 1024
+	httpGeoProviderCacheTTL          = time.Hour * 24 * 7
+	httpGeoProviderSaveInterval      = time.Second * 30
+	httpGeoProviderTimeout           = time.Second * 10
+)
+
+type httpGeoCacheEntry struct {
+	Timestamp int64 `json:"timestamp"` // Unix milliseconds of when the location was fetched
+	Found     bool  `json:"found"`
+
+	CountryName     string  `json:"countryName"`
+	CityName        string  `json:"cityName"`
+	ContinentName   string  `json:"continentName"`
+	SubdivisionName string  `json:"subdivisionName"`
+	PostalCode      string  `json:"postalCode"`
+	TimeZone        string  `json:"timeZone"`
+	Longitude       float64 `json:"longitude"`
+	Latitude        float64 `json:"latitude"`
+}
+
+// httpGeoProvider looks up addresses with an HTTP service. Lookups never block on the network; addresses which
+// aren't in the persistent cache yet are fetched in the background and are unknown until then
+type httpGeoProvider struct {
+	url       string
+	cachePath string
+	client    *http.Client
+
+	cache   map[string]httpGeoCacheEntry
+	dirty   bool
+	pending map[string]struct{}
+	lock    sync.Mutex
+
+	queue  chan string
+	cancel func()
+	wg     sync.WaitGroup
+}
+
+func newHTTPGeoProvider(url, cachePath string, client *http.Client) *httpGeoProvider {
+	return &httpGeoProvider{
+		url:       url,
+		cachePath: cachePath,
+		client:    client,
+
+		cache:   map[string]httpGeoCacheEntry{},
+		pending: map[string]struct{}{},
+	}
+}
+
+// Open loads the cache and starts fetching in the background if it hasn't been started yet
+func (p *httpGeoProvider) Open() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.queue != nil {
+		return nil
+	}
+
+	if err := loadConfig(p.cachePath, &p.cache); err != nil {
+		log.Println("Could not load HTTP geolocation cache, starting with an empty cache:", err)
+
+		p.cache = map[string]httpGeoCacheEntry{}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	p.queue = make(chan string, httpGeoProviderQueueLen)
+	p.cancel = cancel
+
+	p.wg.Add(2)
+	go p.fetchQueued(ctx, p.queue)
+	go p.saveCache(ctx)
+
+	return nil
+}
+
+func (p *httpGeoProvider) Lookup(ip net.IP) geoIPRecord {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return geoIPRecord{}
+	}
+	key := addr.Unmap().String()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	entry, ok := p.cache[key]
+	if ok && time.Since(time.UnixMilli(entry.Timestamp)) < httpGeoProviderCacheTTL {
+		if !entry.Found {
+			return geoIPRecord{precision: locationPrecisionUnknown}
+		}
+
+		precision := locationPrecisionCity
+		if entry.CityName == "" {
+			precision = locationPrecisionCountry
+		}
+
+		return geoIPRecord{
+			countryName:     entry.CountryName,
+			cityName:        entry.CityName,
+			longitude:       entry.Longitude,
+			latitude:        entry.Latitude,
+			precision:       precision,
+			continentName:   entry.ContinentName,
+			subdivisionName: entry.SubdivisionName,
+			postalCode:      entry.PostalCode,
+			timeZone:        entry.TimeZone,
+		}
+	}
+
+	if _, ok := p.pending[key]; !ok && p.queue != nil {
+		select {
+		case p.queue <- key:
+			p.pending[key] = struct{}{}
+
+		default:
+			// The queue is full, so the address is queued again on a later lookup
+		}
+	}
+
+	return geoIPRecord{precision: locationPrecisionUnknown}
+}
+
+func (p *httpGeoProvider) fetchQueued(ctx context.Context, queue chan string) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(time.Minute / httpGeoProviderRequestsPerMinute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case key := <-queue:
+			select {
+			case <-ctx.Done():
+				return
+
+			case <-ticker.C:
+			}
+
+			entry, err := p.fetch(ctx, key)
+
+			p.lock.Lock()
+			delete(p.pending, key)
+			if err != nil {
+				log.Println("Could not look up location of", key, "with HTTP service:", err)
+			} else {
+				p.cache[key] = entry
+				p.dirty = true
+			}
+			p.lock.Unlock()
+		}
+	}
+}
+
+// getJSONValue returns the first of `keys` in `v` as a string
+func getJSONValue(v map[string]any, keys ...string) string {
+	for _, key := range keys {
+		switch value := v[key].(type) {
+		case string:
+			if value != "" {
+				return value
+			}
+
+		case float64:
+			return strconv.FormatFloat(value, 'f', -1, 64)
+		}
+	}
+
+	return ""
+}
+
+// fetch looks up an address; the field names of common services such as ip-api.com, ipapi.co and ipinfo.io are supported
+func (p *httpGeoProvider) fetch(ctx context.Context, key string) (httpGeoCacheEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, httpGeoProviderTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.ReplaceAll(p.url, "{ip}", url.PathEscape(key)), nil)
+	if err != nil {
+		return httpGeoCacheEntry{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return httpGeoCacheEntry{}, err
+	}
+	defer res.Body.Close()
+
+	entry := httpGeoCacheEntry{
+		Timestamp: time.Now().UnixMilli(),
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		return entry, nil
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return httpGeoCacheEntry{}, fmt.Errorf("%w: %v", ErrUnexpectedHTTPStatus, res.Status)
+	}
+
+	v := map[string]any{}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&v); err != nil {
+		return httpGeoCacheEntry{}, err
+	}
+
+	latitude, longitude := getJSONValue(v, "lat", "latitude"), getJSONValue(v, "lon", "lng", "longitude")
+	if loc := getJSONValue(v, "loc"); loc != "" {
+		latitude, longitude, _ = strings.Cut(loc, ",")
+	}
+
+	if entry.Latitude, err = strconv.ParseFloat(latitude, 64); err != nil {
+		return entry, nil
+	}
+
+	if entry.Longitude, err = strconv.ParseFloat(longitude, 64); err != nil {
+		return entry, nil
+	}
+
+	entry.Found = true
+	entry.CountryName = getJSONValue(v, "country_name", "country")
+	entry.CityName = getJSONValue(v, "city")
+	entry.ContinentName = getJSONValue(v, "continent_name", "continent")
+	entry.SubdivisionName = getJSONValue(v, "regionName", "region")
+	entry.PostalCode = getJSONValue(v, "zip", "postal")
+	entry.TimeZone = getJSONValue(v, "timezone", "time_zone")
+
+	return entry, nil
+}
+
+func (p *httpGeoProvider) saveCache(ctx context.Context) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(httpGeoProviderSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			if err := p.save(); err != nil {
+				log.Println("Could not save HTTP geolocation cache:", err)
+			}
+		}
+	}
+}
+
+// save removes expired entries from the cache and writes it if it has changed. The entries are copied so that
+// lookups don't wait for the file to be written
+func (p *httpGeoProvider) save() error {
+	p.lock.Lock()
+
+	for key, entry := range p.cache {
+		if time.Since(time.UnixMilli(entry.Timestamp)) >= httpGeoProviderCacheTTL {
+			delete(p.cache, key)
+
+			p.dirty = true
+		}
+	}
+
+	if !p.dirty {
+		p.lock.Unlock()
+
+		return nil
+	}
+
+	cache := maps.Clone(p.cache)
+	p.dirty = false
+
+	p.lock.Unlock()
+
+	if err := saveConfig(p.cachePath, cache); err != nil {
+		p.lock.Lock()
+		p.dirty = true
+		p.lock.Unlock()
+
+		return err
+	}
+
+	return nil
+}
+
+// Close stops fetching in the background and saves the cache
+func (p *httpGeoProvider) Close() error {
+	p.lock.Lock()
+	cancel := p.cancel
+	p.queue = nil
+	p.cancel = nil
+	p.pending = map[string]struct{}{}
+	p.lock.Unlock()
+
+	if cancel == nil {
+		return nil
+	}
+
+	cancel()
+	p.wg.Wait()
+
+	return p.save()
+}
@@ -0,0 +1,224 @@
+package backend
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseIP2LocationAddr(t *testing.T) {
+	tests := []struct {
+		number string
+		want   string // Empty if the number is invalid
+	}{
+		{"0", "0.0.0.0"},
+		{"16777216", "1.0.0.0"},
+		{"4294967295", "255.255.255.255"},
+
+		// IPv6 files use IPv4-mapped IPv6 addresses for IPv4
+		{"281470698520576", "1.0.0.0"},
+		{"281474976710655", "255.255.255.255"},
+
+		{"4294967296", "::1:0:0"},
+		{"42540766411282592856903984951653826560", "2001:db8::"},
+		{"340282366920938463463374607431768211455", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"},
+
+		{"340282366920938463463374607431768211456", ""},
+		{"-1", ""},
+		{"1.0.0.0", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.number, func(t *testing.T) {
+			got, err := parseIP2LocationAddr(tt.number)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("got %v, want an error", got)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want := netip.MustParseAddr(tt.want); got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseCSVGeoRanges(t *testing.T) {
+	ranges, err := parseCSVGeoRanges(strings.NewReader(`# cidr,latitude,longitude,country,city
+1.0.0.0/24,52.52,13.405,Germany,Berlin
+2.0.0.7/16, 48.8566, 2.3522, France
+::ffff:3.0.0.0/120,40.4168,-3.7038
+2001:db8::/32,35.6762,139.6503,Japan,Tokyo
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		from, to  string
+		latitude  float64
+		longitude float64
+		country   string
+		city      string
+	}{
+		{"1.0.0.0", "1.0.0.255", 52.52, 13.405, "Germany", "Berlin"},
+		{"2.0.0.0", "2.0.255.255", 48.8566, 2.3522, "France", ""},
+		{"3.0.0.0", "3.0.0.255", 40.4168, -3.7038, "", ""},
+		{"2001:db8::", "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", 35.6762, 139.6503, "Japan", "Tokyo"},
+	}
+
+	if len(ranges) != len(want) {
+		t.Fatalf("got %v ranges, want %v", len(ranges), len(want))
+	}
+
+	for i, w := range want {
+		got := ranges[i]
+
+		if got.from != netip.MustParseAddr(w.from) || got.to != netip.MustParseAddr(w.to) {
+			t.Errorf("range %v: got %v-%v, want %v-%v", i, got.from, got.to, w.from, w.to)
+		}
+
+		if got.record.latitude != w.latitude || got.record.longitude != w.longitude || got.record.countryName != w.country || got.record.cityName != w.city || got.record.precision != locationPrecisionCity {
+			t.Errorf("range %v: got %+v, want %+v", i, got.record, w)
+		}
+	}
+
+	for _, invalid := range []string{
+		"1.0.0.0/24,52.52\n",
+		"1.0.0.0,52.52,13.405\n",
+		"1.0.0.0/33,52.52,13.405\n",
+		"1.0.0.0/24,north,13.405\n",
+	} {
+		if _, err := parseCSVGeoRanges(strings.NewReader(invalid)); err == nil {
+			t.Errorf("%q: got no error", invalid)
+		}
+	}
+}
+
+func TestParseIP2LocationGeoRanges(t *testing.T) {
+	ranges, err := parseIP2LocationGeoRanges(strings.NewReader(`"0","16777215","-","-","-","-","0.000000","0.000000","-","-"
+"16777216","16777471","DE","Germany"
+"281470698520832","281470698521087","FR","France","Ile-de-France","Paris","48.853410","2.348800","75000","+01:00"
+"42540766411282592856903984951653826560","42540766411282592856903984951653892095","JP","Japan","Tokyo","Tokyo","0.000000","0.000000"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		from, to string
+		record   geoIPRecord
+	}{
+		{"1.0.0.0", "1.0.0.255", geoIPRecord{
+			countryName: "Germany",
+			longitude:   countryCentroids["DE"].longitude,
+			latitude:    countryCentroids["DE"].latitude,
+			precision:   locationPrecisionCountry,
+		}},
+		{"1.0.1.0", "1.0.1.255", geoIPRecord{
+			countryName:     "France",
+			subdivisionName: "Ile-de-France",
+			cityName:        "Paris",
+			longitude:       2.3488,
+			latitude:        48.85341,
+			precision:       locationPrecisionCity,
+			postalCode:      "75000",
+			timeZone:        "+01:00",
+		}},
+		{"2001:db8::", "2001:db8::ffff", geoIPRecord{
+			countryName:     "Japan",
+			subdivisionName: "Tokyo",
+			cityName:        "Tokyo",
+			longitude:       countryCentroids["JP"].longitude,
+			latitude:        countryCentroids["JP"].latitude,
+			precision:       locationPrecisionCountry,
+		}},
+	}
+
+	if len(ranges) != len(want) {
+		t.Fatalf("got %v ranges, want %v", len(ranges), len(want))
+	}
+
+	for i, w := range want {
+		got := ranges[i]
+
+		if got.from != netip.MustParseAddr(w.from) || got.to != netip.MustParseAddr(w.to) {
+			t.Errorf("range %v: got %v-%v, want %v-%v", i, got.from, got.to, w.from, w.to)
+		}
+
+		if got.record.countryName != w.record.countryName || got.record.subdivisionName != w.record.subdivisionName || got.record.cityName != w.record.cityName ||
+			got.record.longitude != w.record.longitude || got.record.latitude != w.record.latitude || got.record.precision != w.record.precision ||
+			got.record.postalCode != w.record.postalCode || got.record.timeZone != w.record.timeZone {
+			t.Errorf("range %v: got %+v, want %+v", i, got.record, w.record)
+		}
+	}
+
+	for _, invalid := range []string{
+		`"16777216","16777471","DE"`,
+		`"16777216","1.0.0.255","DE","Germany"`,
+		`"16777216","16777471","DE","Germany","-","-","north","13.405"`,
+	} {
+		if _, err := parseIP2LocationGeoRanges(strings.NewReader(invalid)); err == nil {
+			t.Errorf("%q: got no error", invalid)
+		}
+	}
+}
+
+func TestRangeGeoProviderLookup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ranges.csv")
+	if err := os.WriteFile(path, []byte(`2001:db8::/32,3,3,,IPv6
+1.0.0.0/24,1,1,,First
+1.0.2.0/23,2,2,,Second
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	provider := newCSVGeoProvider(path)
+	if err := provider.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+
+	tests := []struct {
+		ip   string
+		want string // City of the matching range, empty if there is none
+	}{
+		{"0.255.255.255", ""},
+		{"1.0.0.0", "First"},
+		{"1.0.0.255", "First"},
+		{"1.0.1.0", ""},
+		{"1.0.1.255", ""},
+		{"1.0.2.0", "Second"},
+		{"1.0.3.255", "Second"},
+		{"1.0.4.0", ""},
+		{"::ffff:1.0.0.7", "First"},
+
+		// IPv6 addresses whose numeric values are in IPv4 ranges don't match them
+		{"::100:0", ""},
+		{"::1.0.2.1", ""},
+
+		{"2001:db7:ffff:ffff:ffff:ffff:ffff:ffff", ""},
+		{"2001:db8::", "IPv6"},
+		{"2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", "IPv6"},
+		{"2001:db9::", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := provider.Lookup(net.ParseIP(tt.ip)); got.cityName != tt.want {
+				t.Errorf("got %q, want %q", got.cityName, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package backend
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+const (
+	geoIPCacheSize = 65536
+)
+
+// geoIPRecord contains the fields of an address found in a database; each database only fills in its own fields
+type geoIPRecord struct {
+	countryName string
+	cityName    string
+	longitude   float64
+	latitude    float64
+	precision   locationPrecision
+
+	continentName         string
+	subdivisionName       string
+	postalCode            string
+	timeZone              string
+	accuracyRadius        int
+	isAnycast             bool
+	registeredCountryName string
+
+	asn uint
+	org string
+
+	label string
+	tags  []string
+}
+
+func lookupASNRecord(db *geoip2.Reader, ip net.IP, locale string) geoIPRecord {
+	record, _ := db.ASN(ip)
+	if record == nil {
+		return geoIPRecord{}
+	}
+
+	return geoIPRecord{
+		asn: record.AutonomousSystemNumber,
+		org: record.AutonomousSystemOrganization,
+	}
+}
+
+// geoIPReader is a GeoIP database shared by all traces and lookups, which can be replaced while it is in use
+type geoIPReader struct {
+	path   string
+	reader *geoip2.Reader
+	lookup func(db *geoip2.Reader, ip net.IP, locale string) geoIPRecord
+	locale string
+	cache  *lruCache[netip.Addr, geoIPRecord]
+	lock   sync.RWMutex
+}
+
+func newGeoIPReader(path string, cacheSize int, lookup func(db *geoip2.Reader, ip net.IP, locale string) geoIPRecord) *geoIPReader {
+	return &geoIPReader{
+		path:   path,
+		lookup: lookup,
+		locale: defaultLocale,
+		cache:  newLRUCache[netip.Addr, geoIPRecord](cacheSize),
+	}
+}
+
+// SetLocale sets the locale of the names in looked up records
+func (g *geoIPReader) SetLocale(locale string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.locale = locale
+
+	g.cache.Purge()
+}
+
+func (g *geoIPReader) GetLocale() string {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	return g.locale
+}
+
+// Open opens the database if it isn't open yet
+func (g *geoIPReader) Open() error {
+	g.lock.RLock()
+	open := g.reader != nil
+	g.lock.RUnlock()
+
+	if open {
+		return nil
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.reader != nil {
+		return nil
+	}
+
+	reader, err := geoip2.Open(g.path)
+	if err != nil {
+		return err
+	}
+
+	g.reader = reader
+
+	return nil
+}
+
+// Update closes the database, calls `update` to change the file and opens the database again.
+// Lookups block until the new database is open, and return empty locations if it has been removed
+func (g *geoIPReader) Update(update func(path string) error) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.reader != nil {
+		if err := g.reader.Close(); err != nil {
+			return err
+		}
+
+		g.reader = nil
+	}
+
+	g.cache.Purge()
+
+	updateErr := update(g.path)
+
+	reader, err := geoip2.Open(g.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return updateErr
+		}
+
+		return errors.Join(updateErr, err)
+	}
+
+	g.reader = reader
+
+	return updateErr
+}
+
+// Lookup returns the record of `ip`, or an empty record if it isn't in the database or the database isn't open
+func (g *geoIPReader) Lookup(ip net.IP) geoIPRecord {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return geoIPRecord{}
+	}
+	addr = addr.Unmap()
+
+	if record, ok := g.cache.Get(addr); ok {
+		return record
+	}
+
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	if g.reader == nil {
+		return geoIPRecord{}
+	}
+
+	record := g.lookup(g.reader, ip, g.locale)
+
+	g.cache.Add(addr, record)
+
+	return record
+}
+
+type databaseInfo struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+
+	DatabaseType string   `json:"databaseType"` // E.g. `GeoLite2-City`, `GeoLite2-Country` or `GeoLite2-ASN`
+	Description  string   `json:"description"`
+	BuildEpoch   int64    `json:"buildEpoch"` // Unix seconds
+	IPVersion    int      `json:"ipVersion"`
+	Languages    []string `json:"languages"`
+	NodeCount    int      `json:"nodeCount"`
+
+	Age      int64 `json:"age"`      // Seconds since the build epoch
+	Outdated bool  `json:"outdated"` // Whether the database is older than the maximum database age
+}
+
+// Info returns the metadata of the database, opening it if it isn't open yet
+func (g *geoIPReader) Info() (databaseInfo, error) {
+	if err := g.Open(); err != nil {
+		return databaseInfo{}, err
+	}
+
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	if g.reader == nil {
+		return databaseInfo{}, os.ErrNotExist
+	}
+
+	stat, err := os.Stat(g.path)
+	if err != nil {
+		return databaseInfo{}, err
+	}
+
+	metadata := g.reader.Metadata()
+
+	return databaseInfo{
+		Path: g.path,
+		Size: stat.Size(),
+
+		DatabaseType: metadata.DatabaseType,
+		Description:  metadata.Description["en"],
+		BuildEpoch:   int64(metadata.BuildEpoch),
+		IPVersion:    int(metadata.IPVersion),
+		Languages:    metadata.Languages,
+		NodeCount:    int(metadata.NodeCount),
+	}, nil
+}
+
+func (g *geoIPReader) Close() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.cache.Purge()
+
+	if g.reader == nil {
+		return nil
+	}
+
+	err := g.reader.Close()
+	g.reader = nil
+
+	return err
+}
@@ -0,0 +1,576 @@
+package backend
+
+import (
+	"bufio"
+	"cmp"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	historySegmentPrefix   = "flows-"
+	historySegmentSuffix   = ".jsonl"
+	historySegmentDuration = time.Hour
+	historyMaxSegmentSize  = 16 * 1024 * 1024
+
+	historyFlushInterval     = time.Second
+	historyRetentionInterval = time.Minute
+
+	defaultHistoryMaxAge  = int64(time.Hour * 24 * 30 / time.Second)
+	defaultHistoryMaxSize = 256 * 1024 * 1024
+
+	// Retention is enforced by removing whole segments, so the history must be able to hold at least one
+	minHistoryMaxAge  = int64(historySegmentDuration / time.Second)
+	minHistoryMaxSize = historyMaxSegmentSize
+
+	defaultHistoryQueryLimit = 10000
+
+	// Records which couldn't be written are kept for the next flush up to this limit
+	historyMaxPendingRecords = 100000
+)
+
+// flowRecord is a connection written to the history once it has been removed from the connections table
+type flowRecord struct {
+	tracedConnection
+
+	LastSeen int64 `json:"lastSeen"` // Unix milliseconds of the last packet; `timestamp` is the first packet
+}
+
+type historySegment struct {
+	path  string
+	start time.Time
+	size  int64
+}
+
+type historyInfo struct {
+	Enabled  bool  `json:"enabled"`
+	Size     int64 `json:"size"` // Bytes on disk
+	Segments int   `json:"segments"`
+	Oldest   int64 `json:"oldest"` // Unix milliseconds of when the oldest segment was started, or 0 if there are none
+}
+
+// queriedFlowRecord is a record which matched a query; `seq` is the order it was read in, which breaks ties between
+// records with the same first packet
+type queriedFlowRecord struct {
+	flowRecord
+
+	seq int
+}
+
+func compareQueriedFlowRecords(a, b queriedFlowRecord) int {
+	return cmp.Or(cmp.Compare(a.Timestamp, b.Timestamp), cmp.Compare(a.seq, b.seq))
+}
+
+// queriedFlowRecords is a max-heap with the record with the latest first packet at the top, which keeps the
+// earliest records of a query without keeping all matching records in memory
+type queriedFlowRecords []queriedFlowRecord
+
+func (r queriedFlowRecords) Len() int           { return len(r) }
+func (r queriedFlowRecords) Less(i, j int) bool { return compareQueriedFlowRecords(r[i], r[j]) > 0 }
+func (r queriedFlowRecords) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+func (r *queriedFlowRecords) Push(x any) {
+	*r = append(*r, x.(queriedFlowRecord))
+}
+
+func (r *queriedFlowRecords) Pop() any {
+	old := *r
+	x := old[len(old)-1]
+	*r = old[:len(old)-1]
+
+	return x
+}
+
+// flowHistory stores flow records on disk in append-only segments of JSON lines, which are named after the time
+// they were started at. Records are buffered in memory and written in the background, and whole segments are
+// removed once they are older than the maximum age or the history is larger than the maximum size
+type flowHistory struct {
+	dir string
+
+	enabled bool
+	maxAge  time.Duration
+	maxSize int64
+	pending []flowRecord
+	lock    sync.Mutex
+
+	file      *os.File
+	segment   historySegment
+	writeLock sync.Mutex
+}
+
+func newFlowHistory(dir string) *flowHistory {
+	return &flowHistory{
+		dir: dir,
+	}
+}
+
+// SetRetention configures whether records are written, and after which age in seconds and above which size in bytes
+// the oldest records are removed
+func (h *flowHistory) SetRetention(enabled bool, maxAge, maxSize int64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.enabled = enabled
+	h.maxAge = time.Duration(maxAge) * time.Second
+	h.maxSize = maxSize
+
+	if !enabled {
+		h.pending = nil
+	}
+}
+
+// Add queues a record to be written; it never blocks on the disk
+func (h *flowHistory) Add(record flowRecord) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if !h.enabled {
+		return
+	}
+
+	h.pending = append(h.pending, record)
+}
+
+func parseHistorySegmentStart(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, historySegmentPrefix) || !strings.HasSuffix(name, historySegmentSuffix) {
+		return time.Time{}, false
+	}
+
+	start, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, historySegmentPrefix), historySegmentSuffix), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.UnixMilli(start), true
+}
+
+// listSegments returns the segments from the oldest to the newest
+func (h *flowHistory) listSegments() ([]historySegment, error) {
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []historySegment{}, nil
+		}
+
+		return nil, err
+	}
+
+	segments := []historySegment{}
+	for _, entry := range entries {
+		start, ok := parseHistorySegmentStart(entry.Name())
+		if !ok || entry.IsDir() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		segments = append(segments, historySegment{
+			path:  filepath.Join(h.dir, entry.Name()),
+			start: start,
+			size:  info.Size(),
+		})
+	}
+
+	slices.SortFunc(segments, func(a, b historySegment) int {
+		return a.start.Compare(b.start)
+	})
+
+	return segments, nil
+}
+
+// closeSegmentLocked closes the segment which is being written to; the write lock must be held
+func (h *flowHistory) closeSegmentLocked() error {
+	if h.file == nil {
+		return nil
+	}
+
+	err := h.file.Close()
+
+	h.file = nil
+
+	return err
+}
+
+// writeLocked appends `lines` to the current segment, or to a new one if it is too old or too large, and returns
+// how many lines were written completely; the write lock must be held
+func (h *flowHistory) writeLocked(lines [][]byte) (int, error) {
+	now := time.Now()
+	if h.file != nil && (now.Sub(h.segment.start) > historySegmentDuration || h.segment.size > historyMaxSegmentSize) {
+		if err := h.closeSegmentLocked(); err != nil {
+			return 0, err
+		}
+	}
+
+	if h.file == nil {
+		if err := os.MkdirAll(h.dir, os.ModePerm); err != nil {
+			return 0, err
+		}
+
+		h.segment = historySegment{
+			path:  filepath.Join(h.dir, historySegmentPrefix+strconv.FormatInt(now.UnixMilli(), 10)+historySegmentSuffix),
+			start: now,
+		}
+
+		file, err := os.OpenFile(h.segment.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return 0, err
+		}
+
+		info, err := file.Stat()
+		if err != nil {
+			return 0, errors.Join(err, file.Close())
+		}
+
+		h.file = file
+		h.segment.size = info.Size()
+	}
+
+	n, err := h.file.Write(slices.Concat(lines...))
+
+	written := 0
+	for ; written < len(lines) && len(lines[written]) <= n; written++ {
+		n -= len(lines[written])
+		h.segment.size += int64(len(lines[written]))
+	}
+
+	if err != nil {
+		// Remove the line which was cut off, since segments are only read up to the first incomplete record
+		return written, errors.Join(err, h.file.Truncate(h.segment.size), h.closeSegmentLocked())
+	}
+
+	return written, nil
+}
+
+// Flush writes the queued records to disk. Records which couldn't be written are queued again to be retried on the
+// next flush, and the oldest ones are dropped if more than `historyMaxPendingRecords` are queued
+func (h *flowHistory) Flush() error {
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
+
+	h.lock.Lock()
+	records := h.pending
+	h.pending = nil
+	h.lock.Unlock()
+
+	if len(records) == 0 {
+		return nil
+	}
+
+	encoded, lines := []flowRecord{}, [][]byte{}
+	for _, record := range records {
+		b, err := json.Marshal(record)
+		if err != nil {
+			log.Println("Could not encode flow record, dropping it:", err)
+
+			continue
+		}
+
+		encoded = append(encoded, record)
+		lines = append(lines, append(b, '\n'))
+	}
+
+	written, err := h.writeLocked(lines)
+	if err == nil {
+		return nil
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.enabled {
+		h.pending = slices.Concat(encoded[written:], h.pending)
+		if dropped := len(h.pending) - historyMaxPendingRecords; dropped > 0 {
+			log.Println("Dropping", dropped, "flow records which could not be written")
+
+			h.pending = h.pending[dropped:]
+		}
+	}
+
+	return err
+}
+
+// EnforceRetention removes the segments which only contain records older than the maximum age, and then the
+// oldest segments until the history is no larger than the maximum size
+func (h *flowHistory) EnforceRetention() error {
+	h.lock.Lock()
+	maxAge, maxSize := h.maxAge, h.maxSize
+	h.lock.Unlock()
+
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
+
+	segments, err := h.listSegments()
+	if err != nil {
+		return err
+	}
+
+	size := int64(0)
+	for _, segment := range segments {
+		size += segment.size
+	}
+
+	now := time.Now()
+	for i, segment := range segments {
+		// Records are written after they were last seen, so a segment only contains records from before the next one started
+		expired := maxAge > 0 && i < len(segments)-1 && now.Sub(segments[i+1].start) > maxAge
+		oversized := maxSize > 0 && size > maxSize
+		if !expired && !oversized {
+			break
+		}
+
+		if h.file != nil && segment.path == h.segment.path {
+			if err := h.closeSegmentLocked(); err != nil {
+				return err
+			}
+		}
+
+		if err := os.Remove(segment.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		size -= segment.size
+	}
+
+	return nil
+}
+
+// Query returns up to `limit` records of flows which were active between `from` and `to` (Unix milliseconds) and
+// for which `matches` returns true, ordered by their first packet. A `limit` of 0 returns all records, and a nil
+// `matches` matches all records
+func (h *flowHistory) Query(from, to int64, limit int, matches func(record flowRecord) bool) ([]flowRecord, error) {
+	if err := h.Flush(); err != nil {
+		return nil, err
+	}
+
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
+
+	segments, err := h.listSegments()
+	if err != nil {
+		return nil, err
+	}
+
+	// Records are written when their flow ends, so the first packets of the records in later segments can be earlier
+	// than those in earlier ones, and all segments in the time range have to be read
+	var (
+		found = &queriedFlowRecords{}
+		seq   = 0
+	)
+	for i, segment := range segments {
+		// Segments which ended before `from` can't contain flows which were seen after it
+		if i < len(segments)-1 && segments[i+1].start.UnixMilli() < from {
+			continue
+		}
+
+		if err := func() error {
+			file, err := os.Open(segment.path)
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					return nil
+				}
+
+				return err
+			}
+			defer file.Close()
+
+			decoder := json.NewDecoder(bufio.NewReader(file))
+			for {
+				var record flowRecord
+				if err := decoder.Decode(&record); err != nil {
+					if err == io.EOF {
+						return nil
+					}
+
+					// Segments which were cut off while writing, e.g. because the app crashed, are read up to the last complete record
+					log.Println("Could not read flow history segment", segment.path, "completely:", err)
+
+					return nil
+				}
+
+				if record.Timestamp > to || record.LastSeen < from || (matches != nil && !matches(record)) {
+					continue
+				}
+
+				queried := queriedFlowRecord{record, seq}
+				seq++
+
+				if limit <= 0 || found.Len() < limit {
+					heap.Push(found, queried)
+				} else if compareQueriedFlowRecords(queried, (*found)[0]) < 0 {
+					(*found)[0] = queried
+					heap.Fix(found, 0)
+				}
+			}
+		}(); err != nil {
+			return nil, err
+		}
+	}
+
+	slices.SortFunc(*found, compareQueriedFlowRecords)
+
+	records := make([]flowRecord, len(*found))
+	for i, queried := range *found {
+		records[i] = queried.flowRecord
+	}
+
+	return records, nil
+}
+
+func (h *flowHistory) Info() (historyInfo, error) {
+	h.lock.Lock()
+	enabled := h.enabled
+	h.lock.Unlock()
+
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
+
+	segments, err := h.listSegments()
+	if err != nil {
+		return historyInfo{}, err
+	}
+
+	info := historyInfo{
+		Enabled:  enabled,
+		Segments: len(segments),
+	}
+	for _, segment := range segments {
+		info.Size += segment.size
+	}
+	if len(segments) > 0 {
+		info.Oldest = segments[0].start.UnixMilli()
+	}
+
+	return info, nil
+}
+
+// Clear removes all records
+func (h *flowHistory) Clear() error {
+	// Failed flushes queue their records again while holding the write lock, so it must be held to drop them
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
+
+	h.lock.Lock()
+	h.pending = nil
+	h.lock.Unlock()
+
+	if err := h.closeSegmentLocked(); err != nil {
+		return err
+	}
+
+	segments, err := h.listSegments()
+	if err != nil {
+		return err
+	}
+
+	for _, segment := range segments {
+		if err := os.Remove(segment.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close writes the queued records and closes the segment which is being written to
+func (h *flowHistory) Close() error {
+	if err := h.Flush(); err != nil {
+		return err
+	}
+
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
+
+	return h.closeSegmentLocked()
+}
+
+// runHistory periodically writes the queued records and enforces the retention until `ctx` is cancelled
+func (l *local) runHistory(ctx context.Context) {
+	flushes := time.NewTicker(historyFlushInterval)
+	defer flushes.Stop()
+
+	retentions := time.NewTicker(historyRetentionInterval)
+	defer retentions.Stop()
+
+	if err := l.history.EnforceRetention(); err != nil {
+		log.Println("Could not enforce flow history retention:", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-flushes.C:
+			if err := l.history.Flush(); err != nil {
+				log.Println("Could not write flow history:", err)
+			}
+
+		case <-retentions.C:
+			if err := l.history.EnforceRetention(); err != nil {
+				log.Println("Could not enforce flow history retention:", err)
+			}
+		}
+	}
+}
+
+// closeHistory records the connections which are still active and writes all queued records
+func (l *local) closeHistory() error {
+	l.connectionsLock.Lock()
+	l.connections.Clear()
+	l.connectionsLock.Unlock()
+
+	return l.history.Close()
+}
+
+// QueryHistory returns up to `limit` flows which were active between `from` and `to` (Unix milliseconds) and match
+// the filter expression `filter`, ordered by their first packet. A `limit` of 0 uses the default limit, and an empty
+// filter matches all flows
+func (l *local) QueryHistory(ctx context.Context, from, to int64, limit int, filter string) ([]flowRecord, error) {
+	if from > to {
+		return nil, errors.Join(ErrInvalidHistoryQuery, fmt.Errorf("start of the time range must not be after its end"))
+	}
+
+	if limit < 0 {
+		return nil, errors.Join(ErrInvalidHistoryQuery, fmt.Errorf("limit must not be negative"))
+	}
+
+	if limit == 0 {
+		limit = defaultHistoryQueryLimit
+	}
+
+	f, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return l.history.Query(from, to, limit, func(record flowRecord) bool {
+		return f.Match(record.tracedConnection)
+	})
+}
+
+func (l *local) GetHistoryInfo(ctx context.Context) (historyInfo, error) {
+	return l.history.Info()
+}
+
+func (l *local) ClearHistory(ctx context.Context) error {
+	return l.history.Clear()
+}
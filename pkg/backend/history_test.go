@@ -0,0 +1,156 @@
+package backend
+
+import (
+	"cmp"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestFlowHistoryQueryLimit(t *testing.T) {
+	h := newFlowHistory(t.TempDir())
+	h.SetRetention(true, defaultHistoryMaxAge, defaultHistoryMaxSize)
+
+	// Records are spread over multiple segments in random order, with some sharing their first packet
+	var (
+		r       = rand.New(rand.NewPCG(1, 2))
+		records = []flowRecord{}
+	)
+	for segment := 0; segment < 3; segment++ {
+		for i := 0; i < 200; i++ {
+			record := flowRecord{
+				tracedConnection: newTestFlow("10.0.0.1", "1.1.1.1", len(records), 443, 1),
+				LastSeen:         int64(1000 + r.IntN(1000)),
+			}
+			record.Timestamp = int64(r.IntN(100))
+
+			h.Add(record)
+			records = append(records, record)
+		}
+
+		if err := h.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	slices.SortStableFunc(records, func(a, b flowRecord) int {
+		return cmp.Compare(a.Timestamp, b.Timestamp)
+	})
+
+	for _, limit := range []int{0, 1, 10, 599, 600, 1000} {
+		got, err := h.Query(0, math.MaxInt64, limit, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := records
+		if limit > 0 && len(want) > limit {
+			want = want[:limit]
+		}
+
+		if len(got) != len(want) {
+			t.Fatalf("limit %v: got %v records, want %v", limit, len(got), len(want))
+		}
+
+		for i := range want {
+			if got[i].Timestamp != want[i].Timestamp || got[i].SrcPort != want[i].SrcPort {
+				t.Fatalf("limit %v: record %v has first packet %v and port %v, want %v and %v", limit, i, got[i].Timestamp, got[i].SrcPort, want[i].Timestamp, want[i].SrcPort)
+			}
+		}
+	}
+
+	got, err := h.Query(50, 60, 5, func(record flowRecord) bool {
+		return record.SrcPort%2 == 0
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []flowRecord{}
+	for _, record := range records {
+		if record.Timestamp <= 60 && record.LastSeen >= 50 && record.SrcPort%2 == 0 && len(want) < 5 {
+			want = append(want, record)
+		}
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %v records, want %v", len(got), len(want))
+	}
+
+	for i := range want {
+		if got[i].SrcPort != want[i].SrcPort {
+			t.Errorf("record %v has port %v, want %v", i, got[i].SrcPort, want[i].SrcPort)
+		}
+	}
+}
+
+func TestFlowHistoryFlushRetries(t *testing.T) {
+	// A file in place of the history directory makes writing fail until it is removed
+	dir := filepath.Join(t.TempDir(), "history")
+	if err := os.WriteFile(dir, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	h := newFlowHistory(dir)
+	h.SetRetention(true, defaultHistoryMaxAge, defaultHistoryMaxSize)
+
+	for port := 1; port <= 3; port++ {
+		h.Add(flowRecord{tracedConnection: newTestFlow("10.0.0.1", "1.1.1.1", port, 443, 1)})
+	}
+
+	if err := h.Flush(); err == nil {
+		t.Fatal("got no error, want one")
+	}
+
+	h.Add(flowRecord{tracedConnection: newTestFlow("10.0.0.1", "1.1.1.1", 4, 443, 1)})
+
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := h.Query(0, math.MaxInt64, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ports := []int{}
+	for _, record := range records {
+		ports = append(ports, record.SrcPort)
+	}
+
+	if want := []int{1, 2, 3, 4}; !slices.Equal(ports, want) {
+		t.Errorf("got ports %v, want %v", ports, want)
+	}
+
+	// Only the latest records are kept while writing keeps failing
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(dir, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for port := 0; port < historyMaxPendingRecords+10; port++ {
+		h.Add(flowRecord{tracedConnection: newTestFlow("10.0.0.1", "1.1.1.1", port, 443, 1)})
+	}
+
+	if err := h.Flush(); err == nil {
+		t.Fatal("got no error, want one")
+	}
+
+	if len(h.pending) != historyMaxPendingRecords || h.pending[0].SrcPort != 10 {
+		t.Errorf("got %v queued records starting at port %v, want %v starting at port 10", len(h.pending), h.pending[0].SrcPort, historyMaxPendingRecords)
+	}
+}
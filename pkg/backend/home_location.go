@@ -0,0 +1,42 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+)
+
+// homeLocation is used for all private and special-purpose addresses, which GeoIP databases can't locate
+type homeLocation struct {
+	Label     string  `json:"label"`
+	Longitude float64 `json:"longitude"`
+	Latitude  float64 `json:"latitude"`
+
+	// GuessFromTraffic replaces the coordinates with the location of the first public address of a traced device seen in traffic.
+	// This only works if the traced device has a public address itself, so behind NAT the coordinates are never replaced
+	GuessFromTraffic bool `json:"guessFromTraffic"`
+}
+
+func (h homeLocation) validate() error {
+	if h.Longitude < -180 || h.Longitude > 180 {
+		return errors.Join(ErrInvalidHomeLocation, fmt.Errorf("longitude must be between -180 and 180, got %v", h.Longitude))
+	}
+
+	if h.Latitude < -90 || h.Latitude > 90 {
+		return errors.Join(ErrInvalidHomeLocation, fmt.Errorf("latitude must be between -90 and 90, got %v", h.Latitude))
+	}
+
+	return nil
+}
+
+func loadHomeLocation(path string) (homeLocation, error) {
+	h := homeLocation{}
+	if err := loadConfig(path, &h); err != nil {
+		return homeLocation{}, err
+	}
+
+	return h, h.validate()
+}
+
+func saveHomeLocation(path string, h homeLocation) error {
+	return saveConfig(path, h)
+}
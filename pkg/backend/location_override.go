@@ -0,0 +1,340 @@
+package backend
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	locationOverrideTagSeparator = ";"
+)
+
+var (
+	locationOverridesCSVHeader = []string{"cidr", "label", "latitude", "longitude", "tags"}
+)
+
+// locationOverride maps a range of addresses to a label, tags and optionally coordinates, e.g. to show internal networks on the globe
+type locationOverride struct {
+	CIDR      string   `json:"cidr"`
+	Label     string   `json:"label"`
+	Longitude float64  `json:"longitude"` // Longitude and latitude of 0 keep the location from the geolocation providers or the home location
+	Latitude  float64  `json:"latitude"`
+	Tags      []string `json:"tags"`
+}
+
+func (o locationOverride) hasLocation() bool {
+	return o.Longitude != 0 || o.Latitude != 0
+}
+
+// normalize validates the override and returns it with its CIDR in canonical form, e.g. `10.20.0.0/16` for `10.20.1.2/16`
+func (o locationOverride) normalize() (locationOverride, error) {
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(o.CIDR))
+	if err != nil {
+		return locationOverride{}, errors.Join(ErrInvalidLocationOverride, err)
+	}
+	if addr := prefix.Addr(); addr.Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96)
+	}
+	o.CIDR = prefix.Masked().String()
+
+	if o.Longitude < -180 || o.Longitude > 180 {
+		return locationOverride{}, errors.Join(ErrInvalidLocationOverride, fmt.Errorf("longitude must be between -180 and 180"))
+	}
+
+	if o.Latitude < -90 || o.Latitude > 90 {
+		return locationOverride{}, errors.Join(ErrInvalidLocationOverride, fmt.Errorf("latitude must be between -90 and 90"))
+	}
+
+	o.Label = strings.TrimSpace(o.Label)
+
+	tags := []string{}
+	for _, tag := range o.Tags {
+		if tag = strings.TrimSpace(tag); tag != "" && !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	o.Tags = tags
+
+	return o, nil
+}
+
+// locationOverrideLevel contains the overrides with prefixes of the same length
+type locationOverrideLevel struct {
+	bits      int
+	overrides map[netip.Prefix]int // Positions in `locationOverrides.overrides` by prefix
+}
+
+// locationOverrides is the persistent table of location overrides, in which the most specific override of an address wins.
+// Lookups check the prefix of the address for each prefix length that is in use, so they don't depend on the number of overrides
+type locationOverrides struct {
+	path      string
+	overrides []locationOverride      // Sorted from the most to the least specific prefix
+	levels4   []locationOverrideLevel // Levels of the IPv4 overrides from the longest to the shortest prefix length
+	levels6   []locationOverrideLevel
+	lock      sync.RWMutex
+}
+
+func newLocationOverrides(path string) *locationOverrides {
+	return &locationOverrides{
+		path: path,
+	}
+}
+
+// setLocked replaces the overrides; the lock must be held
+func (t *locationOverrides) setLocked(overrides []locationOverride) {
+	overrides = slices.Clone(overrides)
+	slices.SortStableFunc(overrides, func(a, b locationOverride) int {
+		return netip.MustParsePrefix(b.CIDR).Bits() - netip.MustParsePrefix(a.CIDR).Bits()
+	})
+
+	levels4, levels6 := []locationOverrideLevel{}, []locationOverrideLevel{}
+	for i, override := range overrides {
+		prefix := netip.MustParsePrefix(override.CIDR)
+
+		levels := &levels6
+		if prefix.Addr().Is4() {
+			levels = &levels4
+		}
+
+		if len(*levels) == 0 || (*levels)[len(*levels)-1].bits != prefix.Bits() {
+			*levels = append(*levels, locationOverrideLevel{
+				bits:      prefix.Bits(),
+				overrides: map[netip.Prefix]int{},
+			})
+		}
+
+		// If the file contains the same prefix more than once, the first one wins
+		level := (*levels)[len(*levels)-1]
+		if _, ok := level.overrides[prefix]; !ok {
+			level.overrides[prefix] = i
+		}
+	}
+
+	t.overrides = overrides
+	t.levels4 = levels4
+	t.levels6 = levels6
+}
+
+// saveLocked persists and replaces the overrides; the lock must be held
+func (t *locationOverrides) saveLocked(overrides []locationOverride) error {
+	if err := saveConfig(t.path, overrides); err != nil {
+		return err
+	}
+
+	t.setLocked(overrides)
+
+	return nil
+}
+
+// Load reads the overrides from disk; a missing file results in no overrides
+func (t *locationOverrides) Load() error {
+	overrides := []locationOverride{}
+	if err := loadConfig(t.path, &overrides); err != nil {
+		return err
+	}
+
+	for i, override := range overrides {
+		normalized, err := override.normalize()
+		if err != nil {
+			return err
+		}
+
+		overrides[i] = normalized
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.setLocked(overrides)
+
+	return nil
+}
+
+// Lookup returns the most specific override of `ip`
+func (t *locationOverrides) Lookup(ip net.IP) (locationOverride, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return locationOverride{}, false
+	}
+	addr = addr.Unmap()
+
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	levels := t.levels6
+	if addr.Is4() {
+		levels = t.levels4
+	}
+
+	for _, level := range levels {
+		prefix, err := addr.Prefix(level.bits)
+		if err != nil {
+			continue
+		}
+
+		if i, ok := level.overrides[prefix]; ok {
+			return t.overrides[i], true
+		}
+	}
+
+	return locationOverride{}, false
+}
+
+func (t *locationOverrides) List() []locationOverride {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return slices.Clone(t.overrides)
+}
+
+// Put adds an override or replaces the override with the same CIDR
+func (t *locationOverrides) Put(override locationOverride) (locationOverride, error) {
+	override, err := override.normalize()
+	if err != nil {
+		return locationOverride{}, err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	overrides := slices.DeleteFunc(slices.Clone(t.overrides), func(candidate locationOverride) bool {
+		return candidate.CIDR == override.CIDR
+	})
+
+	return override, t.saveLocked(append(overrides, override))
+}
+
+// Delete removes the override with `cidr`, and returns false if there is none
+func (t *locationOverrides) Delete(cidr string) (bool, error) {
+	normalized, err := locationOverride{CIDR: cidr}.normalize()
+	if err != nil {
+		return false, err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	overrides := slices.DeleteFunc(slices.Clone(t.overrides), func(candidate locationOverride) bool {
+		return candidate.CIDR == normalized.CIDR
+	})
+	if len(overrides) == len(t.overrides) {
+		return false, nil
+	}
+
+	return true, t.saveLocked(overrides)
+}
+
+// Import reads `cidr,label,latitude,longitude,tags` rows from `r`, in which tags are separated by `;` and empty
+// coordinates keep the location of the address. The header row is optional. Imported overrides replace existing
+// overrides with the same CIDR; if `replace` is set, all existing overrides are removed. Returns the number of imported overrides
+func (t *locationOverrides) Import(r io.Reader, replace bool) (int, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	imported := []locationOverride{}
+	for line := 1; ; line++ {
+		fields, err := reader.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+
+			return 0, errors.Join(ErrInvalidLocationOverride, err)
+		}
+
+		if line == 1 && strings.EqualFold(strings.TrimSpace(fields[0]), locationOverridesCSVHeader[0]) {
+			continue
+		}
+
+		override := locationOverride{
+			CIDR: fields[0],
+		}
+		if len(fields) > 1 {
+			override.Label = fields[1]
+		}
+
+		if len(fields) > 3 && (strings.TrimSpace(fields[2]) != "" || strings.TrimSpace(fields[3]) != "") {
+			if override.Latitude, err = strconv.ParseFloat(strings.TrimSpace(fields[2]), 64); err != nil {
+				return 0, errors.Join(ErrInvalidLocationOverride, fmt.Errorf("line %v: %w", line, err))
+			}
+
+			if override.Longitude, err = strconv.ParseFloat(strings.TrimSpace(fields[3]), 64); err != nil {
+				return 0, errors.Join(ErrInvalidLocationOverride, fmt.Errorf("line %v: %w", line, err))
+			}
+		}
+
+		if len(fields) > 4 {
+			override.Tags = strings.Split(fields[4], locationOverrideTagSeparator)
+		}
+
+		if override, err = override.normalize(); err != nil {
+			return 0, fmt.Errorf("line %v: %w", line, err)
+		}
+
+		imported = append(imported, override)
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	overrides := []locationOverride{}
+	if !replace {
+		overrides = slices.DeleteFunc(slices.Clone(t.overrides), func(candidate locationOverride) bool {
+			return slices.ContainsFunc(imported, func(override locationOverride) bool {
+				return override.CIDR == candidate.CIDR
+			})
+		})
+	}
+
+	// Later rows for the same CIDR win
+	for _, override := range imported {
+		overrides = slices.DeleteFunc(overrides, func(candidate locationOverride) bool {
+			return candidate.CIDR == override.CIDR
+		})
+
+		overrides = append(overrides, override)
+	}
+
+	return len(imported), t.saveLocked(overrides)
+}
+
+// Export writes the overrides to `w` in the format read by `Import`
+func (t *locationOverrides) Export(w io.Writer) error {
+	writer := csv.NewWriter(w)
+
+	if err := writer.Write(locationOverridesCSVHeader); err != nil {
+		return err
+	}
+
+	for _, override := range t.List() {
+		latitude, longitude := "", ""
+		if override.hasLocation() {
+			latitude = strconv.FormatFloat(override.Latitude, 'f', -1, 64)
+			longitude = strconv.FormatFloat(override.Longitude, 'f', -1, 64)
+		}
+
+		if err := writer.Write([]string{
+			override.CIDR,
+			override.Label,
+			latitude,
+			longitude,
+			strings.Join(override.Tags, locationOverrideTagSeparator),
+		}); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+
+	return writer.Error()
+}
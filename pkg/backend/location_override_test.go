@@ -0,0 +1,191 @@
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestLocationOverrides(t testing.TB, overrides ...locationOverride) *locationOverrides {
+	t.Helper()
+
+	table := newLocationOverrides(filepath.Join(t.TempDir(), "location-overrides.json"))
+	for _, override := range overrides {
+		if _, err := table.Put(override); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return table
+}
+
+func TestLocationOverridesLookup(t *testing.T) {
+	table := newTestLocationOverrides(
+		t,
+		locationOverride{CIDR: "0.0.0.0/0", Label: "Internet"},
+		locationOverride{CIDR: "10.0.0.0/8", Label: "Office"},
+		locationOverride{CIDR: "10.20.1.2/16", Label: "Lab"},
+		locationOverride{CIDR: "10.20.30.40/32", Label: "Printer"},
+		locationOverride{CIDR: "192.168.0.0/24", Label: "Home"},
+		locationOverride{CIDR: "2001:db8::/32", Label: "Documentation"},
+		locationOverride{CIDR: "2001:db8:1::/48", Label: "VPN"},
+		locationOverride{CIDR: "::ffff:172.16.0.0/108", Label: "Mapped"},
+	)
+
+	tests := []struct {
+		ip    string
+		label string
+	}{
+		{"10.1.2.3", "Office"},
+		{"10.20.0.1", "Lab"},
+		{"10.20.30.40", "Printer"},
+		{"10.20.30.41", "Lab"},
+		{"192.168.0.255", "Home"},
+		{"192.168.1.1", "Internet"},
+		{"::ffff:10.20.30.40", "Printer"},
+		{"172.16.1.1", "Mapped"},
+		{"2001:db8::1", "Documentation"},
+		{"2001:db8:1::1", "VPN"},
+		{"2001:db9::1", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			override, ok := table.Lookup(net.ParseIP(tt.ip))
+			if ok != (tt.label != "") || override.Label != tt.label {
+				t.Errorf("got %q (%v), want %q", override.Label, ok, tt.label)
+			}
+		})
+	}
+
+	if _, err := table.Delete("10.20.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+
+	if override, _ := table.Lookup(net.ParseIP("10.20.0.1")); override.Label != "Office" {
+		t.Errorf("got %q after deleting the more specific override, want %q", override.Label, "Office")
+	}
+}
+
+func TestLocationOverridesLoad(t *testing.T) {
+	table := newTestLocationOverrides(t, locationOverride{CIDR: "10.0.0.0/8", Label: "Office"}, locationOverride{CIDR: "10.1.0.0/16", Label: "Lab"})
+
+	loaded := newLocationOverrides(table.path)
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	if override, _ := loaded.Lookup(net.ParseIP("10.1.0.1")); override.Label != "Lab" {
+		t.Errorf("got %q, want %q", override.Label, "Lab")
+	}
+}
+
+func TestLocationOverridesCSVRoundTrip(t *testing.T) {
+	table := newTestLocationOverrides(
+		t,
+		locationOverride{CIDR: "10.0.0.0/8", Label: "Office, 2nd floor", Latitude: 48.1374, Longitude: 11.5755, Tags: []string{"corp", "trusted"}},
+		locationOverride{CIDR: "192.168.0.0/24", Label: "\"Home\" network"},
+		locationOverride{CIDR: "2001:db8::/32", Label: "Documentation", Latitude: -33.8688, Longitude: 151.2093},
+		locationOverride{CIDR: "100.64.0.0/10", Tags: []string{"vpn"}},
+	)
+
+	var exported bytes.Buffer
+	if err := table.Export(&exported); err != nil {
+		t.Fatal(err)
+	}
+
+	imported := newTestLocationOverrides(t, locationOverride{CIDR: "172.16.0.0/12", Label: "Replaced"})
+
+	n, err := imported.Import(bytes.NewReader(exported.Bytes()), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 4 {
+		t.Errorf("got %v imported overrides, want 4", n)
+	}
+
+	if got, want := imported.List(), table.List(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	var reexported bytes.Buffer
+	if err := imported.Export(&reexported); err != nil {
+		t.Fatal(err)
+	}
+
+	if reexported.String() != exported.String() {
+		t.Errorf("got %q, want %q", reexported.String(), exported.String())
+	}
+}
+
+func TestLocationOverridesImport(t *testing.T) {
+	table := newTestLocationOverrides(t, locationOverride{CIDR: "10.0.0.0/8", Label: "Office"}, locationOverride{CIDR: "172.16.0.0/12", Label: "Kept"})
+
+	n, err := table.Import(strings.NewReader(strings.Join([]string{
+		"# Overrides without a header",
+		"10.0.0.0/8,Old",
+		"10.0.0.0/8, New, 1.5, 2.5, a; b ;a",
+		"192.168.1.2/24",
+	}, "\n")), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 3 {
+		t.Errorf("got %v imported overrides, want 3", n)
+	}
+
+	want := []locationOverride{
+		{CIDR: "192.168.1.0/24", Tags: []string{}},
+		{CIDR: "172.16.0.0/12", Label: "Kept", Tags: []string{}},
+		{CIDR: "10.0.0.0/8", Label: "New", Latitude: 1.5, Longitude: 2.5, Tags: []string{"a", "b"}},
+	}
+	if got := table.List(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	for _, invalid := range []string{
+		"cidr,label\nnot-a-cidr,Label",
+		"10.0.0.0/8,Label,north,east",
+		"10.0.0.0/8,Label,91,0",
+		"10.0.0.0/8,\"Label",
+	} {
+		if _, err := table.Import(strings.NewReader(invalid), true); !errors.Is(err, ErrInvalidLocationOverride) {
+			t.Errorf("%q: got %v, want %v", invalid, err, ErrInvalidLocationOverride)
+		}
+	}
+
+	// Failed imports don't change the overrides
+	if got := table.List(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v after failed imports, want %+v", got, want)
+	}
+}
+
+func BenchmarkLocationOverridesLookup(b *testing.B) {
+	table := newLocationOverrides(filepath.Join(b.TempDir(), "location-overrides.json"))
+
+	var csv strings.Builder
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&csv, "10.%v.%v.0/24,Network %v\n", i/256, i%256, i)
+	}
+	csv.WriteString("10.0.0.0/8,Office\n")
+
+	if _, err := table.Import(strings.NewReader(csv.String()), true); err != nil {
+		b.Fatal(err)
+	}
+
+	ips := []net.IP{net.ParseIP("10.39.15.1"), net.ParseIP("10.200.0.1"), net.ParseIP("1.1.1.1")}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, _ = table.Lookup(ips[i%len(ips)])
+	}
+}
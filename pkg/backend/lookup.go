@@ -0,0 +1,172 @@
+package backend
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type LookupFormat string
+
+const (
+	LookupFormatJSON LookupFormat = "json"
+	LookupFormatCSV  LookupFormat = "csv"
+)
+
+// addressLookup is the enrichment of an address, as shown for the connections of a trace
+type addressLookup struct {
+	IP    string `json:"ip"`
+	Error string `json:"error"` // Set if the address is invalid
+
+	AddressClass addressClass `json:"addressClass"`
+	ASN          uint         `json:"asn"`
+	Org          string       `json:"org"`
+
+	location
+}
+
+func newLocation(record geoIPRecord) location {
+	return location{
+		Longitude: record.longitude,
+		Latitude:  record.latitude,
+		Precision: record.precision,
+
+		CountryName:           record.countryName,
+		CityName:              record.cityName,
+		ContinentName:         record.continentName,
+		SubdivisionName:       record.subdivisionName,
+		PostalCode:            record.postalCode,
+		TimeZone:              record.timeZone,
+		AccuracyRadius:        record.accuracyRadius,
+		IsAnycast:             record.isAnycast,
+		RegisteredCountryName: record.registeredCountryName,
+
+		Label: record.label,
+		Tags:  record.tags,
+	}
+}
+
+// lookupAddress enriches `ip`; the databases must have been opened before
+func (l *local) lookupAddress(ip string) addressLookup {
+	ip = strings.TrimSpace(ip)
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return addressLookup{
+			IP:    ip,
+			Error: "invalid IP address",
+		}
+	}
+
+	class, record := l.locate(parsed)
+	asn := l.asnDB.reader.Lookup(parsed)
+
+	return addressLookup{
+		IP: parsed.String(),
+
+		AddressClass: class,
+		ASN:          asn.asn,
+		Org:          asn.org,
+
+		location: newLocation(record),
+	}
+}
+
+// closeDatabases closes the databases and geolocation providers
+func (l *local) closeDatabases() error {
+	l.geoProvidersLock.Lock()
+	defer l.geoProvidersLock.Unlock()
+
+	return errors.Join(
+		closeGeoProviders(l.geoProviders),
+		l.cityDB.reader.Close(),
+		l.asnDB.reader.Close(),
+		l.dbipDB.reader.Close(),
+	)
+}
+
+// Lookup looks up `ips` with the databases, geolocation providers and location overrides of the app and writes the
+// results to `w`. The HTTP geolocation provider only knows addresses which it has looked up before, since it doesn't
+// block on the network. Only the databases of the active providers are opened, and the ASN database is optional
+func Lookup(ctx context.Context, ips []string, format LookupFormat, w io.Writer) error {
+	if format != LookupFormatJSON && format != LookupFormatCSV {
+		return errors.Join(ErrInvalidLookupFormat, fmt.Errorf("format must be %v or %v", LookupFormatJSON, LookupFormatCSV))
+	}
+
+	l := newLocal(nil)
+	defer l.closeDatabases()
+
+	lookups, err := l.LookupLocations(ctx, ips)
+	if err != nil {
+		return err
+	}
+
+	if format == LookupFormatJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(lookups)
+	}
+
+	writer := csv.NewWriter(w)
+
+	if err := writer.Write([]string{
+		"ip",
+		"error",
+		"addressClass",
+		"label",
+		"tags",
+		"precision",
+		"latitude",
+		"longitude",
+		"countryName",
+		"cityName",
+		"subdivisionName",
+		"postalCode",
+		"timeZone",
+		"continentName",
+		"accuracyRadius",
+		"isAnycast",
+		"registeredCountryName",
+		"asn",
+		"org",
+	}); err != nil {
+		return err
+	}
+
+	for _, lookup := range lookups {
+		if err := writer.Write([]string{
+			lookup.IP,
+			lookup.Error,
+			string(lookup.AddressClass),
+			lookup.Label,
+			strings.Join(lookup.Tags, locationOverrideTagSeparator),
+			string(lookup.Precision),
+			strconv.FormatFloat(lookup.Latitude, 'f', -1, 64),
+			strconv.FormatFloat(lookup.Longitude, 'f', -1, 64),
+			lookup.CountryName,
+			lookup.CityName,
+			lookup.SubdivisionName,
+			lookup.PostalCode,
+			lookup.TimeZone,
+			lookup.ContinentName,
+			strconv.Itoa(lookup.AccuracyRadius),
+			strconv.FormatBool(lookup.IsAnycast),
+			lookup.RegisteredCountryName,
+			strconv.FormatUint(uint64(lookup.ASN), 10),
+			lookup.Org,
+		}); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+
+	return writer.Error()
+}
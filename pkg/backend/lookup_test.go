@@ -0,0 +1,54 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLookupWithoutCityDatabase(t *testing.T) {
+	for _, dir := range []string{"XDG_DATA_HOME", "XDG_CONFIG_HOME", "XDG_CACHE_HOME"} {
+		t.Setenv(dir, t.TempDir())
+	}
+
+	configDir := filepath.Join(os.Getenv("XDG_CONFIG_HOME"), "connmapper")
+	if err := os.MkdirAll(configDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	rangesPath := filepath.Join(t.TempDir(), "ranges.csv")
+	if err := os.WriteFile(rangesPath, []byte("9.9.9.0/24,52.52,13.405,Germany,Berlin\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	providers, err := json.Marshal([]geoProviderConfig{{Type: geoProviderTypeCSV, Path: rangesPath}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(configDir, "geo-providers.json"), providers, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither the City nor the ASN database exist, which only the default provider needs
+	var output bytes.Buffer
+	if err := Lookup(context.Background(), []string{"9.9.9.9"}, LookupFormatJSON, &output); err != nil {
+		t.Fatal(err)
+	}
+
+	lookups := []addressLookup{}
+	if err := json.Unmarshal(output.Bytes(), &lookups); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(lookups) != 1 {
+		t.Fatalf("got %v lookups, want 1", len(lookups))
+	}
+
+	if got := lookups[0]; got.CityName != "Berlin" || got.Latitude != 52.52 || got.Longitude != 13.405 {
+		t.Errorf("got %+v, want the location from the CSV provider", got)
+	}
+}
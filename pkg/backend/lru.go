@@ -0,0 +1,73 @@
+package backend
+
+import (
+	"container/list"
+	"sync"
+)
+
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+// lruCache is a fixed-size cache which evicts the least recently used entry when it is full
+type lruCache[K comparable, V any] struct {
+	size    int
+	entries map[K]*list.Element
+	order   *list.List
+	lock    sync.Mutex
+}
+
+func newLRUCache[K comparable, V any](size int) *lruCache[K, V] {
+	return &lruCache[K, V]{
+		size:    size,
+		entries: map[K]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+func (c *lruCache[K, V]) Get(key K) (V, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		var v V
+
+		return v, false
+	}
+
+	c.order.MoveToFront(element)
+
+	return element.Value.(*lruEntry[K, V]).value, true
+}
+
+func (c *lruCache[K, V]) Add(key K, value V) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*lruEntry[K, V]).value = value
+
+		c.order.MoveToFront(element)
+
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry[K, V]{key, value})
+
+	for c.size > 0 && c.order.Len() > c.size {
+		oldest := c.order.Back()
+
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry[K, V]).key)
+	}
+}
+
+func (c *lruCache[K, V]) Purge() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries = map[K]*list.Element{}
+	c.order.Init()
+}
@@ -0,0 +1,108 @@
+package backend
+
+// packetCache is a fixed-capacity ring buffer of the latest packets. In summarized mode, it aggregates packets by
+// their connection ID instead, using an index to find the aggregate of a packet and evicting the oldest aggregates
+// once it is full. It isn't safe for concurrent use
+type packetCache struct {
+	entries []tracedConnection
+	ids     []string       // Connection ID of each aggregate in `entries`
+	index   map[string]int // Position of each aggregate in `entries` by its connection ID
+	start   int            // Position of the oldest entry
+	length  int
+}
+
+func newPacketCache(capacity int) *packetCache {
+	capacity = max(capacity, 0)
+
+	return &packetCache{
+		entries: make([]tracedConnection, capacity),
+		ids:     make([]string, capacity),
+		index:   map[string]int{},
+	}
+}
+
+// push adds an entry and returns its position, evicting the oldest entry if the cache is full. Returns -1 if the
+// cache has no capacity
+func (c *packetCache) push(entry tracedConnection, id string) int {
+	if len(c.entries) == 0 {
+		return -1
+	}
+
+	var i int
+	if c.length < len(c.entries) {
+		i = (c.start + c.length) % len(c.entries)
+		c.length++
+	} else {
+		i = c.start
+		c.start = (c.start + 1) % len(c.entries)
+
+		if evicted := c.ids[i]; evicted != "" && c.index[evicted] == i {
+			delete(c.index, evicted)
+		}
+	}
+
+	c.entries[i] = entry
+	c.ids[i] = id
+
+	return i
+}
+
+// Add adds a packet
+func (c *packetCache) Add(packet tracedConnection) {
+	c.push(packet, "")
+}
+
+// Aggregate adds the bytes of `flow` to the aggregate of its connection, or of its reply direction, and creates
+// the aggregate if there is none
+func (c *packetCache) Aggregate(flow tracedConnection, key flowKey) {
+	id := getTracedConnectionID(flow, key)
+	if i, ok := c.index[id]; ok {
+		c.entries[i] = mergeTracedConnection(c.entries[i], flow, false)
+
+		return
+	}
+
+	if i, ok := c.index[getTracedConnectionID(reverseTracedConnection(flow), key)]; ok {
+		c.entries[i] = mergeTracedConnection(c.entries[i], flow, true)
+
+		return
+	}
+
+	if i := c.push(flow, id); i >= 0 {
+		c.index[id] = i
+	}
+}
+
+// List returns the entries from the newest to the oldest
+func (c *packetCache) List() []tracedConnection {
+	entries := make([]tracedConnection, c.length)
+	for i := range entries {
+		entries[i] = c.entries[(c.start+c.length-1-i)%len(c.entries)]
+	}
+
+	return entries
+}
+
+// Resize changes the capacity, keeping the newest entries
+func (c *packetCache) Resize(capacity int) {
+	capacity = max(capacity, 0)
+	if capacity == len(c.entries) {
+		return
+	}
+
+	resized := newPacketCache(capacity)
+	for i := max(c.length-capacity, 0); i < c.length; i++ {
+		j := (c.start + i) % len(c.entries)
+
+		if k := resized.push(c.entries[j], c.ids[j]); k >= 0 && c.ids[j] != "" {
+			resized.index[c.ids[j]] = k
+		}
+	}
+
+	*c = *resized
+}
+
+// Clear removes all entries
+func (c *packetCache) Clear() {
+	*c = *newPacketCache(len(c.entries))
+}
@@ -0,0 +1,306 @@
+package backend
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+func newTestFlow(src, dst string, srcPort, dstPort, length int) tracedConnection {
+	return tracedConnection{
+		Length: length,
+
+		LayerType:     "IPv4",
+		NextLayerType: "TCP",
+
+		SrcIP:   src,
+		SrcPort: srcPort,
+		DstIP:   dst,
+		DstPort: dstPort,
+
+		BytesSent: length,
+	}
+}
+
+// checkPacketCache fails if the ring buffer and the index of `c` are inconsistent
+func checkPacketCache(t *testing.T, c *packetCache, key flowKey) {
+	t.Helper()
+
+	if len(c.ids) != len(c.entries) || c.length < 0 || c.length > len(c.entries) || (len(c.entries) > 0 && (c.start < 0 || c.start >= len(c.entries))) {
+		t.Fatalf("invalid ring buffer: %v entries, %v IDs, start %v, length %v", len(c.entries), len(c.ids), c.start, c.length)
+	}
+
+	live := 0
+	for offset := 0; offset < c.length; offset++ {
+		i := (c.start + offset) % len(c.entries)
+
+		id := c.ids[i]
+		if id == "" {
+			continue
+		}
+		live++
+
+		if j, ok := c.index[id]; !ok || j != i {
+			t.Errorf("aggregate %v at position %v is indexed at position %v", id, i, j)
+		}
+
+		if got := getTracedConnectionID(c.entries[i], key); got != id {
+			t.Errorf("aggregate at position %v has ID %v, but is stored as %v", i, got, id)
+		}
+	}
+
+	if len(c.index) != live {
+		t.Errorf("index has %v aggregates, but the ring buffer has %v", len(c.index), live)
+	}
+
+	for id, i := range c.index {
+		if i < 0 || i >= len(c.entries) || (i-c.start+len(c.entries))%len(c.entries) >= c.length {
+			t.Errorf("aggregate %v is indexed at position %v, which isn't in the ring buffer", id, i)
+		}
+	}
+}
+
+func getPacketLengths(entries []tracedConnection) []int {
+	lengths := []int{}
+	for _, entry := range entries {
+		lengths = append(lengths, entry.Length)
+	}
+
+	return lengths
+}
+
+func TestPacketCacheAddWraparound(t *testing.T) {
+	c := newPacketCache(3)
+
+	for i := 1; i <= 7; i++ {
+		c.Add(newTestFlow("10.0.0.1", "1.1.1.1", 50000, 443, i))
+	}
+
+	if got, want := getPacketLengths(c.List()), []int{7, 6, 5}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if len(c.index) != 0 {
+		t.Errorf("packets must not be indexed, got %v", c.index)
+	}
+
+	checkPacketCache(t, c, flowKeyFiveTuple)
+}
+
+func TestPacketCacheAggregateEvictsOldest(t *testing.T) {
+	var (
+		a = newTestFlow("10.0.0.1", "1.1.1.1", 50000, 443, 1)
+		b = newTestFlow("10.0.0.1", "8.8.8.8", 50001, 53, 10)
+		d = newTestFlow("10.0.0.1", "9.9.9.9", 50002, 853, 100)
+	)
+
+	c := newPacketCache(2)
+
+	c.Aggregate(a, flowKeyFiveTuple)
+	c.Aggregate(b, flowKeyFiveTuple)
+
+	// Merging doesn't refresh the aggregate, so `a` is still the oldest one
+	c.Aggregate(a, flowKeyFiveTuple)
+	c.Aggregate(newTestFlow("8.8.8.8", "10.0.0.1", 53, 50001, 10), flowKeyFiveTuple)
+	checkPacketCache(t, c, flowKeyFiveTuple)
+
+	entries := c.List()
+	if got, want := getPacketLengths(entries), []int{20, 2}; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if entries[0].BytesSent != 10 || entries[0].BytesReceived != 10 {
+		t.Errorf("reply was not counted as received: %+v", entries[0])
+	}
+
+	c.Aggregate(d, flowKeyFiveTuple)
+	checkPacketCache(t, c, flowKeyFiveTuple)
+
+	if got, want := getPacketLengths(c.List()), []int{100, 20}; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// The evicted aggregate starts over
+	c.Aggregate(a, flowKeyFiveTuple)
+	checkPacketCache(t, c, flowKeyFiveTuple)
+
+	if got, want := getPacketLengths(c.List()), []int{1, 100}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPacketCacheResize(t *testing.T) {
+	c := newPacketCache(4)
+
+	// Wrap around before resizing so that the oldest entry isn't at the start of the buffer
+	for port := 1; port <= 6; port++ {
+		c.Aggregate(newTestFlow("10.0.0.1", "1.1.1.1", port, 443, port), flowKeyFiveTuple)
+	}
+	checkPacketCache(t, c, flowKeyFiveTuple)
+
+	c.Resize(2)
+	checkPacketCache(t, c, flowKeyFiveTuple)
+
+	if got, want := getPacketLengths(c.List()), []int{6, 5}; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// Aggregates which were kept are still found, and those which were dropped start over
+	c.Aggregate(newTestFlow("10.0.0.1", "1.1.1.1", 5, 443, 5), flowKeyFiveTuple)
+	c.Resize(3)
+	c.Aggregate(newTestFlow("10.0.0.1", "1.1.1.1", 4, 443, 4), flowKeyFiveTuple)
+	checkPacketCache(t, c, flowKeyFiveTuple)
+
+	if got, want := getPacketLengths(c.List()), []int{4, 6, 10}; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	c.Resize(0)
+	c.Aggregate(newTestFlow("10.0.0.1", "1.1.1.1", 1, 443, 1), flowKeyFiveTuple)
+	c.Add(newTestFlow("10.0.0.1", "1.1.1.1", 1, 443, 1))
+	checkPacketCache(t, c, flowKeyFiveTuple)
+
+	if entries := c.List(); len(entries) != 0 {
+		t.Errorf("got %v entries, want none", len(entries))
+	}
+}
+
+// TestPacketCacheAggregateModel compares random operations with a FIFO list of aggregates
+func TestPacketCacheAggregateModel(t *testing.T) {
+	type aggregate struct {
+		id   string
+		flow tracedConnection
+	}
+
+	var (
+		r        = rand.New(rand.NewPCG(1, 2))
+		capacity = 8
+		c        = newPacketCache(capacity)
+		model    = []aggregate{}
+	)
+
+	for step := 0; step < 20000; step++ {
+		switch op := r.IntN(100); {
+		case op < 2:
+			capacity = r.IntN(12)
+			c.Resize(capacity)
+
+			model = model[max(len(model)-capacity, 0):]
+
+		case op < 3:
+			c.Clear()
+
+			model = []aggregate{}
+
+		default:
+			local, remote, localPort := "10.0.0.1", fmt.Sprintf("10.0.1.%v", r.IntN(4)), 50000+r.IntN(4)
+
+			flow := newTestFlow(local, remote, localPort, 443, 1+r.IntN(1500))
+			if r.IntN(2) == 0 {
+				flow = newTestFlow(remote, local, 443, localPort, 1+r.IntN(1500))
+			}
+
+			c.Aggregate(flow, flowKeyFiveTuple)
+
+			id := getTracedConnectionID(flow, flowKeyFiveTuple)
+			reverseID := getTracedConnectionID(reverseTracedConnection(flow), flowKeyFiveTuple)
+
+			if i := slices.IndexFunc(model, func(a aggregate) bool { return a.id == id }); i >= 0 {
+				model[i].flow = mergeTracedConnection(model[i].flow, flow, false)
+			} else if i := slices.IndexFunc(model, func(a aggregate) bool { return a.id == reverseID }); i >= 0 {
+				model[i].flow = mergeTracedConnection(model[i].flow, flow, true)
+			} else if capacity > 0 {
+				model = append(model, aggregate{id, flow})
+				model = model[max(len(model)-capacity, 0):]
+			}
+		}
+
+		checkPacketCache(t, c, flowKeyFiveTuple)
+
+		entries := c.List()
+		if len(entries) != len(model) {
+			t.Fatalf("step %v: got %v aggregates, want %v", step, len(entries), len(model))
+		}
+
+		for i, entry := range entries {
+			want := model[len(model)-1-i].flow
+			if entry.SrcIP != want.SrcIP || entry.DstIP != want.DstIP || entry.SrcPort != want.SrcPort || entry.DstPort != want.DstPort ||
+				entry.Length != want.Length || entry.BytesSent != want.BytesSent || entry.BytesReceived != want.BytesReceived {
+				t.Fatalf("step %v: aggregate %v is %+v, want %+v", step, i, entry, want)
+			}
+		}
+	}
+}
+
+const benchmarkPacketCacheCapacity = 100000
+
+// newBenchmarkFlows returns `n` flows between distinct hosts and ports
+func newBenchmarkFlows(n int) []tracedConnection {
+	flows := make([]tracedConnection, n)
+	for i := range flows {
+		flows[i] = newTestFlow(
+			"10.0.0.1",
+			fmt.Sprintf("100.%v.%v.%v", (i>>16)&0xff, (i>>8)&0xff, i&0xff),
+			1024+i%50000,
+			443,
+			1500,
+		)
+	}
+
+	return flows
+}
+
+// BenchmarkPacketCacheAdd measures the detailed mode, in which every packet evicts the oldest one from a full cache
+func BenchmarkPacketCacheAdd(b *testing.B) {
+	flows := newBenchmarkFlows(2 * benchmarkPacketCacheCapacity)
+
+	c := newPacketCache(benchmarkPacketCacheCapacity)
+	for _, flow := range flows[:benchmarkPacketCacheCapacity] {
+		c.Add(flow)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		c.Add(flows[i%len(flows)])
+	}
+}
+
+// BenchmarkPacketCacheAggregate measures the summarized mode with packets of twice as many connections as fit into
+// the cache, so that half of them are merged into an existing aggregate and the other half evict the oldest one
+func BenchmarkPacketCacheAggregate(b *testing.B) {
+	flows := newBenchmarkFlows(2 * benchmarkPacketCacheCapacity)
+
+	c := newPacketCache(benchmarkPacketCacheCapacity)
+	for _, flow := range flows[:benchmarkPacketCacheCapacity] {
+		c.Aggregate(flow, flowKeyFiveTuple)
+	}
+
+	r := rand.New(rand.NewPCG(1, 2))
+	order := make([]int, 1<<20)
+	for i := range order {
+		order[i] = r.IntN(len(flows))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		c.Aggregate(flows[order[i%len(order)]], flowKeyFiveTuple)
+	}
+}
+
+func BenchmarkPacketCacheList(b *testing.B) {
+	c := newPacketCache(benchmarkPacketCacheCapacity)
+	for _, flow := range newBenchmarkFlows(benchmarkPacketCacheCapacity) {
+		c.Add(flow)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_ = c.List()
+	}
+}
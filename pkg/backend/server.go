@@ -1,9 +1,9 @@
 package backend
 
 import (
-	"archive/tar"
-	"compress/gzip"
+	"bufio"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,6 +16,8 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -38,40 +40,132 @@ var (
 	ErrUserDeniedEscalationPermission           = errors.New("user denied escalation permission")
 	ErrCouldNotExecuteCommand                   = errors.New("could not execute command")
 	ErrCouldNotCreateElevatedCommand            = errors.New("could not create elevated command")
+	ErrInvalidReplaySpeed                       = errors.New("invalid replay speed")
+	ErrInvalidTraceFilter                       = errors.New("invalid trace filter")
+	ErrDeviceNotTraced                          = errors.New("device is not being traced")
+	ErrDeviceAlreadyTraced                      = errors.New("device is already being traced")
+	ErrUnsupportedTraceProtocolVersion          = errors.New("unsupported trace protocol version")
+	ErrInvalidSnapLen                           = errors.New("invalid snap length")
+	ErrInvalidFlowKey                           = errors.New("invalid flow key")
+	ErrInvalidHomeLocation                      = errors.New("invalid home location")
+	ErrInvalidDatabaseUpdateInterval            = errors.New("invalid database update interval")
+	ErrUnexpectedHTTPStatus                     = errors.New("unexpected HTTP status")
+	ErrInvalidDatabaseChecksum                  = errors.New("invalid database checksum")
+	ErrDatabaseChecksumMismatch                 = errors.New("database checksum mismatch")
+	ErrInvalidDatabase                          = errors.New("invalid database")
+	ErrInvalidMaxDatabaseAge                    = errors.New("invalid maximum database age")
+	ErrInvalidLocale                            = errors.New("invalid locale")
+	ErrInvalidGeoProvider                       = errors.New("invalid geolocation provider")
+	ErrInvalidLocationOverride                  = errors.New("invalid location override")
+	ErrInvalidLookupFormat                      = errors.New("invalid lookup format")
+	ErrInvalidConnectionIdleTimeout             = errors.New("invalid connection idle timeout")
+	ErrInvalidSettings                          = errors.New("invalid settings")
+	ErrUnsupportedSettingsVersion               = errors.New("unsupported settings version")
+	ErrInvalidHistoryQuery                      = errors.New("invalid history query")
+	ErrInvalidFilter                            = errors.New("invalid filter")
+	ErrInvalidLocalAddress                      = errors.New("invalid local address")
 )
 
 const (
 	TraceCommandEnv = "CONNMAPPER_TRACE"
 
 	traceCommandHandshakeLen = 2
-	flatpakIDEnv             = "FLATPAK_ID"
+
+	// Ethernet (14 bytes), IPv6 (40 bytes) and TCP (20 bytes) headers need 74 bytes; the rest leaves room for
+	// VLAN tags, IPv6 extension headers and TCP options
+	minSnapLen   = 128
+	flatpakIDEnv = "FLATPAK_ID"
+
+	defaultLocale = "en"
+
+	defaultMaxPacketCache = 100
 )
 
-func lookupLocation(db *geoip2.Reader, ip net.IP) (
-	countryName string,
-	cityName string,
-	longitude float64,
-	latitude float64,
-) {
+var (
+	// Locales of the names in GeoLite2 databases
+	supportedLocales = []string{"de", "en", "es", "fr", "ja", "pt-BR", "ru", "zh-CN"}
+)
+
+// getLocalizedName returns the name in `locale`, or the English name if there is none
+func getLocalizedName(names map[string]string, locale string) string {
+	if name, ok := names[locale]; ok {
+		return name
+	}
+
+	return names[defaultLocale]
+}
+
+// lookupLocation looks up the location of `ip`. If the database has no coordinates for it, it falls back
+// to the centroid of its subdivision and then to the centroid of its country
+func lookupLocation(db *geoip2.Reader, ip net.IP, locale string) geoIPRecord {
 	record, _ := db.City(ip)
+	if record == nil {
+		return geoIPRecord{precision: locationPrecisionUnknown}
+	}
 
-	countryName = ""
-	cityName = ""
-	longitude = float64(0)
-	latitude = float64(0)
-	if record != nil {
-		countryName = record.Country.Names["en"]
-		cityName = record.City.Names["en"]
-		longitude = record.Location.Longitude
-		latitude = record.Location.Latitude
+	subdivisionName := ""
+	subdivisionCode := ""
+	if len(record.Subdivisions) > 0 {
+		subdivisionName = getLocalizedName(record.Subdivisions[0].Names, locale)
+		subdivisionCode = record.Subdivisions[0].IsoCode
 	}
 
-	return
+	countryCode := record.Country.IsoCode
+	if countryCode == "" {
+		countryCode = record.RegisteredCountry.IsoCode
+	}
+
+	longitude, latitude := record.Location.Longitude, record.Location.Latitude
+	precision := locationPrecisionUnknown
+	if longitude != 0 || latitude != 0 {
+		// Records without a city have the coordinates of their subdivision or country
+		if record.City.GeoNameID != 0 {
+			precision = locationPrecisionCity
+		} else if subdivisionCode != "" {
+			precision = locationPrecisionSubdivision
+		} else {
+			precision = locationPrecisionCountry
+		}
+	} else if c, ok := subdivisionCentroids[countryCode+"-"+subdivisionCode]; ok && subdivisionCode != "" {
+		longitude, latitude, precision = c.longitude, c.latitude, locationPrecisionSubdivision
+	} else if c, ok := countryCentroids[countryCode]; ok {
+		longitude, latitude, precision = c.longitude, c.latitude, locationPrecisionCountry
+	}
+
+	return geoIPRecord{
+		countryName: getLocalizedName(record.Country.Names, locale),
+		cityName:    getLocalizedName(record.City.Names, locale),
+		longitude:   longitude,
+		latitude:    latitude,
+		precision:   precision,
+
+		continentName:         getLocalizedName(record.Continent.Names, locale),
+		subdivisionName:       subdivisionName,
+		postalCode:            record.Postal.Code,
+		timeZone:              record.Location.TimeZone,
+		accuracyRadius:        int(record.Location.AccuracyRadius),
+		isAnycast:             record.Traits.IsAnycast,
+		registeredCountryName: getLocalizedName(record.RegisteredCountry.Names, locale),
+	}
 }
 
 type location struct {
-	Longitude float64 `json:"longitude"`
-	Latitude  float64 `json:"latitude"`
+	Longitude float64           `json:"longitude"`
+	Latitude  float64           `json:"latitude"`
+	Precision locationPrecision `json:"precision"`
+
+	CountryName           string `json:"countryName"`
+	CityName              string `json:"cityName"`
+	ContinentName         string `json:"continentName"`
+	SubdivisionName       string `json:"subdivisionName"` // E.g. the state or region
+	PostalCode            string `json:"postalCode"`
+	TimeZone              string `json:"timeZone"`
+	AccuracyRadius        int    `json:"accuracyRadius"` // Radius around the coordinates in which the address is likely located in kilometers, or 0 if unknown
+	IsAnycast             bool   `json:"isAnycast"`
+	RegisteredCountryName string `json:"registeredCountryName"` // Country in which the address is registered, which can differ from where it is used
+
+	Label string   `json:"label"` // Label of the location override of the address, if any
+	Tags  []string `json:"tags"`
 }
 
 type tracedConnection struct {
@@ -82,45 +176,277 @@ type tracedConnection struct {
 	NextLayerType string `json:"nextLayerType"`
 
 	SrcIP          string  `json:"srcIP"`
+	SrcPort        int     `json:"srcPort"`
 	SrcCountryName string  `json:"srcCountryName"`
 	SrcCityName    string  `json:"srcCityName"`
 	SrcLongitude   float64 `json:"srcLongitude"`
 	SrcLatitude    float64 `json:"srcLatitude"`
 
+	SrcLocationPrecision locationPrecision `json:"srcLocationPrecision"`
+
+	SrcContinentName         string `json:"srcContinentName"`
+	SrcSubdivisionName       string `json:"srcSubdivisionName"`
+	SrcPostalCode            string `json:"srcPostalCode"`
+	SrcTimeZone              string `json:"srcTimeZone"`
+	SrcAccuracyRadius        int    `json:"srcAccuracyRadius"`
+	SrcIsAnycast             bool   `json:"srcIsAnycast"`
+	SrcRegisteredCountryName string `json:"srcRegisteredCountryName"`
+
+	SrcAddressClass addressClass `json:"srcAddressClass"`
+	SrcASN          uint         `json:"srcASN"`
+	SrcOrg          string       `json:"srcOrg"`
+
+	SrcLabel string   `json:"srcLabel"`
+	SrcTags  []string `json:"srcTags"`
+
 	DstIP          string  `json:"dstIP"`
+	DstPort        int     `json:"dstPort"`
 	DstCountryName string  `json:"dstCountryName"`
 	DstCityName    string  `json:"dstCityName"`
 	DstLongitude   float64 `json:"dstLongitude"`
 	DstLatitude    float64 `json:"dstLatitude"`
 
-	timer *time.Timer
+	DstLocationPrecision locationPrecision `json:"dstLocationPrecision"`
+
+	DstContinentName         string `json:"dstContinentName"`
+	DstSubdivisionName       string `json:"dstSubdivisionName"`
+	DstPostalCode            string `json:"dstPostalCode"`
+	DstTimeZone              string `json:"dstTimeZone"`
+	DstAccuracyRadius        int    `json:"dstAccuracyRadius"`
+	DstIsAnycast             bool   `json:"dstIsAnycast"`
+	DstRegisteredCountryName string `json:"dstRegisteredCountryName"`
+
+	DstAddressClass addressClass `json:"dstAddressClass"`
+	DstASN          uint         `json:"dstASN"`
+	DstOrg          string       `json:"dstOrg"`
+
+	DstLabel string   `json:"dstLabel"`
+	DstTags  []string `json:"dstTags"`
+
+	Direction     direction `json:"direction"`
+	BytesSent     int       `json:"bytesSent"`     // Bytes from source to destination
+	BytesReceived int       `json:"bytesReceived"` // Bytes from destination to source
+}
+
+type direction string
+
+const (
+	directionInbound  direction = "inbound"  // From a remote address to an address of the traced device
+	directionOutbound direction = "outbound" // From an address of the traced device to a remote address
+	directionLocal    direction = "local"    // Between addresses of the traced device
+	directionTransit  direction = "transit"  // Between remote addresses
+)
+
+func getDirection(localAddresses map[string]struct{}, srcIP, dstIP net.IP) direction {
+	_, srcIsLocal := localAddresses[srcIP.String()]
+	_, dstIsLocal := localAddresses[dstIP.String()]
+
+	switch {
+	case srcIsLocal && dstIsLocal:
+		return directionLocal
+	case srcIsLocal:
+		return directionOutbound
+	case dstIsLocal:
+		return directionInbound
+	default:
+		return directionTransit
+	}
+}
+
+func getLocalAddresses(netName string) (map[string]struct{}, error) {
+	iface, err := net.InterfaceByName(netName)
+	if err != nil {
+		return nil, err
+	}
+
+	rawAddresses, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := map[string]struct{}{}
+	for _, rawAddress := range rawAddresses {
+		ip, _, err := net.ParseCIDR(rawAddress.String())
+		if err != nil {
+			return nil, err
+		}
+
+		addresses[ip.String()] = struct{}{}
+	}
+
+	return addresses, nil
+}
+
+// reverseTracedConnection swaps the source and destination of a connection, and the bytes sent and received
+func reverseTracedConnection(connection tracedConnection) tracedConnection {
+	connection.SrcIP, connection.DstIP = connection.DstIP, connection.SrcIP
+	connection.SrcPort, connection.DstPort = connection.DstPort, connection.SrcPort
+	connection.SrcCountryName, connection.DstCountryName = connection.DstCountryName, connection.SrcCountryName
+	connection.SrcCityName, connection.DstCityName = connection.DstCityName, connection.SrcCityName
+	connection.SrcAddressClass, connection.DstAddressClass = connection.DstAddressClass, connection.SrcAddressClass
+	connection.SrcASN, connection.DstASN = connection.DstASN, connection.SrcASN
+	connection.SrcOrg, connection.DstOrg = connection.DstOrg, connection.SrcOrg
+	connection.SrcLongitude, connection.DstLongitude = connection.DstLongitude, connection.SrcLongitude
+	connection.SrcLatitude, connection.DstLatitude = connection.DstLatitude, connection.SrcLatitude
+	connection.SrcLocationPrecision, connection.DstLocationPrecision = connection.DstLocationPrecision, connection.SrcLocationPrecision
+	connection.SrcContinentName, connection.DstContinentName = connection.DstContinentName, connection.SrcContinentName
+	connection.SrcSubdivisionName, connection.DstSubdivisionName = connection.DstSubdivisionName, connection.SrcSubdivisionName
+	connection.SrcPostalCode, connection.DstPostalCode = connection.DstPostalCode, connection.SrcPostalCode
+	connection.SrcTimeZone, connection.DstTimeZone = connection.DstTimeZone, connection.SrcTimeZone
+	connection.SrcAccuracyRadius, connection.DstAccuracyRadius = connection.DstAccuracyRadius, connection.SrcAccuracyRadius
+	connection.SrcIsAnycast, connection.DstIsAnycast = connection.DstIsAnycast, connection.SrcIsAnycast
+	connection.SrcRegisteredCountryName, connection.DstRegisteredCountryName = connection.DstRegisteredCountryName, connection.SrcRegisteredCountryName
+	connection.SrcLabel, connection.DstLabel = connection.DstLabel, connection.SrcLabel
+	connection.SrcTags, connection.DstTags = connection.DstTags, connection.SrcTags
+	connection.BytesSent, connection.BytesReceived = connection.BytesReceived, connection.BytesSent
+
+	return connection
 }
 
-func getTracedConnectionID(connection tracedConnection) string {
-	return connection.LayerType + "-" +
-		connection.NextLayerType + "-" +
-		connection.SrcIP + "-" +
-		connection.DstIP + "-"
+// mergeTracedConnection adds the bytes of `packet` to `flow`; if `reversed` is set, `packet` is a reply in `flow`
+func mergeTracedConnection(flow, packet tracedConnection, reversed bool) tracedConnection {
+	flow.Length += packet.Length
+
+	if reversed {
+		flow.BytesSent += packet.BytesReceived
+		flow.BytesReceived += packet.BytesSent
+	} else {
+		flow.BytesSent += packet.BytesSent
+		flow.BytesReceived += packet.BytesReceived
+	}
+
+	return flow
+}
+
+type flowKey string
+
+const (
+	flowKeyHostPair           flowKey = "hostPair"           // Groups by protocol and source and destination IP
+	flowKeyFiveTuple          flowKey = "fiveTuple"          // Groups by protocol and source and destination IP and port
+	flowKeyDestinationService flowKey = "destinationService" // Groups by protocol and destination IP and port
+	flowKeyOrganization       flowKey = "organization"       // Groups by the organization of the destination, or its IP if it is unknown
+)
+
+func getTracedConnectionID(connection tracedConnection, key flowKey) string {
+	switch key {
+	case flowKeyFiveTuple:
+		return connection.LayerType + "-" +
+			connection.NextLayerType + "-" +
+			connection.SrcIP + "-" +
+			strconv.Itoa(connection.SrcPort) + "-" +
+			connection.DstIP + "-" +
+			strconv.Itoa(connection.DstPort) + "-"
+
+	case flowKeyDestinationService:
+		return connection.LayerType + "-" +
+			connection.NextLayerType + "-" +
+			connection.DstIP + "-" +
+			strconv.Itoa(connection.DstPort) + "-"
+
+	case flowKeyOrganization:
+		if connection.DstOrg == "" {
+			return "ip-" + connection.DstIP
+		}
+
+		return "org-" + connection.DstOrg
+
+	default:
+		return connection.LayerType + "-" +
+			connection.NextLayerType + "-" +
+			connection.SrcIP + "-" +
+			connection.DstIP + "-"
+	}
+}
+
+type traceStatus string
+
+const (
+	traceStatusStarting traceStatus = "starting"
+	traceStatusRunning  traceStatus = "running"
+	traceStatusFailed   traceStatus = "failed"
+	traceStatusStopped  traceStatus = "stopped"
+)
+
+// Trace sessions of capture files are named with this prefix, so that they can't collide with devices
+const traceFileSessionPrefix = "file:"
+
+type traceSession struct {
+	Name   string      `json:"name"`
+	Status traceStatus `json:"status"`
+	Error  string      `json:"error"`
+
+	stats          *traceStats
+	localAddresses map[string]struct{} // Addresses of the traced device, used to determine the direction of packets
+	stop           func()
+	stopped        chan struct{} // Closed once stopping the trace has been requested
+	exited         chan struct{} // Closed once the trace has been cleaned up
+}
+
+type traceStats struct {
+	packetsReceived    atomic.Uint64 // As reported by the kernel or libpcap
+	packetsDropped     atomic.Uint64 // As reported by the kernel or libpcap
+	packetsCaptured    atomic.Uint64
+	packetsUndecodable atomic.Uint64
+	packetsWithoutIP   atomic.Uint64
+}
+
+type captureStats struct {
+	Name               string `json:"name"`
+	PacketsReceived    uint64 `json:"packetsReceived"`
+	PacketsDropped     uint64 `json:"packetsDropped"`
+	PacketsCaptured    uint64 `json:"packetsCaptured"`
+	PacketsUndecodable uint64 `json:"packetsUndecodable"`
+	PacketsWithoutIP   uint64 `json:"packetsWithoutIP"`
 }
 
 type local struct {
-	connections     map[string]tracedConnection
-	connectionsLock sync.Mutex
+	connections           *connectionTable
+	connectionIdleTimeout time.Duration
+	connectionsLock       sync.Mutex
 
-	tracingDevices     map[string]struct{}
+	tracingDevices     map[string]*traceSession
 	tracingDevicesLock sync.Mutex
 
 	browserState *ui.BrowserState
 
-	packetCache      []tracedConnection
+	packetCache      *packetCache
 	packetsCacheLock sync.Mutex
 
-	summarized bool
-
-	maxPacketCache      int
+	// Copies of settings which are read while handling packets, guarded by the cache locks
+	summarized          bool
+	flowKey             flowKey
 	maxConnectionsCache int
-	dbPath              string
-	dbDownloadURL       string
+
+	settings        settings
+	settingsPath    string
+	settingsLock    sync.Mutex
+	settingsChanged chan struct{}
+
+	cityDB *geoIPDatabase
+	asnDB  *geoIPDatabase
+	dbipDB *geoIPDatabase
+
+	geoProviders           []GeoProvider
+	geoProviderConfigs     []geoProviderConfig
+	geoProvidersPath       string
+	geoProvidersLock       sync.RWMutex
+	geoProvidersUpdateLock sync.Mutex
+	geoHTTPCacheDir        string
+
+	httpClient *http.Client
+
+	dbAutoUpdate        databaseAutoUpdate
+	dbAutoUpdatePath    string
+	dbAutoUpdateLock    sync.Mutex
+	dbAutoUpdateChanged chan struct{}
+
+	homeLocation     homeLocation
+	homeLocationPath string
+	homeLocationLock sync.RWMutex
+
+	locationOverrides *locationOverrides
+
+	history *flowHistory
 
 	ForRemotes func(cb func(remoteID string, remote remote) error) error
 }
@@ -129,194 +455,858 @@ func (l *local) OpenExternalLink(ctx context.Context, url string) error {
 	return browser.OpenURL(url)
 }
 
+// CheckDatabase returns true if the MaxMind provider is active and its database is missing
 func (l *local) CheckDatabase(ctx context.Context) (bool, error) {
-	if _, err := os.Stat(l.dbPath); err != nil {
-		return true, nil
+	l.geoProvidersLock.RLock()
+	defer l.geoProvidersLock.RUnlock()
+
+	return slices.ContainsFunc(l.geoProviderConfigs, func(c geoProviderConfig) bool {
+		return c.Type == geoProviderTypeMaxMind
+	}) && !l.cityDB.exists(), nil
+}
+
+// getDatabaseInfo returns the metadata of a database and whether it is older than the maximum database age
+func (l *local) getDatabaseInfo(db *geoIPDatabase) (databaseInfo, error) {
+	info, err := db.reader.Info()
+	if err != nil {
+		return databaseInfo{}, err
 	}
 
-	return false, nil
+	info.Age = int64(time.Since(time.Unix(info.BuildEpoch, 0)).Seconds())
+	maxDatabaseAge := l.getSettings().MaxDatabaseAge
+	info.Outdated = maxDatabaseAge > 0 && info.Age > maxDatabaseAge
+
+	return info, nil
+}
+
+// GetDatabaseInfo returns the metadata of the database and whether it is older than the maximum database age
+func (l *local) GetDatabaseInfo(ctx context.Context) (databaseInfo, error) {
+	return l.getDatabaseInfo(l.cityDB)
 }
 
+// SetMaxDatabaseAge sets the age in seconds after which `GetDatabaseInfo` flags the database as outdated.
+// A `maxDatabaseAge` of 0 never flags it
+func (l *local) SetMaxDatabaseAge(ctx context.Context, maxDatabaseAge int64) error {
+	_, err := l.updateSettings(func(s *settings) {
+		s.MaxDatabaseAge = maxDatabaseAge
+	})
+
+	return err
+}
+
+func (l *local) GetMaxDatabaseAge(ctx context.Context) (int64, error) {
+	return l.getSettings().MaxDatabaseAge, nil
+}
+
+// DownloadDatabase downloads the database from the database download URL. `progress` is called with the downloaded
+// and total bytes while downloading, and canceling `ctx` stops the download so that it can be resumed by calling it again
 func (l *local) DownloadDatabase(
 	ctx context.Context,
 	accountID, licenseKey string,
+	progress func(ctx context.Context, downloaded, total int64) error,
 ) error {
-	log.Println("Downloading database from base URL", l.dbDownloadURL)
+	_, err := l.cityDB.update(ctx, l.httpClient, l.getSettings().DBDownloadURL, accountID, licenseKey, progress)
 
-	if err := os.MkdirAll(filepath.Dir(l.dbPath), os.ModePerm); err != nil {
-		return err
-	}
+	return err
+}
 
-	u, err := url.Parse(l.dbDownloadURL)
-	if err != nil {
-		return err
-	}
+// UploadDatabase receives a database from the client, either as a `.mmdb` file or as the `.tar.gz` archive MaxMind
+// distributes, and replaces the current database if it is valid
+func (l *local) UploadDatabase(
+	ctx context.Context,
+	read func(ctx context.Context) ([]byte, error),
+) error {
+	log.Println("Receiving database from client")
 
-	u.User = url.UserPassword(accountID, licenseKey)
+	return l.cityDB.upload(ctx, read)
+}
 
-	hr, err := http.Get(u.String())
-	if err != nil {
-		return err
-	}
-	if hr.Body != nil {
-		defer hr.Body.Close()
-	}
+func (l *local) DeleteDatabase(
+	ctx context.Context,
+) error {
+	log.Println("Deleting database")
 
-	gr, err := gzip.NewReader(hr.Body)
-	if err != nil {
-		return err
+	return l.cityDB.reader.Update(os.RemoveAll)
+}
+
+// CheckASNDatabase returns true if the optional ASN database is missing
+func (l *local) CheckASNDatabase(ctx context.Context) (bool, error) {
+	return !l.asnDB.exists(), nil
+}
+
+func (l *local) GetASNDatabaseInfo(ctx context.Context) (databaseInfo, error) {
+	return l.getDatabaseInfo(l.asnDB)
+}
+
+func (l *local) DownloadASNDatabase(
+	ctx context.Context,
+	accountID, licenseKey string,
+	progress func(ctx context.Context, downloaded, total int64) error,
+) error {
+	_, err := l.asnDB.update(ctx, l.httpClient, l.getSettings().ASNDBDownloadURL, accountID, licenseKey, progress)
+
+	return err
+}
+
+func (l *local) UploadASNDatabase(
+	ctx context.Context,
+	read func(ctx context.Context) ([]byte, error),
+) error {
+	log.Println("Receiving ASN database from client")
+
+	return l.asnDB.upload(ctx, read)
+}
+
+func (l *local) DeleteASNDatabase(
+	ctx context.Context,
+) error {
+	log.Println("Deleting ASN database")
+
+	return l.asnDB.reader.Update(os.RemoveAll)
+}
+
+// CheckDBIPDatabase returns true if the DB-IP database is missing
+func (l *local) CheckDBIPDatabase(ctx context.Context) (bool, error) {
+	return !l.dbipDB.exists(), nil
+}
+
+func (l *local) GetDBIPDatabaseInfo(ctx context.Context) (databaseInfo, error) {
+	return l.getDatabaseInfo(l.dbipDB)
+}
+
+// DownloadDBIPDatabase downloads the DB-IP Lite database, which doesn't require an account
+func (l *local) DownloadDBIPDatabase(
+	ctx context.Context,
+	progress func(ctx context.Context, downloaded, total int64) error,
+) error {
+	_, err := l.dbipDB.update(ctx, l.httpClient, l.getSettings().DBIPDBDownloadURL, "", "", progress)
+
+	return err
+}
+
+func (l *local) UploadDBIPDatabase(
+	ctx context.Context,
+	read func(ctx context.Context) ([]byte, error),
+) error {
+	log.Println("Receiving DB-IP database from client")
+
+	return l.dbipDB.upload(ctx, read)
+}
+
+func (l *local) DeleteDBIPDatabase(
+	ctx context.Context,
+) error {
+	log.Println("Deleting DB-IP database")
+
+	return l.dbipDB.reader.Update(os.RemoveAll)
+}
+
+func (l *local) SetDBIPDBDownloadURL(ctx context.Context, dbipDBDownloadURL string) error {
+	_, err := l.updateSettings(func(s *settings) {
+		s.DBIPDBDownloadURL = dbipDBDownloadURL
+	})
+
+	return err
+}
+
+func (l *local) GetDBIPDBDownloadURL(ctx context.Context) (string, error) {
+	return l.getSettings().DBIPDBDownloadURL, nil
+}
+
+// newGeoProvider creates the provider for `config`; the providers of the databases managed by the service are shared
+func (l *local) newGeoProvider(config geoProviderConfig) GeoProvider {
+	switch config.Type {
+	case geoProviderTypeMaxMind:
+		return sharedGeoProvider{l.cityDB.reader}
+
+	case geoProviderTypeDBIP:
+		return sharedGeoProvider{l.dbipDB.reader}
+
+	case geoProviderTypeIP2Location:
+		return newIP2LocationGeoProvider(config.Path)
+
+	case geoProviderTypeCSV:
+		return newCSVGeoProvider(config.Path)
+
+	default:
+		return newHTTPGeoProvider(
+			config.URL,
+			filepath.Join(l.geoHTTPCacheDir, fmt.Sprintf("geo-http-cache-%x.json", sha256.Sum256([]byte(config.URL)))),
+			l.httpClient,
+		)
 	}
-	defer gr.Close()
+}
 
-	tr := tar.NewReader(gr)
-	found := false
-	for {
-		hdr, err := tr.Next()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
+// SetGeoProviders sets the geolocation providers, which are asked in order until one of them knows the location
+// of an address. Providers which load a file are opened right away so that invalid files are reported
+func (l *local) SetGeoProviders(ctx context.Context, configs []geoProviderConfig) error {
+	if len(configs) == 0 {
+		return errors.Join(ErrInvalidGeoProvider, fmt.Errorf("at least one provider is required"))
+	}
 
+	for _, config := range configs {
+		if err := config.validate(); err != nil {
 			return err
 		}
+	}
+
+	l.geoProvidersUpdateLock.Lock()
+	defer l.geoProvidersUpdateLock.Unlock()
+
+	l.geoProvidersLock.RLock()
+	unused := map[geoProviderConfig]GeoProvider{}
+	for i, config := range l.geoProviderConfigs {
+		unused[config] = l.geoProviders[i]
+	}
+	l.geoProvidersLock.RUnlock()
+
+	// Providers which are still active are reused, which keeps their loaded files and caches
+	providers := []GeoProvider{}
+	added := []GeoProvider{}
+	for _, config := range configs {
+		if provider, ok := unused[config]; ok {
+			delete(unused, config)
+
+			providers = append(providers, provider)
 
-		if !strings.HasSuffix(hdr.Name, ".mmdb") {
 			continue
 		}
 
-		out, err := os.Create(l.dbPath)
-		if err != nil {
-			return err
+		provider := l.newGeoProvider(config)
+		if _, ok := provider.(sharedGeoProvider); !ok {
+			if err := provider.Open(); err != nil {
+				return errors.Join(err, closeGeoProviders(added))
+			}
 		}
-		defer out.Close()
 
-		if _, err := io.Copy(out, tr); err != nil {
-			return err
-		}
+		providers = append(providers, provider)
+		added = append(added, provider)
+	}
 
-		found = true
+	if err := saveConfig(l.geoProvidersPath, configs); err != nil {
+		return errors.Join(err, closeGeoProviders(added))
 	}
 
-	if !found {
-		return ErrDatabaseNotInArchive
+	l.geoProvidersLock.Lock()
+	l.geoProviders = providers
+	l.geoProviderConfigs = slices.Clone(configs)
+	l.geoProvidersLock.Unlock()
+
+	removed := []GeoProvider{}
+	for _, provider := range unused {
+		removed = append(removed, provider)
 	}
 
-	return nil
+	return closeGeoProviders(removed)
 }
 
-func (l *local) UploadDatabase(
-	ctx context.Context,
-	read func(ctx context.Context) ([]byte, error),
-) error {
-	log.Println("Receiving database from client")
+func (l *local) GetGeoProviders(ctx context.Context) ([]geoProviderConfig, error) {
+	l.geoProvidersLock.RLock()
+	defer l.geoProvidersLock.RUnlock()
 
-	if err := os.MkdirAll(filepath.Dir(l.dbPath), os.ModePerm); err != nil {
+	return slices.Clone(l.geoProviderConfigs), nil
+}
+
+// lookupGeoProviders returns the location of `ip` from the active providers
+func (l *local) lookupGeoProviders(ip net.IP) geoIPRecord {
+	l.geoProvidersLock.RLock()
+	defer l.geoProvidersLock.RUnlock()
+
+	return lookupGeoProviders(l.geoProviders, ip)
+}
+
+func (l *local) SetDatabaseAutoUpdate(ctx context.Context, autoUpdate databaseAutoUpdate) error {
+	if err := autoUpdate.validate(); err != nil {
 		return err
 	}
 
-	out, err := os.Create(l.dbPath)
-	if err != nil {
+	l.dbAutoUpdateLock.Lock()
+	defer l.dbAutoUpdateLock.Unlock()
+
+	if err := saveConfig(l.dbAutoUpdatePath, autoUpdate); err != nil {
 		return err
 	}
-	defer out.Close()
 
-	for {
-		chunk, err := read(ctx)
-		if err != nil {
-			return err
-		}
+	l.dbAutoUpdate = autoUpdate
 
-		if len(chunk) == 0 {
-			return nil
-		}
-
-		if _, err := out.Write(chunk); err != nil {
-			return nil
-		}
+	select {
+	case l.dbAutoUpdateChanged <- struct{}{}:
+	default:
 	}
+
+	return nil
 }
 
-func (l *local) DeleteDatabase(
-	ctx context.Context,
-) error {
-	log.Println("Deleting database")
+func (l *local) GetDatabaseAutoUpdate(ctx context.Context) (databaseAutoUpdate, error) {
+	l.dbAutoUpdateLock.Lock()
+	defer l.dbAutoUpdateLock.Unlock()
 
-	return os.RemoveAll(l.dbPath)
+	return l.dbAutoUpdate, nil
+}
+
+func (l *local) GetDatabaseUpdateStatus(ctx context.Context) (databaseUpdateStatus, error) {
+	return l.cityDB.getStatus(), nil
+}
+
+func (l *local) GetASNDatabaseUpdateStatus(ctx context.Context) (databaseUpdateStatus, error) {
+	return l.asnDB.getStatus(), nil
+}
+
+func (l *local) GetDBIPDatabaseUpdateStatus(ctx context.Context) (databaseUpdateStatus, error) {
+	return l.dbipDB.getStatus(), nil
 }
 
 func (l *local) ListDevices(ctx context.Context) ([]uutils.Device, error) {
 	return uutils.ListDevices(ctx)
 }
 
+// SetMaxPacketCache sets the number of packets, or of connections in summarized mode, which are kept for `GetPackets`.
+// If it shrinks, the oldest entries are removed
 func (l *local) SetMaxPacketCache(ctx context.Context, packetCache int) error {
-	l.maxPacketCache = packetCache
+	_, err := l.updateSettings(func(s *settings) {
+		s.MaxPacketCache = packetCache
+	})
 
-	return nil
+	return err
 }
 
 func (l *local) GetMaxPacketCache(ctx context.Context) (int, error) {
-	return l.maxPacketCache, nil
+	return l.getSettings().MaxPacketCache, nil
+}
+
+// SetSnapLen enables the header-only capture mode, in which only the first `snapLen` bytes of each packet leave
+// the trace command. A `snapLen` of 0 captures full packets. Changes apply to devices traced afterwards
+func (l *local) SetSnapLen(ctx context.Context, snapLen int) error {
+	_, err := l.updateSettings(func(s *settings) {
+		s.SnapLen = snapLen
+	})
+
+	return err
+}
+
+func (l *local) GetSnapLen(ctx context.Context) (int, error) {
+	return l.getSettings().SnapLen, nil
+}
+
+// SetLocale sets the preferred locale of the names of locations; names which aren't available in it fall back to English
+func (l *local) SetLocale(ctx context.Context, locale string) error {
+	_, err := l.updateSettings(func(s *settings) {
+		s.Locale = locale
+	})
+
+	return err
+}
+
+func (l *local) GetLocale(ctx context.Context) (string, error) {
+	return l.getSettings().Locale, nil
 }
 
 func (l *local) SetDBDownloadURL(ctx context.Context, dbDownloadURL string) error {
-	l.dbDownloadURL = dbDownloadURL
+	_, err := l.updateSettings(func(s *settings) {
+		s.DBDownloadURL = dbDownloadURL
+	})
 
-	return nil
+	return err
 }
 
 func (l *local) GetDBDownloadURL(ctx context.Context) (string, error) {
-	return l.dbDownloadURL, nil
+	return l.getSettings().DBDownloadURL, nil
 }
 
+func (l *local) SetASNDBDownloadURL(ctx context.Context, asnDBDownloadURL string) error {
+	_, err := l.updateSettings(func(s *settings) {
+		s.ASNDBDownloadURL = asnDBDownloadURL
+	})
+
+	return err
+}
+
+func (l *local) GetASNDBDownloadURL(ctx context.Context) (string, error) {
+	return l.getSettings().ASNDBDownloadURL, nil
+}
+
+// SetMaxConnectionsCache sets the number of connections which are kept; once there are more, the least recently
+// seen connections are removed
 func (l *local) SetMaxConnectionsCache(ctx context.Context, maxConnectionsCache int) error {
-	l.maxConnectionsCache = maxConnectionsCache
+	_, err := l.updateSettings(func(s *settings) {
+		s.MaxConnectionsCache = maxConnectionsCache
+	})
+
+	return err
+}
+
+func (l *local) GetMaxConnectionsCache(ctx context.Context) (int, error) {
+	return l.getSettings().MaxConnectionsCache, nil
+}
+
+// SetConnectionIdleTimeout sets the time in milliseconds after which connections without packets are removed
+func (l *local) SetConnectionIdleTimeout(ctx context.Context, idleTimeout int64) error {
+	_, err := l.updateSettings(func(s *settings) {
+		s.ConnectionIdleTimeout = idleTimeout
+	})
+
+	return err
+}
+
+func (l *local) GetConnectionIdleTimeout(ctx context.Context) (int64, error) {
+	return l.getSettings().ConnectionIdleTimeout, nil
+}
+
+// expireConnections periodically removes the connections which have been idle for longer than the idle timeout
+func (l *local) expireConnections(ctx context.Context) {
+	ticker := time.NewTicker(connectionExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case now := <-ticker.C:
+			l.connectionsLock.Lock()
+			l.connections.Expire(now.Add(-l.connectionIdleTimeout))
+			l.connectionsLock.Unlock()
+		}
+	}
+}
+
+// SetHomeLocation sets the location of private and special-purpose addresses.
+// Guessing it from traffic needs a traced device with a public address, so it doesn't work behind NAT
+func (l *local) SetHomeLocation(ctx context.Context, homeLocation homeLocation) error {
+	if err := homeLocation.validate(); err != nil {
+		return err
+	}
+
+	l.homeLocationLock.Lock()
+	defer l.homeLocationLock.Unlock()
+
+	if err := saveHomeLocation(l.homeLocationPath, homeLocation); err != nil {
+		return err
+	}
+
+	l.homeLocation = homeLocation
+
+	return nil
+}
+
+func (l *local) GetHomeLocation(ctx context.Context) (homeLocation, error) {
+	l.homeLocationLock.RLock()
+	defer l.homeLocationLock.RUnlock()
+
+	return l.homeLocation, nil
+}
+
+func (l *local) ListLocationOverrides(ctx context.Context) ([]locationOverride, error) {
+	return l.locationOverrides.List(), nil
+}
+
+// SetLocationOverride adds a location override, or replaces the override with the same CIDR. Returns the override
+// with its CIDR in canonical form
+func (l *local) SetLocationOverride(ctx context.Context, override locationOverride) (locationOverride, error) {
+	return l.locationOverrides.Put(override)
+}
+
+// DeleteLocationOverride removes the location override with `cidr`, and returns false if there is none
+func (l *local) DeleteLocationOverride(ctx context.Context, cidr string) (bool, error) {
+	return l.locationOverrides.Delete(cidr)
+}
+
+// ImportLocationOverrides imports location overrides from `cidr,label,latitude,longitude,tags` CSV rows, in which
+// tags are separated by `;`. If `replace` is set, all existing overrides are removed first
+func (l *local) ImportLocationOverrides(ctx context.Context, data string, replace bool) (int, error) {
+	return l.locationOverrides.Import(strings.NewReader(data), replace)
+}
+
+// ExportLocationOverrides returns the location overrides as CSV in the format read by `ImportLocationOverrides`
+func (l *local) ExportLocationOverrides(ctx context.Context) (string, error) {
+	var b strings.Builder
+	if err := l.locationOverrides.Export(&b); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// locate looks up the location of an address. Location overrides take precedence; otherwise public addresses are
+// looked up with the geolocation providers and all other addresses use the home location
+func (l *local) locate(ip net.IP) (addressClass, geoIPRecord) {
+	class := getAddressClass(ip)
+
+	override, ok := l.locationOverrides.Lookup(ip)
+	if ok && override.hasLocation() {
+		return class, geoIPRecord{
+			cityName:  override.Label,
+			longitude: override.Longitude,
+			latitude:  override.Latitude,
+			precision: locationPrecisionOverride,
+			label:     override.Label,
+			tags:      override.Tags,
+		}
+	}
+
+	record := l.locateWithoutOverrides(ip, class)
+	if ok {
+		record.label = override.Label
+		record.tags = override.Tags
+	}
+
+	return class, record
+}
+
+func (l *local) locateWithoutOverrides(ip net.IP, class addressClass) geoIPRecord {
+	if class == addressClassPublic {
+		return l.lookupGeoProviders(ip)
+	}
+
+	l.homeLocationLock.RLock()
+	defer l.homeLocationLock.RUnlock()
+
+	precision := locationPrecisionHome
+	if l.homeLocation.Longitude == 0 && l.homeLocation.Latitude == 0 {
+		precision = locationPrecisionUnknown
+	}
+
+	return geoIPRecord{
+		cityName:  l.homeLocation.Label,
+		longitude: l.homeLocation.Longitude,
+		latitude:  l.homeLocation.Latitude,
+		precision: precision,
+	}
+}
+
+// guessHomeLocation sets the home location to the location of `ip` if guessing is enabled
+func (l *local) guessHomeLocation(ip net.IP) {
+	l.homeLocationLock.RLock()
+	guess := l.homeLocation.GuessFromTraffic
+	l.homeLocationLock.RUnlock()
+
+	if !guess {
+		return
+	}
+
+	location := l.lookupGeoProviders(ip)
+	if location.precision == locationPrecisionUnknown {
+		return
+	}
+
+	l.homeLocationLock.Lock()
+	defer l.homeLocationLock.Unlock()
+
+	if !l.homeLocation.GuessFromTraffic {
+		return
+	}
+
+	homeLocation := l.homeLocation
+	homeLocation.Longitude = location.longitude
+	homeLocation.Latitude = location.latitude
+	homeLocation.GuessFromTraffic = false
+	if homeLocation.Label == "" {
+		homeLocation.Label = location.cityName
+	}
+
+	if err := saveHomeLocation(l.homeLocationPath, homeLocation); err != nil {
+		log.Println("Could not save guessed home location:", err)
+	}
+
+	l.homeLocation = homeLocation
+}
+
+func (l *local) RestartApp(ctx context.Context) error {
+	bin, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	if err := utils.ForkExec(
+		bin,
+		os.Args,
+	); err != nil {
+		return err
+	}
+
+	if err := uutils.KillBrowser(ctx, l.browserState); err != nil {
+		return err
+	}
+
+	// Exiting skips the stop function of the server, so the active connections are recorded here
+	if err := l.closeHistory(); err != nil {
+		log.Println("Could not write flow history:", err)
+	}
+
+	os.Exit(0)
+
+	return nil
+}
+
+// handlePacket decodes and records a packet; `timestamp` is when it was captured
+func (l *local) handlePacket(
+	session *traceSession,
+	data []byte,
+	length int,
+	linkType layers.LinkType,
+	timestamp time.Time,
+	decodeOptions gopacket.DecodeOptions,
+) {
+	session.stats.packetsCaptured.Add(1)
+
+	packet := gopacket.NewPacket(data, linkType, decodeOptions)
+
+	layerType := ""
+	nextLayerType := ""
+	var srcIP net.IP
+	var dstIP net.IP
+
+	if ipv4 := packet.Layer(layers.LayerTypeIPv4); ipv4 != nil {
+		layer, ok := ipv4.(*layers.IPv4)
+		if !ok {
+			session.stats.packetsUndecodable.Add(1)
+
+			return
+		}
+
+		layerType = "IPv4"
+		nextLayerType = layer.NextLayerType().String()
+		srcIP = layer.SrcIP
+		dstIP = layer.DstIP
+	} else if ipv6 := packet.Layer(layers.LayerTypeIPv6); ipv6 != nil {
+		layer, ok := ipv6.(*layers.IPv6)
+		if !ok {
+			session.stats.packetsUndecodable.Add(1)
+
+			return
+		}
+
+		layerType = "IPv6"
+		nextLayerType = layer.NextLayerType().String()
+		srcIP = layer.SrcIP
+		dstIP = layer.DstIP
+	} else if packet.ErrorLayer() != nil {
+		session.stats.packetsUndecodable.Add(1)
+
+		return
+	} else {
+		session.stats.packetsWithoutIP.Add(1)
+
+		return
+	}
+
+	srcPort := 0
+	dstPort := 0
+	if tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+		srcPort = int(tcp.SrcPort)
+		dstPort = int(tcp.DstPort)
+	} else if udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP); ok {
+		srcPort = int(udp.SrcPort)
+		dstPort = int(udp.DstPort)
+	} else if sctp, ok := packet.Layer(layers.LayerTypeSCTP).(*layers.SCTP); ok {
+		srcPort = int(sctp.SrcPort)
+		dstPort = int(sctp.DstPort)
+	}
+
+	if srcIP != nil && dstIP != nil {
+		direction := getDirection(session.localAddresses, srcIP, dstIP)
+		if direction == directionOutbound && getAddressClass(srcIP) == addressClassPublic {
+			l.guessHomeLocation(srcIP)
+		}
+
+		srcAddressClass, srcLocation := l.locate(srcIP)
+		dstAddressClass, dstLocation := l.locate(dstIP)
+
+		srcASN := l.asnDB.reader.Lookup(srcIP)
+		dstASN := l.asnDB.reader.Lookup(dstIP)
+
+		connection := tracedConnection{
+			Timestamp: timestamp.UnixMilli(),
+			Length:    length,
+
+			LayerType:     layerType,
+			NextLayerType: nextLayerType,
+
+			SrcIP:          srcIP.String(),
+			SrcPort:        srcPort,
+			SrcCountryName: srcLocation.countryName,
+			SrcCityName:    srcLocation.cityName,
+			SrcLongitude:   srcLocation.longitude,
+			SrcLatitude:    srcLocation.latitude,
+
+			SrcLocationPrecision: srcLocation.precision,
+
+			SrcContinentName:         srcLocation.continentName,
+			SrcSubdivisionName:       srcLocation.subdivisionName,
+			SrcPostalCode:            srcLocation.postalCode,
+			SrcTimeZone:              srcLocation.timeZone,
+			SrcAccuracyRadius:        srcLocation.accuracyRadius,
+			SrcIsAnycast:             srcLocation.isAnycast,
+			SrcRegisteredCountryName: srcLocation.registeredCountryName,
+
+			SrcAddressClass: srcAddressClass,
+			SrcASN:          srcASN.asn,
+			SrcOrg:          srcASN.org,
+
+			SrcLabel: srcLocation.label,
+			SrcTags:  srcLocation.tags,
+
+			DstIP:          dstIP.String(),
+			DstPort:        dstPort,
+			DstCountryName: dstLocation.countryName,
+			DstCityName:    dstLocation.cityName,
+			DstLongitude:   dstLocation.longitude,
+			DstLatitude:    dstLocation.latitude,
+
+			DstLocationPrecision: dstLocation.precision,
+
+			DstContinentName:         dstLocation.continentName,
+			DstSubdivisionName:       dstLocation.subdivisionName,
+			DstPostalCode:            dstLocation.postalCode,
+			DstTimeZone:              dstLocation.timeZone,
+			DstAccuracyRadius:        dstLocation.accuracyRadius,
+			DstIsAnycast:             dstLocation.isAnycast,
+			DstRegisteredCountryName: dstLocation.registeredCountryName,
+
+			DstAddressClass: dstAddressClass,
+			DstASN:          dstASN.asn,
+			DstOrg:          dstASN.org,
+
+			DstLabel: dstLocation.label,
+			DstTags:  dstLocation.tags,
+
+			Direction: direction,
+
+			BytesSent: length,
+		}
+
+		// Flows are oriented so that the local side is the source, and replies are counted in the flow of their request;
+		// the packet itself keeps its direction on the wire
+		flow := connection
+		if flow.Direction == directionInbound {
+			flow = reverseTracedConnection(flow)
+		}
+
+		l.connectionsLock.Lock()
+		l.connections.Observe(flow, l.flowKey, time.Now())
+		l.connections.Evict(l.maxConnectionsCache)
+		l.connectionsLock.Unlock()
+
+		l.packetsCacheLock.Lock()
+		if l.summarized {
+			l.packetCache.Aggregate(flow, l.flowKey)
+		} else {
+			l.packetCache.Add(connection)
+		}
+		l.packetsCacheLock.Unlock()
+	}
+}
+
+// openDatabases opens the active geolocation providers and, if it exists, the optional ASN database
+func (l *local) openDatabases() error {
+	l.geoProvidersLock.RLock()
+	for _, provider := range l.geoProviders {
+		if err := provider.Open(); err != nil {
+			l.geoProvidersLock.RUnlock()
+
+			return err
+		}
+	}
+	l.geoProvidersLock.RUnlock()
+
+	if err := l.asnDB.reader.Open(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
 
 	return nil
 }
 
-func (l *local) GetMaxConnectionsCache(ctx context.Context) (int, error) {
-	return l.maxConnectionsCache, nil
-}
+// startTracing registers a new trace session, or fails if `name` is already being traced
+func (l *local) startTracing(name string) (*traceSession, error) {
+	l.tracingDevicesLock.Lock()
+	defer l.tracingDevicesLock.Unlock()
 
-func (l *local) RestartApp(ctx context.Context) error {
-	bin, err := os.Executable()
-	if err != nil {
-		return err
+	if session, ok := l.tracingDevices[name]; ok && (session.Status == traceStatusStarting || session.Status == traceStatusRunning) {
+		return nil, errors.Join(ErrDeviceAlreadyTraced, fmt.Errorf("trace session %v is %v", name, session.Status))
 	}
 
-	if err := utils.ForkExec(
-		bin,
-		os.Args,
-	); err != nil {
-		return err
-	}
+	session := &traceSession{
+		Name:   name,
+		Status: traceStatusStarting,
 
-	if err := uutils.KillBrowser(ctx, l.browserState); err != nil {
-		return err
+		stats:          &traceStats{},
+		localAddresses: map[string]struct{}{},
+		stopped:        make(chan struct{}),
+		exited:         make(chan struct{}),
 	}
 
-	os.Exit(0)
+	l.tracingDevices[name] = session
 
-	return nil
+	return session, nil
 }
 
-func (l *local) TraceDevice(ctx context.Context, device uutils.Device) error {
+// runTracing marks a trace session as running; `stop` must make its capture goroutine exit
+func (l *local) runTracing(session *traceSession, stop func()) {
 	l.tracingDevicesLock.Lock()
 	defer l.tracingDevicesLock.Unlock()
 
-	_, ok := l.tracingDevices[device.PcapName]
-	if ok {
-		return nil
+	session.Status = traceStatusRunning
+	session.stop = stop
+
+	// Stopping might have been requested while the trace was still starting
+	select {
+	case <-session.stopped:
+		stop()
+	default:
 	}
+}
 
-	if _, err := os.Stat(l.dbPath); err != nil {
-		return err
+// finishTracing marks a trace session as stopped if it ended normally or was stopped, or as failed otherwise
+func (l *local) finishTracing(session *traceSession, err error) {
+	l.tracingDevicesLock.Lock()
+	defer l.tracingDevicesLock.Unlock()
+
+	select {
+	case <-session.stopped:
+		session.Status = traceStatusStopped
+
+	default:
+		if err == nil {
+			session.Status = traceStatusStopped
+		} else {
+			session.Status = traceStatusFailed
+			session.Error = err.Error()
+		}
 	}
 
-	db, err := geoip2.Open(l.dbPath)
+	close(session.exited)
+}
+
+func (l *local) TraceDevice(ctx context.Context, device uutils.Device) (err error) {
+	session, err := l.startTracing(device.PcapName)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err != nil {
+			l.finishTracing(session, err)
+		}
+	}()
+
+	// Without the addresses of the device, all flows are treated as transit flows instead of failing the trace
+	if localAddresses, err := getLocalAddresses(device.NetName); err != nil {
+		log.Println("Could not get local addresses of device, treating all flows as transit:", err)
+	} else {
+		session.localAddresses = localAddresses
+	}
+
+	if err := l.openDatabases(); err != nil {
+		return err
+	}
+
+	if _, err := l.updateSettings(func(s *settings) {
+		s.LastTracedDevice = device.PcapName
+		s.LastTraceFilter = device.Filter
+	}); err != nil {
+		log.Println("Could not save last traced device:", err)
+	}
+
+	snapLen := l.getSettings().SnapLen
 
 	var (
 		cmd         *exec.Cmd
@@ -325,6 +1315,13 @@ func (l *local) TraceDevice(ctx context.Context, device uutils.Device) error {
 		stdoutOverwrite io.ReadCloser
 		fifoTmpDir      string
 	)
+	defer func() {
+		if err != nil {
+			if fifoTmpDir != "" {
+				_ = os.RemoveAll(fifoTmpDir)
+			}
+		}
+	}()
 restartTraceCommand:
 	bin, err := os.Executable()
 	if err != nil {
@@ -351,11 +1348,11 @@ restartTraceCommand:
 		bin = filepath.Join(strings.TrimSuffix(string(output), "\n"), "files", strings.TrimPrefix(bin, filepath.Join("/", "app")))
 
 		if recreateCmd {
-			cmd = exec.CommandContext(ctx, uutils.FlatpakSpawnCmd, "--host", "--env="+TraceCommandEnv+"=true", bin, device.PcapName, fmt.Sprintf("%v", device.MTU))
+			cmd = exec.CommandContext(ctx, uutils.FlatpakSpawnCmd, "--host", "--env="+TraceCommandEnv+"=true", bin, device.PcapName, fmt.Sprintf("%v", device.MTU), device.Filter, fmt.Sprintf("%v", snapLen))
 		}
 	} else {
 		if recreateCmd {
-			cmd = exec.CommandContext(ctx, bin, device.PcapName, fmt.Sprintf("%v", device.MTU))
+			cmd = exec.CommandContext(ctx, bin, device.PcapName, fmt.Sprintf("%v", device.MTU), device.Filter, fmt.Sprintf("%v", snapLen))
 		}
 		cmd.Env = append(cmd.Env, TraceCommandEnv+"=true")
 	}
@@ -375,7 +1372,7 @@ restartTraceCommand:
 	}
 
 	handshake := make([]byte, traceCommandHandshakeLen)
-	if _, err := stdout.Read(handshake); err != nil {
+	if _, err := io.ReadFull(stdout, handshake); err != nil {
 		if cmd.Process != nil {
 			_ = cmd.Process.Kill()
 
@@ -387,7 +1384,27 @@ restartTraceCommand:
 
 	switch string(handshake) {
 	case uutils.TraceCommandHandshakeHandleAcquired:
-		break
+		version := make([]byte, 1)
+		if _, err := io.ReadFull(stdout, version); err != nil {
+			if cmd.Process != nil {
+				_ = cmd.Process.Kill()
+
+				_ = cmd.Wait()
+			}
+
+			return err
+		}
+
+		// The trace command might be an older binary, e.g. one that has been granted capabilities
+		if version[0] != uutils.TraceCommandProtocolVersion {
+			if cmd.Process != nil {
+				_ = cmd.Process.Kill()
+
+				_ = cmd.Wait()
+			}
+
+			return errors.Join(ErrUnsupportedTraceProtocolVersion, fmt.Errorf("expected version %v, got %v", uutils.TraceCommandProtocolVersion, version[0]))
+		}
 
 	case uutils.TraceCommandHandshakeHandlePermissionDenied:
 		if cmd.Process != nil {
@@ -417,7 +1434,7 @@ restartTraceCommand:
 
 		switch runtime.GOOS {
 		case "linux":
-			setcapCommand, err := uutils.CreateElevatedCommand(ctx, "Authentication Required", "Authentication is needed to capture packets.", fmt.Sprintf(`setcap cap_net_raw,cap_net_admin=eip '%v'`, bin))
+			setcapCommand, err := uutils.CreateElevatedCommand(ctx, "Authentication Required", "Authentication is needed to capture packets.", "setcap cap_net_raw,cap_net_admin=eip "+uutils.QuoteShellArgument(bin))
 			if err != nil {
 				return errors.Join(ErrCouldNotCreateElevatedCommand, err)
 			}
@@ -446,11 +1463,11 @@ restartTraceCommand:
 			for i, arg := range cmd.Args {
 				// The first argument is always the currently running program, so we skip it
 				if i > 0 {
-					args = append(args, arg)
+					args = append(args, uutils.QuoteShellArgument(arg))
 				}
 			}
 
-			cmd, err = uutils.CreateElevatedCommand(ctx, "Authentication Required", "Authentication is needed to capture packets.", fmt.Sprintf("'%v' %v 1> '%v'", bin, strings.Join(args, " "), stdoutPath))
+			cmd, err = uutils.CreateElevatedCommand(ctx, "Authentication Required", "Authentication is needed to capture packets.", fmt.Sprintf("%v %v 1> %v", uutils.QuoteShellArgument(bin), strings.Join(args, " "), uutils.QuoteShellArgument(stdoutPath)))
 			if err != nil {
 				return errors.Join(ErrCouldNotCreateElevatedCommand, err)
 			}
@@ -463,6 +1480,15 @@ restartTraceCommand:
 
 		goto restartTraceCommand
 
+	case uutils.TraceCommandHandshakeInvalidFilter:
+		if cmd.Process != nil {
+			_ = cmd.Process.Kill()
+
+			_ = cmd.Wait()
+		}
+
+		return errors.Join(ErrInvalidTraceFilter, fmt.Errorf("could not apply filter `%v`", device.Filter))
+
 	default:
 		if cmd.Process != nil {
 			_ = cmd.Process.Kill()
@@ -473,7 +1499,20 @@ restartTraceCommand:
 		return errors.Join(ErrUnexpectedErrorWhileStartingTraceCommand, errors.New(string(handshake)))
 	}
 
+	l.runTracing(session, func() {
+		// Closing `stdout` also stops elevated commands, which we can't kill directly
+		if cmd.Process != nil {
+			_ = cmd.Process.Kill()
+		}
+		_ = stdout.Close()
+	})
+
 	go func() {
+		var err error
+		defer func() {
+			l.finishTracing(session, err)
+		}()
+
 		defer func() {
 			if fifoTmpDir != "" {
 				_ = os.RemoveAll(fifoTmpDir)
@@ -487,211 +1526,337 @@ restartTraceCommand:
 
 				_ = cmd.Wait()
 			}
-			_ = db.Close()
-
-			l.tracingDevicesLock.Lock()
-			delete(l.tracingDevices, device.PcapName)
-			l.tracingDevicesLock.Unlock()
 		}()
 
-		decoder := json.NewDecoder(stdout)
+		reader := uutils.NewFrameReader(bufio.NewReader(stdout))
+		var (
+			frameType uutils.FrameType
+			rawPacket uutils.Packet
+			rawStats  uutils.Stats
+		)
 		for {
-			var rawPacket uutils.Packet
-			if err := decoder.Decode(&rawPacket); err != nil {
+			frameType, err = reader.ReadFrame(&rawPacket, &rawStats)
+			if err != nil {
+				select {
+				case <-session.stopped:
+					log.Println("Stopped capturing on", device.PcapName)
 
-				log.Println("Could not continue capturing:", err)
+				default:
+					log.Println("Could not continue capturing:", err)
+				}
 
 				return
 			}
 
-			packet := gopacket.NewPacket(rawPacket.Data, rawPacket.LinkType, rawPacket.DecodeOptions)
+			switch frameType {
+			case uutils.FrameTypePacket:
+				l.handlePacket(session, rawPacket.Data, rawPacket.Length, rawPacket.LinkType, rawPacket.Timestamp, gopacket.Default)
 
-			layerType := ""
-			nextLayerType := ""
-			var srcIP net.IP
-			var dstIP net.IP
+			case uutils.FrameTypeStats:
+				session.stats.packetsReceived.Store(rawStats.PacketsReceived)
+				session.stats.packetsDropped.Store(rawStats.PacketsDropped)
+			}
+		}
+	}()
 
-			if ipv4 := packet.Layer(layers.LayerTypeIPv4); ipv4 != nil {
-				layer, ok := ipv4.(*layers.IPv4)
-				if !ok {
-					continue
-				}
+	return nil
+}
 
-				layerType = "IPv4"
-				nextLayerType = layer.NextLayerType().String()
-				srcIP = layer.SrcIP
-				dstIP = layer.DstIP
-			} else if ipv6 := packet.Layer(layers.LayerTypeIPv6); ipv6 != nil {
-				layer, ok := ipv6.(*layers.IPv6)
-				if !ok {
-					continue
-				}
+// TraceFile replays a pcap or pcapng file received from the client through the same pipeline as `TraceDevice`.
+// A `speed` of 1 replays the packets in real time, a `speed` of N replays them N times as fast,
+// and a `speed` of 0 replays them as fast as possible. Packets keep the timestamps from the file, and
+// `localAddresses` are the addresses of the device the file was captured on, which determine the direction of
+// packets; without them, all packets are in transit. The trace session is named `name` with the `file:` prefix
+func (l *local) TraceFile(
+	ctx context.Context,
+	name string,
+	speed float64,
+	localAddresses []string,
+	read func(ctx context.Context) ([]byte, error),
+) (err error) {
+	if speed < 0 {
+		return ErrInvalidReplaySpeed
+	}
 
-				layerType = "IPv6"
-				nextLayerType = layer.NextLayerType().String()
-				srcIP = layer.SrcIP
-				dstIP = layer.DstIP
-			}
+	addresses := map[string]struct{}{}
+	for _, address := range localAddresses {
+		ip := net.ParseIP(strings.TrimSpace(address))
+		if ip == nil {
+			return errors.Join(ErrInvalidLocalAddress, fmt.Errorf("%q is not an IP address", address))
+		}
 
-			if srcIP != nil && dstIP != nil {
-				srcCountryName,
-					srcCityName,
-					srcLongitude,
-					srcLatitude := lookupLocation(db, srcIP)
-
-				dstCountryName,
-					dstCityName,
-					dstLongitude,
-					dstLatitude := lookupLocation(db, dstIP)
-
-				connection := tracedConnection{
-					time.Now().UnixMilli(),
-					rawPacket.Length,
-
-					layerType,
-					nextLayerType,
-
-					srcIP.String(),
-					srcCountryName,
-					srcCityName,
-					srcLongitude,
-					srcLatitude,
-
-					dstIP.String(),
-					dstCountryName,
-					dstCityName,
-					dstLongitude,
-					dstLatitude,
-
-					nil,
-				}
+		addresses[ip.String()] = struct{}{}
+	}
 
-				l.connectionsLock.Lock()
+	session, err := l.startTracing(traceFileSessionPrefix + name)
+	if err != nil {
+		return err
+	}
+	session.localAddresses = addresses
+	defer func() {
+		if err != nil {
+			l.finishTracing(session, err)
+		}
+	}()
 
-				if len(l.connections) > l.maxConnectionsCache {
-					l.connections = map[string]tracedConnection{}
-				}
+	log.Println("Receiving capture file", name, "from client")
 
-				id := getTracedConnectionID(connection)
+	if err := l.openDatabases(); err != nil {
+		return err
+	}
 
-				candidate, ok := l.connections[id]
-				if !ok {
-					connection.timer = time.AfterFunc(time.Second*10, func() {
-						l.connectionsLock.Lock()
+	captureTmpDir, err := os.MkdirTemp(os.TempDir(), "")
+	if err != nil {
+		return err
+	}
 
-						delete(l.connections, id)
+	capture, err := os.Create(filepath.Join(captureTmpDir, "capture"))
+	if err != nil {
+		return errors.Join(err, os.RemoveAll(captureTmpDir))
+	}
 
-						l.connectionsLock.Unlock()
-					})
+	for {
+		chunk, err := read(ctx)
+		if err != nil {
+			return errors.Join(err, capture.Close(), os.RemoveAll(captureTmpDir))
+		}
 
-					l.connections[id] = connection
-				} else {
-					candidate.timer.Reset(time.Second * 10)
-				}
-				l.connectionsLock.Unlock()
+		if len(chunk) == 0 {
+			break
+		}
 
-				if l.summarized {
-					l.packetsCacheLock.Lock()
+		if _, err := capture.Write(chunk); err != nil {
+			return errors.Join(err, capture.Close(), os.RemoveAll(captureTmpDir))
+		}
+	}
 
-					exists := false
-					for i, candidate := range l.packetCache {
-						if getTracedConnectionID(candidate) == getTracedConnectionID(connection) {
-							// Don't increment length of self
-							if i != len(l.packetCache)-1 {
-								l.packetCache[i].Length += connection.Length
-							}
+	if _, err := capture.Seek(0, io.SeekStart); err != nil {
+		return errors.Join(err, capture.Close(), os.RemoveAll(captureTmpDir))
+	}
 
-							exists = true
+	source, err := uutils.OpenCaptureFile(capture)
+	if err != nil {
+		return errors.Join(err, capture.Close(), os.RemoveAll(captureTmpDir))
+	}
 
-							break
-						}
-					}
+	// The replay loop checks `session.stopped` itself
+	l.runTracing(session, func() {})
 
-					if !exists {
-						l.packetCache = append([]tracedConnection{connection}, l.packetCache...)
-					}
+	go func() {
+		var err error
+		defer func() {
+			_ = capture.Close()
+			_ = os.RemoveAll(captureTmpDir)
+
+			l.finishTracing(session, err)
+		}()
+
+		var (
+			firstCaptureTimestamp time.Time
+			firstReplayTimestamp  time.Time
+		)
+		for {
+			select {
+			case <-session.stopped:
+				return
+			default:
+			}
+
+			data, ci, linkType, rerr := source.ReadPacket()
+			if rerr != nil {
+				if !errors.Is(rerr, io.EOF) {
+					err = rerr
+
+					log.Println("Could not continue replaying:", err)
+				}
 
-					l.packetsCacheLock.Unlock()
+				return
+			}
+
+			if speed > 0 {
+				if firstCaptureTimestamp.IsZero() {
+					firstCaptureTimestamp = ci.Timestamp
+					firstReplayTimestamp = time.Now()
 				} else {
-					l.packetsCacheLock.Lock()
-					l.packetCache = append([]tracedConnection{connection}, l.packetCache...)
-					l.packetsCacheLock.Unlock()
-
-					if len(l.packetCache) > l.maxPacketCache {
-						l.packetsCacheLock.Lock()
-						if len(l.packetCache) > l.maxPacketCache {
-							l.packetCache = l.packetCache[:l.maxPacketCache]
-						}
-						l.packetsCacheLock.Unlock()
+					// Space out the packets the same way they were captured, scaled by the speed factor
+					select {
+					case <-time.After(time.Until(firstReplayTimestamp.Add(time.Duration(float64(ci.Timestamp.Sub(firstCaptureTimestamp)) / speed)))):
+					case <-session.stopped:
+						return
 					}
 				}
 			}
+
+			// Every packet in a capture file has been received and none have been dropped
+			session.stats.packetsReceived.Add(1)
+
+			l.handlePacket(session, data, ci.Length, linkType, ci.Timestamp, gopacket.Default)
 		}
 	}()
 
-	l.tracingDevices[device.PcapName] = struct{}{}
-
 	return nil
 }
 
-func (l *local) GetConnections(ctx context.Context) ([]tracedConnection, error) {
-	l.connectionsLock.Lock()
-	defer l.connectionsLock.Unlock()
+// StopTracing stops the trace session `name` and waits until it has exited
+func (l *local) StopTracing(ctx context.Context, name string) error {
+	l.tracingDevicesLock.Lock()
+
+	session, ok := l.tracingDevices[name]
+	if !ok {
+		l.tracingDevicesLock.Unlock()
+
+		return ErrDeviceNotTraced
+	}
+
+	select {
+	case <-session.stopped:
+	default:
+		close(session.stopped)
+
+		// If the trace is still starting, `runTracing` will stop it once it is running
+		if session.stop != nil {
+			session.stop()
+		}
+	}
+
+	l.tracingDevicesLock.Unlock()
+
+	// Traces which are still starting exit once they are running or have failed to start
+	select {
+	case <-session.exited:
+		return nil
+
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *local) ListTracingDevices(ctx context.Context) ([]traceSession, error) {
+	l.tracingDevicesLock.Lock()
+	defer l.tracingDevicesLock.Unlock()
+
+	sessions := []traceSession{}
+	for _, session := range l.tracingDevices {
+		sessions = append(sessions, *session)
+	}
+
+	slices.SortFunc(sessions, func(a, b traceSession) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return sessions, nil
+}
+
+func (l *local) GetCaptureStats(ctx context.Context) ([]captureStats, error) {
+	l.tracingDevicesLock.Lock()
+	defer l.tracingDevicesLock.Unlock()
+
+	stats := []captureStats{}
+	for _, session := range l.tracingDevices {
+		stats = append(stats, captureStats{
+			Name:               session.Name,
+			PacketsReceived:    session.stats.packetsReceived.Load(),
+			PacketsDropped:     session.stats.packetsDropped.Load(),
+			PacketsCaptured:    session.stats.packetsCaptured.Load(),
+			PacketsUndecodable: session.stats.packetsUndecodable.Load(),
+			PacketsWithoutIP:   session.stats.packetsWithoutIP.Load(),
+		})
+	}
+
+	slices.SortFunc(stats, func(a, b captureStats) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return stats, nil
+}
 
-	connections := []tracedConnection{}
-	for _, connection := range l.connections {
-		connections = append(connections, connection)
+// GetConnections returns the connections which match the filter expression `filter`; an empty filter matches all connections
+func (l *local) GetConnections(ctx context.Context, filter string) ([]tracedConnection, error) {
+	f, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
 	}
 
-	return connections, nil
+	l.connectionsLock.Lock()
+	connections := l.connections.List()
+	l.connectionsLock.Unlock()
+
+	return f.Filter(connections), nil
 }
 
-func (l *local) GetPackets(ctx context.Context) ([]tracedConnection, error) {
+// GetPackets returns the packets, or summarized packets, which match the filter expression `filter`; an empty filter
+// matches all packets
+func (l *local) GetPackets(ctx context.Context, filter string) ([]tracedConnection, error) {
+	f, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
 	l.packetsCacheLock.Lock()
-	defer l.packetsCacheLock.Unlock()
+	packets := l.packetCache.List()
+	l.packetsCacheLock.Unlock()
 
-	return l.packetCache, nil
+	return f.Filter(packets), nil
 }
 
+// SetIsSummarized switches between the packet and summarized modes of `GetPackets`; the packet cache is cleared if the mode changes
 func (l *local) SetIsSummarized(ctx context.Context, summarized bool) error {
-	l.packetsCacheLock.Lock()
-	defer l.packetsCacheLock.Unlock()
+	_, err := l.updateSettings(func(s *settings) {
+		s.Summarized = summarized
+	})
 
-	l.summarized = summarized
+	return err
+}
 
-	l.packetCache = []tracedConnection{}
+// SetFlowKey sets how packets are grouped into connections and summarized packets; both caches are cleared if the key changes
+func (l *local) SetFlowKey(ctx context.Context, key flowKey) error {
+	_, err := l.updateSettings(func(s *settings) {
+		s.FlowKey = key
+	})
 
-	return nil
+	return err
+}
+
+func (l *local) GetFlowKey(ctx context.Context) (flowKey, error) {
+	return l.getSettings().FlowKey, nil
 }
 
 func (l *local) LookupLocation(ctx context.Context, ip string) (location, error) {
-	if _, err := os.Stat(l.dbPath); err != nil {
+	if err := l.openDatabases(); err != nil {
 		return location{}, err
 	}
 
-	db, err := geoip2.Open(l.dbPath)
-	if err != nil {
-		return location{}, err
+	_, record := l.locate(net.ParseIP(ip))
+
+	return newLocation(record), nil
+}
+
+// LookupLocations looks up the location, ASN, location override and address class of many addresses at once.
+// Invalid addresses don't fail the lookup, but have their `error` set instead
+func (l *local) LookupLocations(ctx context.Context, ips []string) ([]addressLookup, error) {
+	if err := l.openDatabases(); err != nil {
+		return nil, err
 	}
-	defer db.Close()
 
-	_, _, longitude, latitude := lookupLocation(db, net.ParseIP(ip))
+	lookups := make([]addressLookup, len(ips))
+	for i, ip := range ips {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		lookups[i] = l.lookupAddress(ip)
+	}
 
-	return location{
-		Longitude: longitude,
-		Latitude:  latitude,
-	}, nil
+	return lookups, nil
 }
 
 type remote struct {
 	GetEscalationPermission func(ctx context.Context, restart bool) (bool, error)
+	OnSettingsChanged       func(ctx context.Context, settings settings) error
 }
 
-func StartServer(ctx context.Context, addr string, heartbeat time.Duration, localhostize bool, browserState *ui.BrowserState) (string, func() error, error) {
-	if strings.TrimSpace(addr) == "" {
-		addr = ":0"
-	}
-
+// newLocal creates the service with the configuration and databases of the current user
+func newLocal(browserState *ui.BrowserState) *local {
 	dataHomeDir := os.Getenv("XDG_DATA_HOME")
 	if strings.TrimSpace(dataHomeDir) == "" {
 		userHomeDir, err := os.UserHomeDir()
@@ -702,20 +1867,156 @@ func StartServer(ctx context.Context, addr string, heartbeat time.Duration, loca
 		dataHomeDir = filepath.Join(userHomeDir, ".local", "share")
 	}
 
-	dbPath := filepath.Join(dataHomeDir, "connmapper", "GeoLite2-City.mmdb")
+	configHomeDir := os.Getenv("XDG_CONFIG_HOME")
+	if strings.TrimSpace(configHomeDir) == "" {
+		userHomeDir, err := os.UserHomeDir()
+		if err != nil {
+			panic(err)
+		}
+
+		configHomeDir = filepath.Join(userHomeDir, ".config")
+	}
+
+	settingsPath := filepath.Join(configHomeDir, "connmapper", "settings.json")
+
+	currentSettings, err := loadSettings(settingsPath)
+	if err != nil {
+		log.Println("Could not load settings, using defaults:", err)
+
+		currentSettings = getDefaultSettings()
+	}
+
+	homeLocationPath := filepath.Join(configHomeDir, "connmapper", "home-location.json")
+
+	home, err := loadHomeLocation(homeLocationPath)
+	if err != nil {
+		log.Println("Could not load home location, using default:", err)
+
+		home = homeLocation{}
+	}
+
+	locationOverrides := newLocationOverrides(filepath.Join(dataHomeDir, "connmapper", "location-overrides.json"))
+	if err := locationOverrides.Load(); err != nil {
+		log.Println("Could not load location overrides, starting without overrides:", err)
+	}
+
+	cacheHomeDir := os.Getenv("XDG_CACHE_HOME")
+	if strings.TrimSpace(cacheHomeDir) == "" {
+		userHomeDir, err := os.UserHomeDir()
+		if err != nil {
+			panic(err)
+		}
+
+		cacheHomeDir = filepath.Join(userHomeDir, ".cache")
+	}
+
+	geoProvidersPath := filepath.Join(configHomeDir, "connmapper", "geo-providers.json")
+
+	geoProviderConfigs := []geoProviderConfig{}
+	if err := loadConfig(geoProvidersPath, &geoProviderConfigs); err != nil {
+		log.Println("Could not load geolocation providers, using default:", err)
+	}
+	if slices.ContainsFunc(geoProviderConfigs, func(c geoProviderConfig) bool {
+		return c.validate() != nil
+	}) {
+		log.Println("Invalid geolocation providers, using default")
+
+		geoProviderConfigs = nil
+	}
+	if len(geoProviderConfigs) == 0 {
+		geoProviderConfigs = []geoProviderConfig{{Type: geoProviderTypeMaxMind}}
+	}
+
+	dbAutoUpdatePath := filepath.Join(configHomeDir, "connmapper", "database-auto-update.json")
+
+	dbAutoUpdate := databaseAutoUpdate{
+		Interval: int64((time.Hour * 24).Seconds()),
+	}
+	if err := loadConfig(dbAutoUpdatePath, &dbAutoUpdate); err != nil {
+		log.Println("Could not load database auto-update configuration, using default:", err)
+	} else if err := dbAutoUpdate.validate(); err != nil {
+		log.Println("Invalid database auto-update configuration, disabling it:", err)
+
+		dbAutoUpdate.Enabled = false
+	}
+
+	history := newFlowHistory(filepath.Join(dataHomeDir, "connmapper", "history"))
+	history.SetRetention(currentSettings.HistoryEnabled, currentSettings.HistoryMaxAge, currentSettings.HistoryMaxSize)
+
+	// Proxies are configured with the `HTTP_PROXY`, `HTTPS_PROXY` and `NO_PROXY` environment variables
+	httpTransport := http.DefaultTransport.(*http.Transport).Clone()
+	httpTransport.Proxy = http.ProxyFromEnvironment
 
 	service := &local{
-		connections:    map[string]tracedConnection{},
-		tracingDevices: map[string]struct{}{},
+		connections: newConnectionTable(func(connection tracedConnection, lastTimestamp int64) {
+			history.Add(flowRecord{connection, lastTimestamp})
+		}),
+		tracingDevices: map[string]*traceSession{},
 		browserState:   browserState,
-		packetCache:    []tracedConnection{},
+		packetCache:    newPacketCache(currentSettings.MaxPacketCache),
+
+		summarized:            currentSettings.Summarized,
+		flowKey:               currentSettings.FlowKey,
+		maxConnectionsCache:   currentSettings.MaxConnectionsCache,
+		connectionIdleTimeout: time.Duration(currentSettings.ConnectionIdleTimeout) * time.Millisecond,
+
+		settings:        currentSettings,
+		settingsPath:    settingsPath,
+		settingsChanged: make(chan struct{}, 1),
+
+		cityDB: newGeoIPDatabase(
+			filepath.Join(dataHomeDir, "connmapper", "GeoLite2-City.mmdb"),
+			lookupLocation,
+		),
+		asnDB: newGeoIPDatabase(
+			filepath.Join(dataHomeDir, "connmapper", "GeoLite2-ASN.mmdb"),
+			lookupASNRecord,
+		),
+		dbipDB: newGeoIPDatabase(
+			filepath.Join(dataHomeDir, "connmapper", "dbip-city-lite.mmdb"),
+			lookupLocation,
+		),
+
+		geoProviderConfigs: geoProviderConfigs,
+		geoProvidersPath:   geoProvidersPath,
+		geoHTTPCacheDir:    filepath.Join(cacheHomeDir, "connmapper"),
+
+		httpClient: &http.Client{Transport: httpTransport},
+
+		homeLocation:     home,
+		homeLocationPath: homeLocationPath,
+
+		locationOverrides: locationOverrides,
+
+		history: history,
+
+		dbAutoUpdate:        dbAutoUpdate,
+		dbAutoUpdatePath:    dbAutoUpdatePath,
+		dbAutoUpdateChanged: make(chan struct{}, 1),
+	}
+
+	service.cityDB.reader.SetLocale(currentSettings.Locale)
+	service.dbipDB.reader.SetLocale(currentSettings.Locale)
+
+	for _, config := range geoProviderConfigs {
+		service.geoProviders = append(service.geoProviders, service.newGeoProvider(config))
+	}
+
+	return service
+}
 
-		maxPacketCache:      100,
-		maxConnectionsCache: 1000000,
-		dbPath:              dbPath,
-		dbDownloadURL:       "https://download.maxmind.com/geoip/databases/GeoLite2-City/download?suffix=tar.gz",
+func StartServer(ctx context.Context, addr string, heartbeat time.Duration, localhostize bool, browserState *ui.BrowserState) (string, func() error, error) {
+	if strings.TrimSpace(addr) == "" {
+		addr = ":0"
 	}
 
+	service := newLocal(browserState)
+
+	go service.runDatabaseAutoUpdate(ctx)
+	go service.expireConnections(ctx)
+	go service.runHistory(ctx)
+	go service.runSettingsNotifications(ctx)
+
 	var clients atomic.Int64
 	registry := rpc.NewRegistry[remote, json.RawMessage](
 		service,
@@ -833,9 +2134,13 @@ func StartServer(ctx context.Context, addr string, heartbeat time.Duration, loca
 		return "", nil, err
 	}
 
+	stop := func() error {
+		return errors.Join(listener.Close(), service.closeHistory())
+	}
+
 	if localhostize {
-		return utils.Localhostize(url.String()), listener.Close, nil
+		return utils.Localhostize(url.String()), stop, nil
 	}
 
-	return url.String(), listener.Close, nil
+	return url.String(), stop, nil
 }
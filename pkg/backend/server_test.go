@@ -0,0 +1,69 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTraceSessionLifecycle(t *testing.T) {
+	l := &local{tracingDevices: map[string]*traceSession{}}
+
+	session, err := l.startTracing("eth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := l.startTracing("eth0"); !errors.Is(err, ErrDeviceAlreadyTraced) {
+		t.Errorf("got %v, want %v", err, ErrDeviceAlreadyTraced)
+	}
+
+	// Capture files can have the same names as devices
+	if _, err := l.startTracing(traceFileSessionPrefix + "eth0"); err != nil {
+		t.Error(err)
+	}
+
+	// Stopping a trace which is still starting waits until it has exited
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := l.StopTracing(ctx, "eth0"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	stopped := make(chan struct{})
+	l.runTracing(session, func() {
+		close(stopped)
+	})
+
+	select {
+	case <-stopped:
+	default:
+		t.Fatal("trace which was stopped while starting wasn't stopped once it was running")
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- l.StopTracing(context.Background(), "eth0")
+	}()
+
+	l.finishTracing(session, errors.New("capture closed"))
+
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+
+	if session.Status != traceStatusStopped {
+		t.Errorf("got status %v, want %v", session.Status, traceStatusStopped)
+	}
+
+	if err := l.StopTracing(context.Background(), "eth1"); !errors.Is(err, ErrDeviceNotTraced) {
+		t.Errorf("got %v, want %v", err, ErrDeviceNotTraced)
+	}
+
+	// Stopped traces can be started again
+	if _, err := l.startTracing("eth0"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,277 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	settingsVersion = 1
+
+	settingsNotificationTimeout = time.Second * 10
+)
+
+// settings are the persistent settings of the service. Settings with their own structure and RPCs, such as the
+// home location, the database auto-update and the geolocation providers, are stored in their own files
+type settings struct {
+	Version int `json:"version"`
+
+	MaxPacketCache        int     `json:"maxPacketCache"`
+	MaxConnectionsCache   int     `json:"maxConnectionsCache"`
+	ConnectionIdleTimeout int64   `json:"connectionIdleTimeout"` // Milliseconds
+	Summarized            bool    `json:"summarized"`
+	FlowKey               flowKey `json:"flowKey"`
+	SnapLen               int     `json:"snapLen"`
+	MaxDatabaseAge        int64   `json:"maxDatabaseAge"` // Seconds
+	Locale                string  `json:"locale"`
+
+	DBDownloadURL     string `json:"dbDownloadURL"`
+	ASNDBDownloadURL  string `json:"asnDBDownloadURL"`
+	DBIPDBDownloadURL string `json:"dbipDBDownloadURL"`
+
+	LastTracedDevice string `json:"lastTracedDevice"` // Pcap name of the device which was traced last
+	LastTraceFilter  string `json:"lastTraceFilter"`
+
+	HistoryEnabled bool  `json:"historyEnabled"`
+	HistoryMaxAge  int64 `json:"historyMaxAge"`  // Seconds
+	HistoryMaxSize int64 `json:"historyMaxSize"` // Bytes
+}
+
+func getDefaultSettings() settings {
+	return settings{
+		Version: settingsVersion,
+
+		MaxPacketCache:        defaultMaxPacketCache,
+		MaxConnectionsCache:   1000000,
+		ConnectionIdleTimeout: defaultConnectionIdleTimeout.Milliseconds(),
+		FlowKey:               flowKeyHostPair,
+		MaxDatabaseAge:        int64((time.Hour * 24 * 30).Seconds()),
+		Locale:                defaultLocale,
+
+		DBDownloadURL:     "https://download.maxmind.com/geoip/databases/GeoLite2-City/download?suffix=tar.gz",
+		ASNDBDownloadURL:  "https://download.maxmind.com/geoip/databases/GeoLite2-ASN/download?suffix=tar.gz",
+		DBIPDBDownloadURL: "https://download.db-ip.com/free/dbip-city-lite-{year}-{month}.mmdb.gz",
+
+		HistoryEnabled: true,
+		HistoryMaxAge:  defaultHistoryMaxAge,
+		HistoryMaxSize: defaultHistoryMaxSize,
+	}
+}
+
+func validateDownloadURL(name, downloadURL string) error {
+	u, err := url.Parse(downloadURL)
+	if err != nil {
+		return errors.Join(ErrInvalidSettings, fmt.Errorf("%v is not a valid URL", name), err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return errors.Join(ErrInvalidSettings, fmt.Errorf("%v must be an HTTP or HTTPS URL", name))
+	}
+
+	return nil
+}
+
+// validate returns all invalid settings at once
+func (s settings) validate() error {
+	errs := []error{}
+
+	if s.MaxPacketCache < 1 {
+		errs = append(errs, errors.Join(ErrInvalidSettings, fmt.Errorf("maximum packet cache must be at least 1")))
+	}
+
+	if s.MaxConnectionsCache < 1 {
+		errs = append(errs, errors.Join(ErrInvalidSettings, fmt.Errorf("maximum connections cache must be at least 1")))
+	}
+
+	if s.ConnectionIdleTimeout < connectionExpiryInterval.Milliseconds() {
+		errs = append(errs, errors.Join(ErrInvalidConnectionIdleTimeout, fmt.Errorf("idle timeout must be at least %v milliseconds", connectionExpiryInterval.Milliseconds())))
+	}
+
+	switch s.FlowKey {
+	case flowKeyHostPair, flowKeyFiveTuple, flowKeyDestinationService, flowKeyOrganization:
+	default:
+		errs = append(errs, errors.Join(ErrInvalidFlowKey, fmt.Errorf("flow key must be one of %v, %v, %v or %v", flowKeyHostPair, flowKeyFiveTuple, flowKeyDestinationService, flowKeyOrganization)))
+	}
+
+	if s.SnapLen != 0 && s.SnapLen < minSnapLen {
+		errs = append(errs, errors.Join(ErrInvalidSnapLen, fmt.Errorf("snap length must be 0 or at least %v bytes", minSnapLen)))
+	}
+
+	if s.MaxDatabaseAge < 0 {
+		errs = append(errs, errors.Join(ErrInvalidMaxDatabaseAge, fmt.Errorf("maximum database age must not be negative")))
+	}
+
+	if !slices.Contains(supportedLocales, s.Locale) {
+		errs = append(errs, errors.Join(ErrInvalidLocale, fmt.Errorf("locale must be one of %v", strings.Join(supportedLocales, ", "))))
+	}
+
+	errs = append(
+		errs,
+		validateDownloadURL("database download URL", s.DBDownloadURL),
+		validateDownloadURL("ASN database download URL", s.ASNDBDownloadURL),
+		validateDownloadURL("DB-IP database download URL", s.DBIPDBDownloadURL),
+	)
+
+	if s.HistoryMaxAge < minHistoryMaxAge {
+		errs = append(errs, errors.Join(ErrInvalidSettings, fmt.Errorf("maximum history age must be at least %v seconds", minHistoryMaxAge)))
+	}
+
+	if s.HistoryMaxSize < minHistoryMaxSize {
+		errs = append(errs, errors.Join(ErrInvalidSettings, fmt.Errorf("maximum history size must be at least %v bytes", minHistoryMaxSize)))
+	}
+
+	return errors.Join(errs...)
+}
+
+// loadSettings reads the settings from `path`, migrating them from older versions. Settings which are missing from
+// the file keep their default values
+func loadSettings(path string) (settings, error) {
+	s := getDefaultSettings()
+	s.Version = 0
+
+	if err := loadConfig(path, &s); err != nil {
+		return settings{}, err
+	}
+
+	if s.Version > settingsVersion {
+		return settings{}, errors.Join(ErrUnsupportedSettingsVersion, fmt.Errorf("settings version %v is newer than the supported version %v", s.Version, settingsVersion))
+	}
+
+	// Version 0 is a missing file or a file without a version, which only differs from version 1 in the version field
+	s.Version = settingsVersion
+
+	if err := s.validate(); err != nil {
+		return settings{}, err
+	}
+
+	return s, nil
+}
+
+// applySettings updates the state of the service to `next`; `prev` are the settings it had so far
+func (l *local) applySettings(prev, next settings) {
+	l.connectionsLock.Lock()
+	l.packetsCacheLock.Lock()
+
+	if prev.FlowKey != next.FlowKey {
+		l.connections.Clear()
+		l.packetCache.Clear()
+	}
+
+	if prev.Summarized != next.Summarized {
+		l.packetCache.Clear()
+	}
+
+	l.flowKey = next.FlowKey
+	l.summarized = next.Summarized
+
+	l.maxConnectionsCache = next.MaxConnectionsCache
+	l.connectionIdleTimeout = time.Duration(next.ConnectionIdleTimeout) * time.Millisecond
+	l.connections.Evict(next.MaxConnectionsCache)
+
+	l.packetCache.Resize(next.MaxPacketCache)
+
+	l.packetsCacheLock.Unlock()
+	l.connectionsLock.Unlock()
+
+	if prev.Locale != next.Locale {
+		l.cityDB.reader.SetLocale(next.Locale)
+		l.dbipDB.reader.SetLocale(next.Locale)
+	}
+
+	l.history.SetRetention(next.HistoryEnabled, next.HistoryMaxAge, next.HistoryMaxSize)
+}
+
+func (l *local) getSettings() settings {
+	l.settingsLock.Lock()
+	defer l.settingsLock.Unlock()
+
+	return l.settings
+}
+
+// updateSettings validates, persists and applies the settings changed by `update`, and notifies all clients of them
+func (l *local) updateSettings(update func(s *settings)) (settings, error) {
+	l.settingsLock.Lock()
+	defer l.settingsLock.Unlock()
+
+	next := l.settings
+	update(&next)
+	next.Version = settingsVersion
+
+	if err := next.validate(); err != nil {
+		return settings{}, err
+	}
+
+	if next == l.settings {
+		return next, nil
+	}
+
+	if err := saveConfig(l.settingsPath, next); err != nil {
+		return settings{}, err
+	}
+
+	l.applySettings(l.settings, next)
+	l.settings = next
+
+	select {
+	case l.settingsChanged <- struct{}{}:
+	default:
+	}
+
+	return next, nil
+}
+
+// runSettingsNotifications notifies all clients of the current settings whenever they change until `ctx` is cancelled.
+// Notifications are sent one after another, so clients always end up with the latest settings
+func (l *local) runSettingsNotifications(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-l.settingsChanged:
+			l.notifySettings(l.getSettings())
+		}
+	}
+}
+
+// notifySettings sends the settings to all clients
+func (l *local) notifySettings(s settings) {
+	if l.ForRemotes == nil {
+		return
+	}
+
+	peers := []remote{}
+	_ = l.ForRemotes(func(remoteID string, remote remote) error {
+		peers = append(peers, remote)
+
+		return nil
+	})
+
+	for _, peer := range peers {
+		ctx, cancel := context.WithTimeout(context.Background(), settingsNotificationTimeout)
+
+		if err := peer.OnSettingsChanged(ctx, s); err != nil {
+			log.Println("Could not notify client of changed settings:", err)
+		}
+
+		cancel()
+	}
+}
+
+func (l *local) GetSettings(ctx context.Context) (settings, error) {
+	return l.getSettings(), nil
+}
+
+// UpdateSettings replaces all settings and returns an error which lists all invalid settings if any of them are
+// invalid, in which case none of them are changed
+func (l *local) UpdateSettings(ctx context.Context, s settings) (settings, error) {
+	return l.updateSettings(func(next *settings) {
+		*next = s
+	})
+}
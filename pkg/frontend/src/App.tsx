@@ -9,6 +9,9 @@ import {
   FlexItem,
   Form,
   FormGroup,
+  HelperText,
+  HelperTextItem,
+  Label,
   MenuToggle,
   Modal,
   ModalBody,
@@ -39,6 +42,7 @@ import {
   OutlinedClockIcon,
   OutlinedWindowRestoreIcon,
   RedoIcon,
+  StopIcon,
   TableIcon,
   TimesIcon,
   TrashIcon,
@@ -68,9 +72,12 @@ import logoDark from "./logo-dark.png";
 import "./main.scss";
 import { getIP } from "webrtc-ip";
 
+// Settings which were stored in localStorage before the backend persisted them
 const MAX_PACKET_CACHE_KEY = "latensee.maxPacketCache";
 const MAX_CONNECTIONS_CACHE_KEY = "latensee.maxConnectionsCache";
+const CONNECTION_IDLE_TIMEOUT_KEY = "latensee.connectionIdleTimeout";
 const DB_DOWNLOAD_URL_KEY = "latensee.dbDownloadUrl";
+
 const CONNECTIONS_INTERVAL_KEY = "latensee.connectionsInterval";
 const PACKETS_INTERVAL_KEY = "latensee.packetsInterval";
 const CYBERPUNK_MODE_KEY = "latensee.cyberpunkMode";
@@ -78,26 +85,93 @@ const CYBERPUNK_MODE_KEY = "latensee.cyberpunkMode";
 const DARK_THEME_CLASS_NAME = "pf-v6-theme-dark";
 const CYBERPUNK_THEME_CLASS_NAME = "pf-v6-x-theme-cyberpunk";
 
+type ILocationPrecision =
+  | "city"
+  | "subdivision"
+  | "country"
+  | "home"
+  | "override"
+  | "unknown";
+
 interface ILocation {
   longitude: number;
   latitude: number;
+  precision: ILocationPrecision;
+
+  countryName: string;
+  cityName: string;
+  continentName: string;
+  subdivisionName: string;
+  postalCode: string;
+  timeZone: string;
+  accuracyRadius: number;
+  isAnycast: boolean;
+  registeredCountryName: string;
+
+  label: string;
+  tags: string[];
 }
 
+type IAddressClass =
+  | "public"
+  | "private"
+  | "shared"
+  | "loopback"
+  | "linkLocal"
+  | "uniqueLocal"
+  | "multicast"
+  | "broadcast"
+  | "documentation"
+  | "benchmarking"
+  | "reserved";
+
 interface ITracedConnection {
   layerType: string;
   nextLayerType: string;
 
   srcIP: string;
+  srcPort: number;
   srcCountryName: string;
   srcCityName: string;
   srcLongitude: number;
   srcLatitude: number;
+  srcLocationPrecision: ILocationPrecision;
+  srcContinentName: string;
+  srcSubdivisionName: string;
+  srcPostalCode: string;
+  srcTimeZone: string;
+  srcAccuracyRadius: number;
+  srcIsAnycast: boolean;
+  srcRegisteredCountryName: string;
+  srcAddressClass: IAddressClass;
+  srcASN: number;
+  srcOrg: string;
+  srcLabel: string;
+  srcTags: string[];
 
   dstIP: string;
+  dstPort: number;
   dstCountryName: string;
   dstCityName: string;
   dstLongitude: number;
   dstLatitude: number;
+  dstLocationPrecision: ILocationPrecision;
+  dstContinentName: string;
+  dstSubdivisionName: string;
+  dstPostalCode: string;
+  dstTimeZone: string;
+  dstAccuracyRadius: number;
+  dstIsAnycast: boolean;
+  dstRegisteredCountryName: string;
+  dstAddressClass: IAddressClass;
+  dstASN: number;
+  dstOrg: string;
+  dstLabel: string;
+  dstTags: string[];
+
+  direction: "inbound" | "outbound" | "local" | "transit";
+  bytesSent: number;
+  bytesReceived: number;
 }
 
 interface ITracedConnectionDetails extends ITracedConnection {
@@ -122,7 +196,102 @@ const getTracedConnectionID = (connection: ITracedConnection) =>
   connection.dstIP +
   "-";
 
+interface ISettings {
+  version: number;
+
+  maxPacketCache: number;
+  maxConnectionsCache: number;
+  connectionIdleTimeout: number;
+  summarized: boolean;
+  flowKey: "hostPair" | "fiveTuple" | "destinationService" | "organization";
+  snapLen: number;
+  maxDatabaseAge: number;
+  locale: string;
+
+  dbDownloadURL: string;
+  asnDBDownloadURL: string;
+  dbipDBDownloadURL: string;
+
+  lastTracedDevice: string;
+  lastTraceFilter: string;
+
+  historyEnabled: boolean;
+  historyMaxAge: number;
+  historyMaxSize: number;
+}
+
+// Defaults of the backend for the settings which were stored in localStorage
+const DEFAULT_MAX_PACKET_CACHE = 100;
+const DEFAULT_MAX_CONNECTIONS_CACHE = 1000000;
+const DEFAULT_CONNECTION_IDLE_TIMEOUT = 10000;
+const DEFAULT_DB_DOWNLOAD_URL =
+  "https://download.maxmind.com/geoip/databases/GeoLite2-City/download?suffix=tar.gz";
+
+// migrateLegacySettings returns the settings from localStorage for which the
+// backend still has the defaults, and removes them from localStorage so that
+// they are only migrated once
+const migrateLegacySettings = (settings: ISettings): Partial<ISettings> => {
+  const legacySettings: Partial<ISettings> = {};
+
+  const maxPacketCache = parseInt(
+    localStorage.getItem(MAX_PACKET_CACHE_KEY) || "0"
+  );
+  if (
+    maxPacketCache > 0 &&
+    settings.maxPacketCache === DEFAULT_MAX_PACKET_CACHE
+  ) {
+    legacySettings.maxPacketCache = maxPacketCache;
+  }
+
+  const maxConnectionsCache = parseInt(
+    localStorage.getItem(MAX_CONNECTIONS_CACHE_KEY) || "0"
+  );
+  if (
+    maxConnectionsCache > 0 &&
+    settings.maxConnectionsCache === DEFAULT_MAX_CONNECTIONS_CACHE
+  ) {
+    legacySettings.maxConnectionsCache = maxConnectionsCache;
+  }
+
+  const connectionIdleTimeout = parseInt(
+    localStorage.getItem(CONNECTION_IDLE_TIMEOUT_KEY) || "0"
+  );
+  if (
+    connectionIdleTimeout > 0 &&
+    settings.connectionIdleTimeout === DEFAULT_CONNECTION_IDLE_TIMEOUT
+  ) {
+    legacySettings.connectionIdleTimeout = connectionIdleTimeout;
+  }
+
+  const dbDownloadURL = (
+    localStorage.getItem(DB_DOWNLOAD_URL_KEY) || ""
+  ).trim();
+  if (
+    dbDownloadURL.length > 0 &&
+    settings.dbDownloadURL === DEFAULT_DB_DOWNLOAD_URL
+  ) {
+    legacySettings.dbDownloadURL = dbDownloadURL;
+  }
+
+  for (const key of [
+    MAX_PACKET_CACHE_KEY,
+    MAX_CONNECTIONS_CACHE_KEY,
+    CONNECTION_IDLE_TIMEOUT_KEY,
+    DB_DOWNLOAD_URL_KEY,
+  ]) {
+    localStorage.removeItem(key);
+  }
+
+  return legacySettings;
+};
+
 class Local {
+  onSettingsChanged?: (settings: ISettings) => void;
+
+  async OnSettingsChanged(ctx: ILocalContext, settings: ISettings) {
+    this.onSettingsChanged?.(settings);
+  }
+
   async GetEscalationPermission(ctx: ILocalContext, restart: boolean) {
     if (restart) {
       return confirm(
@@ -136,10 +305,17 @@ class Local {
   }
 }
 
+interface ITraceSession {
+  name: string;
+  status: "starting" | "running" | "failed" | "stopped";
+  error: string;
+}
+
 interface IDevice {
   PcapName: string;
   NetName: string;
   MTU: number;
+  Filter: string;
 }
 
 class Remote {
@@ -147,6 +323,17 @@ class Remote {
     return;
   }
 
+  async GetSettings(ctx: IRemoteContext): Promise<ISettings> {
+    return {} as ISettings;
+  }
+
+  async UpdateSettings(
+    ctx: IRemoteContext,
+    settings: ISettings
+  ): Promise<ISettings> {
+    return settings;
+  }
+
   async CheckDatabase(ctx: IRemoteContext): Promise<boolean> {
     return false;
   }
@@ -154,7 +341,12 @@ class Remote {
   async DownloadDatabase(
     ctx: IRemoteContext,
     accountID: string,
-    licenseKey: string
+    licenseKey: string,
+    progress: (
+      ctx: ILocalContext,
+      downloaded: number,
+      total: number
+    ) => Promise<void>
   ): Promise<void> {
     return;
   }
@@ -176,11 +368,31 @@ class Remote {
 
   async TraceDevice(ctx: IRemoteContext, device: IDevice): Promise<void> {}
 
-  async GetConnections(ctx: IRemoteContext): Promise<ITracedConnection[]> {
+  async TraceFile(
+    ctx: IRemoteContext,
+    name: string,
+    speed: number,
+    localAddresses: string[],
+    read: (ctx: ILocalContext) => Promise<number[]>
+  ): Promise<void> {}
+
+  async StopTracing(ctx: IRemoteContext, name: string): Promise<void> {}
+
+  async ListTracingDevices(ctx: IRemoteContext): Promise<ITraceSession[]> {
+    return [];
+  }
+
+  async GetConnections(
+    ctx: IRemoteContext,
+    filter: string
+  ): Promise<ITracedConnection[]> {
     return [];
   }
 
-  async GetPackets(ctx: IRemoteContext): Promise<ITracedConnectionDetails[]> {
+  async GetPackets(
+    ctx: IRemoteContext,
+    filter: string
+  ): Promise<ITracedConnectionDetails[]> {
     return [];
   }
 
@@ -213,6 +425,13 @@ class Remote {
     return 0;
   }
 
+  async SetConnectionIdleTimeout(
+    ctx: IRemoteContext,
+    idleTimeout: number
+  ): Promise<void> {
+    return;
+  }
+
   async SetDBDownloadURL(
     ctx: IRemoteContext,
     dbDownloadURL: string
@@ -232,6 +451,20 @@ class Remote {
     return {
       longitude: 0,
       latitude: 0,
+      precision: "unknown",
+
+      countryName: "",
+      cityName: "",
+      continentName: "",
+      subdivisionName: "",
+      postalCode: "",
+      timeZone: "",
+      accuracyRadius: 0,
+      isAnycast: false,
+      registeredCountryName: "",
+
+      label: "",
+      tags: [],
     } as ILocation;
   }
 }
@@ -296,9 +529,10 @@ const App = () => {
   useEffect(() => console.log(clients, "clients connected"), [clients]);
 
   const [reconnect, setReconnect] = useState(false);
+  const [local] = useState(new Local());
   const [registry] = useState(
     new Registry(
-      new Local(),
+      local,
       new Remote(),
 
       {
@@ -406,14 +640,26 @@ const App = () => {
 
   const addLocalLocation = useCallback(
     (packet: ITracedConnection) => {
-      if (!packet.srcLatitude && !packet.srcLongitude && currentLocation) {
+      if (
+        packet.srcLocationPrecision === "unknown" &&
+        packet.srcAddressClass !== "public" &&
+        currentLocation &&
+        currentLocation.precision !== "unknown"
+      ) {
         packet.srcLatitude = currentLocation.latitude;
         packet.srcLongitude = currentLocation.longitude;
+        packet.srcLocationPrecision = "home";
       }
 
-      if (!packet.dstLatitude && !packet.dstLongitude && currentLocation) {
+      if (
+        packet.dstLocationPrecision === "unknown" &&
+        packet.dstAddressClass !== "public" &&
+        currentLocation &&
+        currentLocation.precision !== "unknown"
+      ) {
         packet.dstLatitude = currentLocation.latitude;
         packet.dstLongitude = currentLocation.longitude;
+        packet.dstLocationPrecision = "home";
       }
     },
     [currentLocation]
@@ -452,6 +698,7 @@ const App = () => {
 
   const [devices, setDevices] = useState<IDevice[]>([]);
   const [maxConnectionsCache, setMaxConnectionsCache] = useState(0);
+  const [connectionIdleTimeout, setConnectionIdleTimeout] = useState(0);
   const [maxPacketCache, setMaxPacketCache] = useState(0);
   const [dbDownloadURL, setDBDownloadURL] = useState("");
   const [isDBConfigurationRequired, setIsDBConfigurationRequired] =
@@ -464,62 +711,57 @@ const App = () => {
     parseInt(localStorage.getItem(PACKETS_INTERVAL_KEY) || "100")
   );
 
+  // Settings are only sent to the backend once they have been loaded from it
+  const settingsSynced = useRef(false);
+
   useEffect(() => {
     if (clients <= 0) {
+      settingsSynced.current = false;
+
       return;
     }
 
     registry.forRemotes(async (_, remote) => {
       try {
-        // Rehydrate from localStorage
-        setMaxPacketCache(
-          parseInt(localStorage.getItem(MAX_PACKET_CACHE_KEY) || "0")
-        );
-
-        setMaxConnectionsCache(
-          parseInt(localStorage.getItem(MAX_CONNECTIONS_CACHE_KEY) || "0")
-        );
-
-        setDBDownloadURL(localStorage.getItem(DB_DOWNLOAD_URL_KEY) || "");
-
-        // Rehydrate from server and fetch devices
-        const [
-          newDevices,
-          newMaxConnectionsCache,
-          newMaxPacketCache,
-          newDBDownloadURL,
-          newIsDBDownloadRequired,
-        ] = await Promise.all([
-          remote.ListDevices(undefined),
-          remote.GetMaxConnectionsCache(undefined),
-          remote.GetMaxPacketCache(undefined),
-          remote.GetDBDownloadURL(undefined),
-          remote.CheckDatabase(undefined),
-        ]);
+        const [newDevices, newIsDBDownloadRequired, newSettings] =
+          await Promise.all([
+            remote.ListDevices(undefined),
+            remote.CheckDatabase(undefined),
+            remote.GetSettings(undefined),
+          ]);
 
         setDevices(newDevices);
 
         if (newDevices.length > 0) {
-          setSelectedDevicePcapName(newDevices[0]?.PcapName || "");
+          setSelectedDevicePcapName(
+            newDevices.find(
+              (d) => d.PcapName === newSettings.lastTracedDevice
+            )?.PcapName ||
+              newDevices[0]?.PcapName ||
+              ""
+          );
         }
 
-        // Set local values from server if they aren't set yet
-        if (
-          parseInt(localStorage.getItem(MAX_CONNECTIONS_CACHE_KEY) || "0") <= 0
-        ) {
-          setMaxConnectionsCache(newMaxConnectionsCache);
-        }
+        setTraceFilter(newSettings.lastTraceFilter);
 
-        if (parseInt(localStorage.getItem(MAX_PACKET_CACHE_KEY) || "0") <= 0) {
-          setMaxPacketCache(newMaxPacketCache);
-        }
+        let settings = newSettings;
 
-        if (
-          (localStorage.getItem(DB_DOWNLOAD_URL_KEY) || "").trim().length <= 0
-        ) {
-          setDBDownloadURL(newDBDownloadURL);
+        const legacySettings = migrateLegacySettings(settings);
+        if (Object.keys(legacySettings).length > 0) {
+          settings = await remote.UpdateSettings(undefined, {
+            ...settings,
+            ...legacySettings,
+          });
         }
 
+        settingsSynced.current = true;
+
+        setMaxPacketCache(settings.maxPacketCache);
+        setMaxConnectionsCache(settings.maxConnectionsCache);
+        setConnectionIdleTimeout(settings.connectionIdleTimeout);
+        setDBDownloadURL(settings.dbDownloadURL);
+        setIsSummarized(settings.summarized);
+
         setIsDBConfigurationRequired(newIsDBDownloadRequired);
       } catch (e) {
         alert(JSON.stringify((e as Error).message));
@@ -528,12 +770,10 @@ const App = () => {
   }, [clients]);
 
   useEffect(() => {
-    if (clients <= 0 || maxPacketCache <= 0) {
+    if (clients <= 0 || !settingsSynced.current || maxPacketCache <= 0) {
       return;
     }
 
-    localStorage.setItem(MAX_PACKET_CACHE_KEY, maxPacketCache.toString());
-
     registry.forRemotes(async (_, remote) => {
       try {
         await remote.SetMaxPacketCache(undefined, maxPacketCache);
@@ -544,15 +784,10 @@ const App = () => {
   }, [clients, maxPacketCache]);
 
   useEffect(() => {
-    if (clients <= 0 || maxConnectionsCache <= 0) {
+    if (clients <= 0 || !settingsSynced.current || maxConnectionsCache <= 0) {
       return;
     }
 
-    localStorage.setItem(
-      MAX_CONNECTIONS_CACHE_KEY,
-      maxConnectionsCache.toString()
-    );
-
     registry.forRemotes(async (_, remote) => {
       try {
         await remote.SetMaxConnectionsCache(undefined, maxConnectionsCache);
@@ -563,11 +798,27 @@ const App = () => {
   }, [clients, maxConnectionsCache]);
 
   useEffect(() => {
-    if (clients <= 0 || dbDownloadURL.trim().length <= 0) {
+    if (clients <= 0 || !settingsSynced.current || connectionIdleTimeout <= 0) {
       return;
     }
 
-    localStorage.setItem(DB_DOWNLOAD_URL_KEY, dbDownloadURL);
+    registry.forRemotes(async (_, remote) => {
+      try {
+        await remote.SetConnectionIdleTimeout(undefined, connectionIdleTimeout);
+      } catch (e) {
+        alert(JSON.stringify((e as Error).message));
+      }
+    });
+  }, [clients, connectionIdleTimeout]);
+
+  useEffect(() => {
+    if (
+      clients <= 0 ||
+      !settingsSynced.current ||
+      dbDownloadURL.trim().length <= 0
+    ) {
+      return;
+    }
 
     registry.forRemotes(async (_, remote) => {
       try {
@@ -580,7 +831,10 @@ const App = () => {
 
   const [deviceSelectorIsOpen, setDeviceSelectorIsOpen] = useState(false);
   const [selectedDevicePcapName, setSelectedDevicePcapName] = useState("");
+  const [traceFilter, setTraceFilter] = useState("");
+  const [traceFilterErr, setTraceFilterErr] = useState("");
   const [tracing, setTracing] = useState(false);
+  const captureFileInput = useRef<HTMLInputElement>(null);
 
   const [arcs, setArcs] = useState<IArc[]>([]);
 
@@ -589,42 +843,50 @@ const App = () => {
       const interval = setInterval(async () => {
         registry.forRemotes(async (_, remote) => {
           try {
-            const conns = await remote.GetConnections(undefined);
+            const conns = await remote.GetConnections(undefined, "");
 
             setArcs((oldArcs) =>
-              conns.map((conn) => {
-                const oldArc = oldArcs.find(
-                  (arc) => arc.id === getTracedConnectionID(conn)
-                );
+              conns
+                .filter((conn) => {
+                  addLocalLocation(conn);
+
+                  // Unknown locations would otherwise be mapped to 0, 0
+                  return (
+                    conn.srcLocationPrecision !== "unknown" &&
+                    conn.dstLocationPrecision !== "unknown"
+                  );
+                })
+                .map((conn) => {
+                  const oldArc = oldArcs.find(
+                    (arc) => arc.id === getTracedConnectionID(conn)
+                  );
 
-                if (oldArc) {
-                  return oldArc;
-                }
+                  if (oldArc) {
+                    return oldArc;
+                  }
 
-                addLocalLocation(conn);
-
-                return {
-                  id: getTracedConnectionID(conn),
-                  label: `${conn.layerType}/${conn.nextLayerType} ${
-                    conn.srcIP
-                  } (${
-                    conn.srcCountryName && conn.srcCityName
-                      ? conn.srcCountryName + ", " + conn.srcCityName
-                      : conn.srcCountryName || conn.srcCityName || "-"
-                  }, ${conn.srcLongitude}, ${conn.srcLatitude}) → ${
-                    conn.dstIP
-                  } (${
-                    conn.dstCountryName && conn.dstCityName
-                      ? conn.dstCountryName + ", " + conn.dstCityName
-                      : conn.dstCountryName || conn.dstCityName || "-"
-                  }, ${conn.dstLongitude}, ${conn.dstLatitude})`,
-                  coords: [
-                    [conn.srcLongitude, conn.srcLatitude],
-                    [conn.dstLongitude, conn.dstLatitude],
-                  ],
-                  incoming: conn.srcCountryName ? true : false,
-                };
-              })
+                  return {
+                    id: getTracedConnectionID(conn),
+                    label: `${conn.layerType}/${conn.nextLayerType} ${
+                      conn.srcIP
+                    } (${
+                      conn.srcCountryName && conn.srcCityName
+                        ? conn.srcCountryName + ", " + conn.srcCityName
+                        : conn.srcCountryName || conn.srcCityName || "-"
+                    }, ${conn.srcLongitude}, ${conn.srcLatitude}) → ${
+                      conn.dstIP
+                    } (${
+                      conn.dstCountryName && conn.dstCityName
+                        ? conn.dstCountryName + ", " + conn.dstCityName
+                        : conn.dstCountryName || conn.dstCityName || "-"
+                    }, ${conn.dstLongitude}, ${conn.dstLatitude})`,
+                    coords: [
+                      [conn.srcLongitude, conn.srcLatitude],
+                      [conn.dstLongitude, conn.dstLatitude],
+                    ],
+                    incoming: conn.srcCountryName ? true : false,
+                  };
+                })
             );
           } catch (e) {
             alert(JSON.stringify((e as Error).message));
@@ -636,6 +898,51 @@ const App = () => {
     }
   }, [tracing]);
 
+  const [traceSessions, setTraceSessions] = useState<ITraceSession[]>([]);
+
+  useEffect(() => {
+    if (tracing) {
+      const refreshTraceSessions = () =>
+        registry.forRemotes(async (_, remote) => {
+          try {
+            setTraceSessions(await remote.ListTracingDevices(undefined));
+          } catch (e) {
+            alert(JSON.stringify((e as Error).message));
+          }
+        });
+
+      refreshTraceSessions();
+
+      const interval = setInterval(
+        refreshTraceSessions,
+        connectionsInterval.current
+      );
+
+      return () => clearInterval(interval);
+    }
+  }, [tracing]);
+
+  const stopTracing = useCallback(() => {
+    registry.forRemotes(async (_, remote) => {
+      try {
+        for (const session of await remote.ListTracingDevices(undefined)) {
+          if (
+            session.status === "starting" ||
+            session.status === "running"
+          ) {
+            await remote.StopTracing(undefined, session.name);
+          }
+        }
+
+        setTracing(false);
+        setTraceSessions([]);
+        setArcs([]);
+      } catch (e) {
+        alert(JSON.stringify((e as Error).message));
+      }
+    });
+  }, [registry]);
+
   const { width, height } = useWindowSize();
 
   const [isInspectorOpen, setIsInspectorOpen] = useState(false);
@@ -644,7 +951,7 @@ const App = () => {
   const [isSummarized, setIsSummarized] = useState(false);
 
   useEffect(() => {
-    if (clients <= 0) {
+    if (clients <= 0 || !settingsSynced.current) {
       return;
     }
 
@@ -657,9 +964,27 @@ const App = () => {
     });
   }, [clients, isSummarized]);
 
+  useEffect(() => {
+    // Follow changes made by other clients
+    local.onSettingsChanged = (settings) => {
+      setMaxPacketCache(settings.maxPacketCache);
+      setMaxConnectionsCache(settings.maxConnectionsCache);
+      setConnectionIdleTimeout(settings.connectionIdleTimeout);
+      setDBDownloadURL(settings.dbDownloadURL);
+      setIsSummarized(settings.summarized);
+    };
+
+    return () => {
+      local.onSettingsChanged = undefined;
+    };
+  }, [local]);
+
   const [searchQuery, setSearchQuery] = useState("");
   const [regexErr, setRegexErr] = useState(false);
 
+  const [filter, setFilter] = useState("");
+  const [filterErr, setFilterErr] = useState("");
+
   const [inWindow, setInWindow] = useState(false);
 
   const [filteredPackets, setFilteredPackets] = useState<
@@ -819,13 +1144,19 @@ const App = () => {
               (async () => {
                 try {
                   setDBIsDownloading(true);
+                  setProgress(0);
 
                   registry.forRemotes(async (_, remote) => {
                     try {
                       await remote.DownloadDatabase(
                         undefined,
                         accountID,
-                        licenseKey
+                        licenseKey,
+                        async (_, downloaded, total) => {
+                          if (total > 0) {
+                            setProgress(Math.floor((downloaded / total) * 100));
+                          }
+                        }
                       );
 
                       setDBIsDownloading(false);
@@ -899,6 +1230,16 @@ const App = () => {
                   Download database
                 </Button>
               </ActionGroup>
+
+              {dbIsDownloading && (
+                <Progress
+                  value={progress}
+                  title="Downloading database ..."
+                  variant={
+                    progress >= 100 ? ProgressVariant.success : undefined
+                  }
+                />
+              )}
             </FormGroup>
           </Form>
 
@@ -923,13 +1264,16 @@ const App = () => {
             <FileUpload
               id="db-upload"
               className="pf-v6-u-pl-0"
-              filenamePlaceholder="Drag and drop a database file (.mmdb) or upload one"
+              filenamePlaceholder="Drag and drop a database file (.mmdb or .tar.gz) or upload one"
               isClearButtonDisabled
               hideDefaultPreview
               disabled={dbIsDownloading || dbIsUploading}
               isDisabled={dbIsDownloading || dbIsUploading}
               dropzoneProps={{
-                accept: { "application/octet-stream": [".mmdb"] },
+                accept: {
+                  "application/octet-stream": [".mmdb"],
+                  "application/gzip": [".tar.gz", ".tgz"],
+                },
                 onDropRejected: () =>
                   alert("Not a valid database file, please try again"),
               }}
@@ -1083,6 +1427,31 @@ const App = () => {
               />
             </FormGroup>
 
+            <FormGroup
+              label="Connection idle timeout (in milliseconds)"
+              isRequired
+              fieldId="connection-idle-timeout"
+            >
+              <TextInput
+                isRequired
+                type="number"
+                id="connection-idle-timeout"
+                name="connection-idle-timeout"
+                value={connectionIdleTimeout}
+                onChange={(_, e) => {
+                  const v = parseInt(e);
+
+                  if (isNaN(v)) {
+                    console.error("Could not parse connection idle timeout");
+
+                    return;
+                  }
+
+                  setConnectionIdleTimeout(v);
+                }}
+              />
+            </FormGroup>
+
             <Title headingLevel="h2">Tracing</Title>
 
             <FormGroup
@@ -1280,6 +1649,42 @@ const App = () => {
             </Button>
           )}
 
+          <Flex
+            className="pf-v6-x-trace-status"
+            spaceItems={{ default: "spaceItemsSm" }}
+            alignItems={{ default: "alignItemsCenter" }}
+          >
+            {traceSessions.map((session) => (
+              <FlexItem key={session.name}>
+                <Label
+                  color={
+                    session.status === "running"
+                      ? "green"
+                      : session.status === "starting"
+                      ? "blue"
+                      : session.status === "failed"
+                      ? "red"
+                      : "grey"
+                  }
+                  title={session.error || undefined}
+                >
+                  {session.name}: {session.status}
+                </Label>
+              </FlexItem>
+            ))}
+
+            <FlexItem>
+              <Button
+                variant="danger"
+                icon={<StopIcon />}
+                onClick={stopTracing}
+              >
+                {" "}
+                Stop tracing
+              </Button>
+            </FlexItem>
+          </Flex>
+
           {isInspectorOpen && (
             <InWindowOrModal
               inWindow={inWindow}
@@ -1333,6 +1738,18 @@ const App = () => {
                           />
                         </ToolbarItem>
 
+                        <ToolbarItem>
+                          <TextInput
+                            type="text"
+                            aria-label="Filter by expression"
+                            placeholder='e.g. proto == "TCP" and bytes > 1MB'
+                            value={filter}
+                            onChange={(_, e) => setFilter(e)}
+                            validated={filterErr ? "error" : "default"}
+                            title={filterErr}
+                          />
+                        </ToolbarItem>
+
                         <ToolbarItem>
                           <ToggleGroup aria-label="Select your output mode">
                             <ToggleGroupItem
@@ -1370,18 +1787,29 @@ const App = () => {
                                         "layerType",
                                         "nextLayerType",
                                         "length",
+                                        "direction",
+                                        "bytesSent",
+                                        "bytesReceived",
 
                                         "srcIP",
+                                        "srcPort",
                                         "srcCountryName",
                                         "srcCityName",
                                         "srcLatitude",
                                         "srcLongitude",
+                                        "srcASN",
+                                        "srcOrg",
+                                        "srcLabel",
 
                                         "dstIP",
+                                        "dstPort",
                                         "dstCountryName",
                                         "dstCityName",
                                         "dstLatitude",
                                         "dstLongitude",
+                                        "dstASN",
+                                        "dstOrg",
+                                        "dstLabel",
                                       ],
                                       data: filteredPackets.map((packet) => [
                                         packet.timestamp,
@@ -1389,18 +1817,29 @@ const App = () => {
                                         packet.layerType,
                                         packet.nextLayerType,
                                         packet.length,
+                                        packet.direction,
+                                        packet.bytesSent,
+                                        packet.bytesReceived,
 
                                         packet.srcIP,
+                                        packet.srcPort,
                                         packet.srcCountryName,
                                         packet.srcCityName,
                                         packet.srcLatitude,
                                         packet.srcLongitude,
+                                        packet.srcASN,
+                                        packet.srcOrg,
+                                        packet.srcLabel,
 
                                         packet.dstIP,
+                                        packet.dstPort,
                                         packet.dstCountryName,
                                         packet.dstCityName,
                                         packet.dstLatitude,
                                         packet.dstLongitude,
+                                        packet.dstASN,
+                                        packet.dstOrg,
+                                        packet.dstLabel,
                                       ]),
                                     })
                                   )
@@ -1477,6 +1916,8 @@ const App = () => {
                 addLocalLocation={addLocalLocation}
                 searchQuery={searchQuery}
                 setRegexErr={setRegexErr}
+                filter={filter}
+                setFilterErr={setFilterErr}
                 filteredPackets={filteredPackets}
                 setFilteredPackets={setFilteredPackets}
                 packetsInterval={packetsInterval}
@@ -1543,6 +1984,28 @@ const App = () => {
                   </Select>
                 </FlexItem>
 
+                <FlexItem>
+                  <TextInput
+                    type="text"
+                    aria-label="Capture filter"
+                    placeholder="e.g. tcp port 443 and not net 10.0.0.0/8"
+                    value={traceFilter}
+                    onChange={(_, e) => {
+                      setTraceFilter(e);
+                      setTraceFilterErr("");
+                    }}
+                    validated={traceFilterErr ? "error" : "default"}
+                  />
+
+                  {traceFilterErr && (
+                    <HelperText>
+                      <HelperTextItem variant="error">
+                        {traceFilterErr}
+                      </HelperTextItem>
+                    </HelperText>
+                  )}
+                </FlexItem>
+
                 <FlexItem>
                   <Button
                     variant="primary"
@@ -1550,16 +2013,26 @@ const App = () => {
                       (async () => {
                         registry.forRemotes(async (_, remote) => {
                           try {
-                            await remote.TraceDevice(
-                              undefined,
-                              devices.find(
+                            await remote.TraceDevice(undefined, {
+                              ...(devices.find(
                                 (d) => d.PcapName === selectedDevicePcapName
-                              ) || devices[0]
-                            );
+                              ) || devices[0]),
+                              Filter: traceFilter.trim(),
+                            });
 
+                            setTraceFilterErr("");
                             setTracing(true);
                           } catch (e) {
-                            alert(JSON.stringify((e as Error).message));
+                            const message = (e as Error).message;
+
+                            // Invalid filters are shown next to the filter instead
+                            if (message.startsWith("invalid trace filter")) {
+                              setTraceFilterErr(message);
+
+                              return;
+                            }
+
+                            alert(JSON.stringify(message));
                           }
                         });
                       })();
@@ -1568,6 +2041,61 @@ const App = () => {
                     Trace device
                   </Button>
                 </FlexItem>
+
+                <FlexItem>
+                  <input
+                    ref={captureFileInput}
+                    type="file"
+                    accept=".pcap,.pcapng,.cap"
+                    hidden
+                    onChange={(e) => {
+                      const file = e.target.files?.[0];
+                      e.target.value = "";
+                      if (!file) {
+                        return;
+                      }
+
+                      const localAddresses = (
+                        prompt(
+                          "Optionally enter the IP addresses of the device the file was captured on, separated by commas. Without them, all packets are shown as transit traffic."
+                        ) || ""
+                      )
+                        .split(",")
+                        .map((address) => address.trim())
+                        .filter((address) => address.length > 0);
+
+                      const fileReader = file.stream().getReader();
+
+                      registry.forRemotes(async (_, remote) => {
+                        try {
+                          await remote.TraceFile(
+                            undefined,
+                            file.name,
+                            1,
+                            localAddresses,
+                            async (_) => {
+                              const { done, value } = await fileReader.read();
+                              if (done) return [];
+
+                              return Array.from(value);
+                            }
+                          );
+
+                          setTracing(true);
+                        } catch (e) {
+                          alert(JSON.stringify((e as Error).message));
+                        }
+                      });
+                    }}
+                  />
+
+                  <Button
+                    variant="secondary"
+                    onClick={() => captureFileInput.current?.click()}
+                  >
+                    Replay capture file
+                  </Button>
+                </FlexItem>
               </Flex>
             </FlexItem>
           </Flex>
@@ -1609,6 +2137,8 @@ interface ITrafficTableProps {
   addLocalLocation: (packet: ITracedConnection) => void;
   searchQuery: string;
   setRegexErr: (err: boolean) => void;
+  filter: string;
+  setFilterErr: (err: string) => void;
   filteredPackets: ITracedConnectionDetails[];
   setFilteredPackets: (packets: ITracedConnectionDetails[]) => void;
   packetsInterval: React.MutableRefObject<number>;
@@ -1619,6 +2149,8 @@ const RealtimeTrafficTable: React.FC<ITrafficTableProps> = ({
   addLocalLocation,
   searchQuery,
   setRegexErr,
+  filter,
+  setFilterErr,
   filteredPackets,
   setFilteredPackets,
   packetsInterval,
@@ -1629,8 +2161,9 @@ const RealtimeTrafficTable: React.FC<ITrafficTableProps> = ({
     const interval = setInterval(async () => {
       registry.forRemotes(async (_, remote) => {
         try {
-          const packets = await remote.GetPackets(undefined);
+          const packets = await remote.GetPackets(undefined, filter);
 
+          setFilterErr("");
           setPackets(
             packets.map((p) => {
               addLocalLocation(p);
@@ -1639,13 +2172,21 @@ const RealtimeTrafficTable: React.FC<ITrafficTableProps> = ({
             })
           );
         } catch (e) {
-          alert(JSON.stringify((e as Error).message));
+          const message = (e as Error).message;
+
+          if (message.startsWith("invalid filter")) {
+            setFilterErr(message);
+
+            return;
+          }
+
+          alert(JSON.stringify(message));
         }
       });
     }, packetsInterval.current);
 
     return () => clearInterval(interval);
-  }, []);
+  }, [filter, setFilterErr]);
 
   const [activeSortIndex, setActiveSortIndex] = useState<number | undefined>();
   const [activeSortDirection, setActiveSortDirection] = useState<
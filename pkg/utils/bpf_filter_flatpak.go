@@ -0,0 +1,764 @@
+//go:build flatpak
+// +build flatpak
+
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/bpf"
+)
+
+// We can't link against libpcap in the Flatpak, so we compile the commonly used subset of the
+// `pcap-filter` syntax to classic BPF ourselves. Since we use `AF_PACKET` sockets in `SOCK_DGRAM` mode,
+// packets start directly with the IPv4 or IPv6 header.
+
+var (
+	ErrUnexpectedEndOfFilter = errors.New("unexpected end of filter")
+	ErrUnsupportedFilter     = errors.New("unsupported filter primitive")
+	ErrFilterTooComplex      = errors.New("filter is too complex")
+)
+
+const (
+	bpfAcceptLen       = 262144
+	bpfMaxInstructions = 4096 // `BPF_MAXINSNS` of the kernel
+
+	// Packets with more IPv6 extension headers before the transport header don't match protocol and port primitives
+	bpfMaxIPv6ExtensionHeaders = 6
+
+	ipProtoHopByHop = 0
+	ipProtoICMP     = 1
+	ipProtoTCP      = 6
+	ipProtoUDP      = 17
+	ipProtoRouting  = 43
+	ipProtoFragment = 44
+	ipProtoAH       = 51
+	ipProtoICMPv6   = 58
+	ipProtoDstOpts  = 60
+	ipProtoSCTP     = 132
+)
+
+type bpfNode interface {
+	compile(p *bpfProgram, t, f bpfLabel) error
+}
+
+type bpfAndNode struct {
+	left, right bpfNode
+}
+
+type bpfOrNode struct {
+	left, right bpfNode
+}
+
+type bpfNotNode struct {
+	node bpfNode
+}
+
+type bpfProtoNode struct {
+	v4, v6 int // -1 if the protocol doesn't exist for the IP version
+}
+
+type bpfNetNode struct {
+	dir   string
+	proto bpfProtoNode
+	ipnet *net.IPNet
+}
+
+type bpfPortNode struct {
+	dir      string
+	protos   []int
+	from, to uint32
+}
+
+type bpfLabel int
+
+const bpfNext bpfLabel = -1
+
+type bpfJump struct {
+	cond   bpf.JumpTest
+	val    uint32
+	t, f   bpfLabel
+	always bool
+}
+
+type bpfProgram struct {
+	instructions []bpf.Instruction
+	jumps        map[int]bpfJump
+	labels       []int
+}
+
+func (p *bpfProgram) newLabel() bpfLabel {
+	p.labels = append(p.labels, -1)
+
+	return bpfLabel(len(p.labels) - 1)
+}
+
+func (p *bpfProgram) mark(l bpfLabel) {
+	p.labels[l] = len(p.instructions)
+}
+
+func (p *bpfProgram) emit(i ...bpf.Instruction) {
+	p.instructions = append(p.instructions, i...)
+}
+
+func (p *bpfProgram) jumpIf(cond bpf.JumpTest, val uint32, t, f bpfLabel) {
+	p.jumps[len(p.instructions)] = bpfJump{cond: cond, val: val, t: t, f: f}
+	p.instructions = append(p.instructions, nil)
+}
+
+func (p *bpfProgram) jump(t bpfLabel) {
+	p.jumps[len(p.instructions)] = bpfJump{t: t, always: true}
+	p.instructions = append(p.instructions, nil)
+}
+
+func (p *bpfProgram) skip(i int, l bpfLabel) (int, error) {
+	if l == bpfNext {
+		return 0, nil
+	}
+
+	skip := p.labels[l] - i - 1
+	if skip < 0 {
+		return 0, ErrFilterTooComplex
+	}
+
+	return skip, nil
+}
+
+// relax replaces the conditional jump at `i` with a conditional jump over two unconditional ones, which
+// can skip more than the 255 instructions conditional jumps are limited to
+func (p *bpfProgram) relax(i int) {
+	j := p.jumps[i]
+
+	// The instruction after the jump moves, so it needs a label
+	next := p.newLabel()
+	p.labels[next] = i + 1
+	if j.t == bpfNext {
+		j.t = next
+	}
+	if j.f == bpfNext {
+		j.f = next
+	}
+
+	for l, target := range p.labels {
+		if target > i {
+			p.labels[l] = target + 2
+		}
+	}
+
+	jumps := make(map[int]bpfJump, len(p.jumps)+2)
+	for k, jump := range p.jumps {
+		if k > i {
+			k += 2
+		}
+
+		jumps[k] = jump
+	}
+	p.instructions = slices.Insert(p.instructions, i+1, nil, nil)
+
+	f := p.newLabel()
+	p.labels[f] = i + 2
+
+	jumps[i] = bpfJump{cond: j.cond, val: j.val, t: bpfNext, f: f}
+	jumps[i+1] = bpfJump{t: j.t, always: true}
+	jumps[i+2] = bpfJump{t: j.f, always: true}
+	p.jumps = jumps
+}
+
+func (p *bpfProgram) assemble() ([]bpf.RawInstruction, error) {
+	for {
+		if len(p.instructions) > bpfMaxInstructions {
+			return nil, ErrFilterTooComplex
+		}
+
+		far := -1
+		for i, j := range p.jumps {
+			if j.always {
+				continue
+			}
+
+			t, err := p.skip(i, j.t)
+			if err != nil {
+				return nil, err
+			}
+
+			f, err := p.skip(i, j.f)
+			if err != nil {
+				return nil, err
+			}
+
+			if t > 255 || f > 255 {
+				far = i
+
+				break
+			}
+		}
+
+		if far < 0 {
+			break
+		}
+
+		p.relax(far)
+	}
+
+	for i, j := range p.jumps {
+		t, err := p.skip(i, j.t)
+		if err != nil {
+			return nil, err
+		}
+
+		if j.always {
+			p.instructions[i] = bpf.Jump{Skip: uint32(t)}
+
+			continue
+		}
+
+		f, err := p.skip(i, j.f)
+		if err != nil {
+			return nil, err
+		}
+
+		p.instructions[i] = bpf.JumpIf{Cond: j.cond, Val: j.val, SkipTrue: uint8(t), SkipFalse: uint8(f)}
+	}
+
+	return bpf.Assemble(p.instructions)
+}
+
+// jumpOnVersion jumps to `v4` or `v6` depending on the IP version of the packet
+func (p *bpfProgram) jumpOnVersion(v4, v6, f bpfLabel) {
+	p.emit(
+		bpf.LoadAbsolute{Off: 0, Size: 1},
+		bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xf0},
+	)
+	p.jumpIf(bpf.JumpEqual, 0x40, v4, bpfNext)
+	p.jumpIf(bpf.JumpEqual, 0x60, v6, f)
+}
+
+// jumpOnProtos jumps to `t` if the protocol in A is one of `protos`, and to `f` otherwise
+func (p *bpfProgram) jumpOnProtos(protos []int, t, f bpfLabel) {
+	for i, proto := range protos {
+		if i == len(protos)-1 {
+			p.jumpIf(bpf.JumpEqual, uint32(proto), t, f)
+		} else {
+			p.jumpIf(bpf.JumpEqual, uint32(proto), t, bpfNext)
+		}
+	}
+}
+
+// jumpOnIPv6Transport skips the extension headers of IPv6 packets and jumps to `t` with the offset of the
+// transport header in X if its protocol is one of `protos`, and to `f` otherwise. Only the first fragment of
+// a packet contains the transport header, so the others only match if `fragments` is set
+func (p *bpfProgram) jumpOnIPv6Transport(protos []int, fragments bool, t, f bpfLabel) {
+	// X is the offset of the current header and A the protocol of the next one
+	p.emit(
+		bpf.LoadAbsolute{Off: 6, Size: 1},
+		bpf.LoadConstant{Dst: bpf.RegX, Val: 40},
+	)
+	for i := 0; i < bpfMaxIPv6ExtensionHeaders; i++ {
+		extension, options, ah, fragment, next := p.newLabel(), p.newLabel(), p.newLabel(), p.newLabel(), p.newLabel()
+		p.jumpOnProtos(protos, t, extension)
+
+		p.mark(extension)
+		p.jumpIf(bpf.JumpEqual, ipProtoHopByHop, options, bpfNext)
+		p.jumpIf(bpf.JumpEqual, ipProtoRouting, options, bpfNext)
+		p.jumpIf(bpf.JumpEqual, ipProtoDstOpts, options, bpfNext)
+		p.jumpIf(bpf.JumpEqual, ipProtoAH, ah, bpfNext)
+		p.jumpIf(bpf.JumpEqual, ipProtoFragment, fragment, f)
+
+		// The length of options headers is in units of 8 bytes, not counting the first 8 bytes
+		p.mark(options)
+		p.emit(
+			bpf.LoadIndirect{Off: 1, Size: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 3},
+		)
+		p.jump(next)
+
+		// The length of authentication headers is in units of 4 bytes, not counting the first 8 bytes
+		p.mark(ah)
+		p.emit(
+			bpf.LoadIndirect{Off: 1, Size: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 2},
+			bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 2},
+		)
+		p.jump(next)
+
+		p.mark(fragment)
+		if !fragments {
+			p.emit(bpf.LoadIndirect{Off: 2, Size: 2})
+			p.jumpIf(bpf.JumpBitsSet, 0xfff8, f, bpfNext)
+		}
+		p.emit(bpf.LoadConstant{Dst: bpf.RegA, Val: 8})
+
+		p.mark(next)
+		p.emit(
+			bpf.ALUOpX{Op: bpf.ALUOpAdd},
+			bpf.StoreScratch{Src: bpf.RegA, N: 0},
+			bpf.LoadIndirect{Off: 0, Size: 1},
+			bpf.LoadScratch{Dst: bpf.RegX, N: 0},
+		)
+	}
+	p.jumpOnProtos(protos, t, f)
+}
+
+func (n bpfAndNode) compile(p *bpfProgram, t, f bpfLabel) error {
+	right := p.newLabel()
+	if err := n.left.compile(p, right, f); err != nil {
+		return err
+	}
+	p.mark(right)
+
+	return n.right.compile(p, t, f)
+}
+
+func (n bpfOrNode) compile(p *bpfProgram, t, f bpfLabel) error {
+	right := p.newLabel()
+	if err := n.left.compile(p, t, right); err != nil {
+		return err
+	}
+	p.mark(right)
+
+	return n.right.compile(p, t, f)
+}
+
+func (n bpfNotNode) compile(p *bpfProgram, t, f bpfLabel) error {
+	return n.node.compile(p, f, t)
+}
+
+func (n bpfProtoNode) compile(p *bpfProgram, t, f bpfLabel) error {
+	v4, v6 := p.newLabel(), p.newLabel()
+	p.jumpOnVersion(v4, v6, f)
+
+	p.mark(v4)
+	if n.v4 < 0 {
+		p.jump(f)
+	} else if n.v4 == 0 {
+		p.jump(t)
+	} else {
+		p.emit(bpf.LoadAbsolute{Off: 9, Size: 1})
+		p.jumpIf(bpf.JumpEqual, uint32(n.v4), t, f)
+	}
+
+	p.mark(v6)
+	if n.v6 < 0 {
+		p.jump(f)
+	} else if n.v6 == 0 {
+		p.jump(t)
+	} else {
+		p.jumpOnIPv6Transport([]int{n.v6}, true, t, f)
+	}
+
+	return nil
+}
+
+func (n bpfNetNode) compile(p *bpfProgram, t, f bpfLabel) error {
+	ip, mask := n.ipnet.IP.To4(), n.ipnet.Mask
+	srcOff, dstOff := uint32(12), uint32(16)
+	if ip == nil {
+		ip = n.ipnet.IP.To16()
+		srcOff, dstOff = 8, 24
+	}
+	if len(mask) != len(ip) {
+		return ErrUnsupportedFilter
+	}
+
+	matched := t
+	if n.proto.v4 != 0 || n.proto.v6 != 0 {
+		matched = p.newLabel()
+	}
+
+	addr := p.newLabel()
+	if len(ip) == net.IPv4len {
+		p.jumpOnVersion(addr, f, f)
+	} else {
+		p.jumpOnVersion(f, addr, f)
+	}
+	p.mark(addr)
+
+	compare := func(off uint32, t, f bpfLabel) {
+		for i := 0; i < len(ip); i += 4 {
+			m := binary.BigEndian.Uint32(mask[i : i+4])
+			if m == 0 {
+				continue
+			}
+
+			p.emit(bpf.LoadAbsolute{Off: off + uint32(i), Size: 4})
+			if m != 0xffffffff {
+				p.emit(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: m})
+			}
+			p.jumpIf(bpf.JumpEqual, binary.BigEndian.Uint32(ip[i:i+4])&m, bpfNext, f)
+		}
+
+		p.jump(t)
+	}
+
+	switch n.dir {
+	case "src":
+		compare(srcOff, matched, f)
+	case "dst":
+		compare(dstOff, matched, f)
+	default:
+		dst := p.newLabel()
+		compare(srcOff, matched, dst)
+		p.mark(dst)
+		compare(dstOff, matched, f)
+	}
+
+	if matched != t {
+		p.mark(matched)
+
+		return n.proto.compile(p, t, f)
+	}
+
+	return nil
+}
+
+func (n bpfPortNode) compile(p *bpfProgram, t, f bpfLabel) error {
+	v4, v6 := p.newLabel(), p.newLabel()
+	p.jumpOnVersion(v4, v6, f)
+
+	compare := func(load bpf.Instruction, t, f bpfLabel) {
+		p.emit(load)
+		if n.from == n.to {
+			p.jumpIf(bpf.JumpEqual, n.from, t, f)
+
+			return
+		}
+
+		p.jumpIf(bpf.JumpGreaterOrEqual, n.from, bpfNext, f)
+		p.jumpIf(bpf.JumpGreaterThan, n.to, f, t)
+	}
+
+	ports := func(srcLoad, dstLoad bpf.Instruction) {
+		switch n.dir {
+		case "src":
+			compare(srcLoad, t, f)
+		case "dst":
+			compare(dstLoad, t, f)
+		default:
+			dst := p.newLabel()
+			compare(srcLoad, t, dst)
+			p.mark(dst)
+			compare(dstLoad, t, f)
+		}
+	}
+
+	p.mark(v4)
+	transport := p.newLabel()
+	p.emit(bpf.LoadAbsolute{Off: 9, Size: 1})
+	p.jumpOnProtos(n.protos, transport, f)
+	p.mark(transport)
+	// Only the first fragment contains the transport header
+	p.emit(bpf.LoadAbsolute{Off: 6, Size: 2})
+	p.jumpIf(bpf.JumpBitsSet, 0x1fff, f, bpfNext)
+	p.emit(bpf.LoadMemShift{Off: 0})
+	ports(bpf.LoadIndirect{Off: 0, Size: 2}, bpf.LoadIndirect{Off: 2, Size: 2})
+
+	p.mark(v6)
+	transport = p.newLabel()
+	p.jumpOnIPv6Transport(n.protos, false, transport, f)
+
+	p.mark(transport)
+	ports(bpf.LoadIndirect{Off: 0, Size: 2}, bpf.LoadIndirect{Off: 2, Size: 2})
+
+	return nil
+}
+
+type bpfParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *bpfParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+
+	return p.tokens[p.pos]
+}
+
+func (p *bpfParser) next() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", ErrUnexpectedEndOfFilter
+	}
+
+	p.pos++
+
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *bpfParser) parseOr() (bpfNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "or" || p.peek() == "||" {
+		p.pos++
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		left = bpfOrNode{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *bpfParser) parseAnd() (bpfNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "and" || p.peek() == "&&" {
+		p.pos++
+
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+
+		left = bpfAndNode{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *bpfParser) parseNot() (bpfNode, error) {
+	if p.peek() == "not" || p.peek() == "!" {
+		p.pos++
+
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+
+		return bpfNotNode{node}, nil
+	}
+
+	if p.peek() == "(" {
+		p.pos++
+
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if token, err := p.next(); err != nil {
+			return nil, err
+		} else if token != ")" {
+			return nil, fmt.Errorf("%w: expected `)`, got `%v`", ErrUnsupportedFilter, token)
+		}
+
+		return node, nil
+	}
+
+	return p.parsePrimitive()
+}
+
+func (p *bpfParser) parsePrimitive() (bpfNode, error) {
+	proto := ""
+	switch p.peek() {
+	case "ip", "ip6", "tcp", "udp", "sctp", "icmp", "icmp6":
+		proto, _ = p.next()
+	}
+
+	dir := ""
+	switch p.peek() {
+	case "src", "dst":
+		dir, _ = p.next()
+	}
+
+	kind := p.peek()
+	switch kind {
+	case "host", "net", "port", "portrange":
+		p.pos++
+
+	default:
+		if dir != "" {
+			// `src 10.0.0.1` is shorthand for `src host 10.0.0.1`
+			kind = "host"
+		} else if proto != "" {
+			return protoNode(proto), nil
+		} else {
+			token, err := p.next()
+			if err != nil {
+				return nil, err
+			}
+
+			return nil, fmt.Errorf("%w: `%v`", ErrUnsupportedFilter, token)
+		}
+	}
+
+	value, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case "host", "net":
+		var ipnet *net.IPNet
+		if strings.Contains(value, "/") {
+			_, ipnet, err = net.ParseCIDR(value)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("%w: `%v` is not an IP address", ErrUnsupportedFilter, value)
+			}
+
+			if ip4 := ip.To4(); ip4 != nil {
+				ipnet = &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+			} else {
+				ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+			}
+		}
+
+		return bpfNetNode{dir, protoNode(proto), ipnet}, nil
+
+	default:
+		protos := []int{ipProtoTCP, ipProtoUDP, ipProtoSCTP}
+		switch proto {
+		case "", "ip", "ip6":
+		case "tcp":
+			protos = []int{ipProtoTCP}
+		case "udp":
+			protos = []int{ipProtoUDP}
+		case "sctp":
+			protos = []int{ipProtoSCTP}
+		default:
+			return nil, fmt.Errorf("%w: `%v` has no ports", ErrUnsupportedFilter, proto)
+		}
+
+		from, to := value, value
+		if kind == "portrange" {
+			var ok bool
+			from, to, ok = strings.Cut(value, "-")
+			if !ok {
+				return nil, fmt.Errorf("%w: `%v` is not a port range", ErrUnsupportedFilter, value)
+			}
+		}
+
+		fromPort, err := strconv.ParseUint(from, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+
+		toPort, err := strconv.ParseUint(to, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+
+		node := bpfNode(bpfPortNode{dir, protos, uint32(fromPort), uint32(toPort)})
+		if proto == "ip" || proto == "ip6" {
+			node = bpfAndNode{protoNode(proto), node}
+		}
+
+		return node, nil
+	}
+}
+
+func protoNode(proto string) bpfProtoNode {
+	switch proto {
+	case "ip":
+		return bpfProtoNode{0, -1}
+	case "ip6":
+		return bpfProtoNode{-1, 0}
+	case "tcp":
+		return bpfProtoNode{ipProtoTCP, ipProtoTCP}
+	case "udp":
+		return bpfProtoNode{ipProtoUDP, ipProtoUDP}
+	case "sctp":
+		return bpfProtoNode{ipProtoSCTP, ipProtoSCTP}
+	case "icmp":
+		return bpfProtoNode{ipProtoICMP, -1}
+	case "icmp6":
+		return bpfProtoNode{-1, ipProtoICMPv6}
+	default:
+		return bpfProtoNode{0, 0}
+	}
+}
+
+func tokenizeFilter(filter string) []string {
+	tokens := []string{}
+	current := strings.Builder{}
+	flush := func() {
+		if current.Len() > 0 {
+			tokens = append(tokens, current.String())
+			current.Reset()
+		}
+	}
+
+	for i := 0; i < len(filter); i++ {
+		c := filter[i]
+
+		switch {
+		case unicode.IsSpace(rune(c)):
+			flush()
+
+		case c == '(' || c == ')' || (c == '!' && (i+1 >= len(filter) || filter[i+1] != '=')):
+			flush()
+			tokens = append(tokens, string(c))
+
+		case (c == '&' || c == '|') && i+1 < len(filter) && filter[i+1] == c:
+			flush()
+			tokens = append(tokens, string([]byte{c, c}))
+			i++
+
+		default:
+			current.WriteByte(c)
+		}
+	}
+	flush()
+
+	return tokens
+}
+
+// CompileBPFFilter compiles a `pcap-filter` expression for packets without a link-layer header.
+// Matching packets are truncated to `snapLen` bytes if it is positive, and an empty filter matches all packets
+func CompileBPFFilter(filter string, snapLen int) ([]bpf.RawInstruction, error) {
+	acceptLen := uint32(bpfAcceptLen)
+	if snapLen > 0 {
+		acceptLen = uint32(snapLen)
+	}
+
+	if strings.TrimSpace(filter) == "" {
+		return bpf.Assemble([]bpf.Instruction{bpf.RetConstant{Val: acceptLen}})
+	}
+
+	parser := &bpfParser{tokens: tokenizeFilter(filter)}
+
+	node, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if parser.pos < len(parser.tokens) {
+		return nil, fmt.Errorf("%w: `%v`", ErrUnsupportedFilter, parser.peek())
+	}
+
+	program := &bpfProgram{jumps: map[int]bpfJump{}}
+	accept, drop := program.newLabel(), program.newLabel()
+	if err := node.compile(program, accept, drop); err != nil {
+		return nil, err
+	}
+
+	program.mark(accept)
+	program.emit(bpf.RetConstant{Val: acceptLen})
+
+	program.mark(drop)
+	program.emit(bpf.RetConstant{Val: 0})
+
+	return program.assemble()
+}
@@ -0,0 +1,292 @@
+//go:build flatpak
+// +build flatpak
+
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+type testPacket struct {
+	src, dst         string
+	proto            int
+	srcPort, dstPort uint16
+	fragment         uint16 // Flags and fragment offset of IPv4 packets and IPv6 fragment headers
+	extensions       []int  // Protocols of the IPv6 extension headers before the transport header
+}
+
+// bytes returns the packet without a link-layer header, like `AF_PACKET` sockets in `SOCK_DGRAM` mode
+func (p testPacket) bytes() []byte {
+	transport := make([]byte, 8)
+	if p.proto == ipProtoICMP || p.proto == ipProtoICMPv6 {
+		transport[0] = 8 // Echo request
+	} else {
+		binary.BigEndian.PutUint16(transport[0:2], p.srcPort)
+		binary.BigEndian.PutUint16(transport[2:4], p.dstPort)
+	}
+
+	src, dst := net.ParseIP(p.src), net.ParseIP(p.dst)
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		header := make([]byte, 20)
+		header[0] = 0x45
+		binary.BigEndian.PutUint16(header[2:4], uint16(len(header)+len(transport)))
+		binary.BigEndian.PutUint16(header[6:8], p.fragment)
+		header[8] = 64
+		header[9] = byte(p.proto)
+		copy(header[12:16], src4)
+		copy(header[16:20], dst4)
+
+		return append(header, transport...)
+	}
+
+	payload := transport
+	for i := len(p.extensions) - 1; i >= 0; i-- {
+		next := p.proto
+		if i < len(p.extensions)-1 {
+			next = p.extensions[i+1]
+		}
+
+		var extension []byte
+		switch p.extensions[i] {
+		case ipProtoFragment:
+			extension = make([]byte, 8)
+			binary.BigEndian.PutUint16(extension[2:4], p.fragment)
+		case ipProtoAH:
+			extension = make([]byte, 24)
+			extension[1] = byte(len(extension)/4 - 2)
+		default:
+			extension = make([]byte, 16)
+			extension[1] = byte(len(extension)/8 - 1)
+		}
+		extension[0] = byte(next)
+
+		payload = append(extension, payload...)
+	}
+
+	header := make([]byte, 40)
+	header[0] = 0x60
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(payload)))
+	header[6] = byte(p.proto)
+	if len(p.extensions) > 0 {
+		header[6] = byte(p.extensions[0])
+	}
+	header[7] = 64
+	copy(header[8:24], src.To16())
+	copy(header[24:40], dst.To16())
+
+	return append(header, payload...)
+}
+
+var (
+	tcp4HTTP      = testPacket{src: "10.0.0.1", dst: "93.184.216.34", proto: ipProtoTCP, srcPort: 50000, dstPort: 80}
+	tcp4SSH       = testPacket{src: "192.168.1.2", dst: "10.1.2.3", proto: ipProtoTCP, srcPort: 50001, dstPort: 22}
+	udp4DNS       = testPacket{src: "10.0.0.1", dst: "1.1.1.1", proto: ipProtoUDP, srcPort: 50002, dstPort: 53}
+	udp4High      = testPacket{src: "172.16.0.1", dst: "172.16.0.2", proto: ipProtoUDP, srcPort: 1500, dstPort: 2001}
+	icmp4         = testPacket{src: "10.0.0.1", dst: "8.8.8.8", proto: ipProtoICMP}
+	tcp4Fragment  = testPacket{src: "10.0.0.1", dst: "93.184.216.34", proto: ipProtoTCP, srcPort: 50000, dstPort: 80, fragment: 185}
+	tcp4FirstFrag = testPacket{src: "10.0.0.1", dst: "93.184.216.34", proto: ipProtoTCP, srcPort: 50000, dstPort: 80, fragment: 0x2000}
+	tcp6HTTPS     = testPacket{src: "2001:db8::1", dst: "2606:4700::1111", proto: ipProtoTCP, srcPort: 50003, dstPort: 443}
+	udp6DNS       = testPacket{src: "fe80::1", dst: "2001:db8:1::53", proto: ipProtoUDP, srcPort: 50004, dstPort: 53}
+	icmp6         = testPacket{src: "2001:db8::1", dst: "2001:db8::2", proto: ipProtoICMPv6}
+	tcp6Options   = testPacket{src: "2001:db8::1", dst: "2606:4700::1111", proto: ipProtoTCP, srcPort: 50005, dstPort: 443, extensions: []int{ipProtoHopByHop, ipProtoRouting, ipProtoDstOpts}}
+	udp6AH        = testPacket{src: "2001:db8::1", dst: "2001:db8:1::53", proto: ipProtoUDP, srcPort: 50006, dstPort: 53, extensions: []int{ipProtoAH}}
+	udp6FirstFrag = testPacket{src: "2001:db8::1", dst: "2001:db8:1::53", proto: ipProtoUDP, srcPort: 50007, dstPort: 53, extensions: []int{ipProtoDstOpts, ipProtoFragment}, fragment: 1}
+	udp6Fragment  = testPacket{src: "2001:db8::1", dst: "2001:db8:1::53", proto: ipProtoUDP, srcPort: 50007, dstPort: 53, extensions: []int{ipProtoFragment}, fragment: 185 << 3}
+	udp6Nested    = testPacket{src: "2001:db8::1", dst: "2001:db8:1::53", proto: ipProtoUDP, srcPort: 50008, dstPort: 53, extensions: []int{0, 0, 0, 0, 0, 0, 0}}
+)
+
+// arp is a packet which is neither IPv4 nor IPv6
+var arp = []byte{0x00, 0x01, 0x08, 0x00, 0x06, 0x04, 0x00, 0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+
+func runBPFFilter(t *testing.T, filter string, snapLen int, packet []byte) int {
+	t.Helper()
+
+	raw, err := CompileBPFFilter(filter, snapLen)
+	if err != nil {
+		t.Fatalf("could not compile %q: %v", filter, err)
+	}
+
+	instructions, ok := bpf.Disassemble(raw)
+	if !ok {
+		t.Fatalf("could not disassemble %q", filter)
+	}
+
+	vm, err := bpf.NewVM(instructions)
+	if err != nil {
+		t.Fatalf("invalid program for %q: %v", filter, err)
+	}
+
+	n, err := vm.Run(packet)
+	if err != nil {
+		t.Fatalf("could not run %q: %v", filter, err)
+	}
+
+	return n
+}
+
+func TestCompileBPFFilter(t *testing.T) {
+	packets := map[string][]byte{
+		"tcp4HTTP":      tcp4HTTP.bytes(),
+		"tcp4SSH":       tcp4SSH.bytes(),
+		"udp4DNS":       udp4DNS.bytes(),
+		"udp4High":      udp4High.bytes(),
+		"icmp4":         icmp4.bytes(),
+		"tcp4Fragment":  tcp4Fragment.bytes(),
+		"tcp4FirstFrag": tcp4FirstFrag.bytes(),
+		"tcp6HTTPS":     tcp6HTTPS.bytes(),
+		"udp6DNS":       udp6DNS.bytes(),
+		"icmp6":         icmp6.bytes(),
+		"tcp6Options":   tcp6Options.bytes(),
+		"udp6AH":        udp6AH.bytes(),
+		"udp6FirstFrag": udp6FirstFrag.bytes(),
+		"udp6Fragment":  udp6Fragment.bytes(),
+		"udp6Nested":    udp6Nested.bytes(),
+		"arp":           arp,
+	}
+
+	tests := []struct {
+		filter  string
+		matches []string
+	}{
+		{"", []string{"tcp4HTTP", "tcp4SSH", "udp4DNS", "udp4High", "icmp4", "tcp4Fragment", "tcp4FirstFrag", "tcp6HTTPS", "udp6DNS", "icmp6", "arp", "tcp6Options", "udp6AH", "udp6FirstFrag", "udp6Fragment", "udp6Nested"}},
+		{"ip", []string{"tcp4HTTP", "tcp4SSH", "udp4DNS", "udp4High", "icmp4", "tcp4Fragment", "tcp4FirstFrag"}},
+		{"ip6", []string{"tcp6HTTPS", "udp6DNS", "icmp6", "tcp6Options", "udp6AH", "udp6FirstFrag", "udp6Fragment", "udp6Nested"}},
+		{"tcp", []string{"tcp4HTTP", "tcp4SSH", "tcp4Fragment", "tcp4FirstFrag", "tcp6HTTPS", "tcp6Options"}},
+		{"udp", []string{"udp4DNS", "udp4High", "udp6DNS", "udp6AH", "udp6FirstFrag", "udp6Fragment"}},
+		{"icmp", []string{"icmp4"}},
+		{"icmp6", []string{"icmp6"}},
+		{"port 53", []string{"udp4DNS", "udp6DNS", "udp6AH", "udp6FirstFrag"}},
+		{"tcp port 53", []string{}},
+		{"udp dst port 53", []string{"udp4DNS", "udp6DNS", "udp6AH", "udp6FirstFrag"}},
+		{"src port 53", []string{}},
+		{"port 80", []string{"tcp4HTTP", "tcp4FirstFrag"}},
+		{"not port 22", []string{"tcp4HTTP", "udp4DNS", "udp4High", "icmp4", "tcp4Fragment", "tcp4FirstFrag", "tcp6HTTPS", "udp6DNS", "icmp6", "arp", "tcp6Options", "udp6AH", "udp6FirstFrag", "udp6Fragment", "udp6Nested"}},
+		{"! port 22 and tcp", []string{"tcp4HTTP", "tcp4Fragment", "tcp4FirstFrag", "tcp6HTTPS", "tcp6Options"}},
+		{"portrange 1500-2000", []string{"udp4High"}},
+		{"dst portrange 2000-2001", []string{"udp4High"}},
+		{"src portrange 1501-2001", []string{}},
+		{"tcp portrange 440-450", []string{"tcp6HTTPS", "tcp6Options"}},
+		{"ip6 and portrange 50-60", []string{"udp6DNS", "udp6AH", "udp6FirstFrag"}},
+		{"host 10.0.0.1", []string{"tcp4HTTP", "udp4DNS", "icmp4", "tcp4Fragment", "tcp4FirstFrag"}},
+		{"src 10.0.0.1 and dst 1.1.1.1", []string{"udp4DNS"}},
+		{"dst host 10.0.0.1", []string{}},
+		{"net 10.0.0.0/8", []string{"tcp4HTTP", "tcp4SSH", "udp4DNS", "icmp4", "tcp4Fragment", "tcp4FirstFrag"}},
+		{"src net 192.168.0.0/16", []string{"tcp4SSH"}},
+		{"dst net 10.1.0.0/16", []string{"tcp4SSH"}},
+		{"net 172.16.0.0/12", []string{"udp4High"}},
+		{"net 172.32.0.0/12", []string{}},
+		{"net 2001:db8::/32", []string{"tcp6HTTPS", "udp6DNS", "icmp6", "tcp6Options", "udp6AH", "udp6FirstFrag", "udp6Fragment", "udp6Nested"}},
+		{"dst net 2001:db8:1::/48", []string{"udp6DNS", "udp6AH", "udp6FirstFrag", "udp6Fragment", "udp6Nested"}},
+		{"host 2606:4700::1111", []string{"tcp6HTTPS", "tcp6Options"}},
+		{"tcp net 10.0.0.0/8", []string{"tcp4HTTP", "tcp4SSH", "tcp4Fragment", "tcp4FirstFrag"}},
+		{"(tcp or udp) and not port 443 and not net 192.168.0.0/16", []string{"tcp4HTTP", "udp4DNS", "udp4High", "tcp4Fragment", "tcp4FirstFrag", "udp6DNS", "udp6AH", "udp6FirstFrag", "udp6Fragment"}},
+		{"icmp || icmp6", []string{"icmp4", "icmp6"}},
+		{"not (ip or ip6)", []string{"arp"}},
+
+		// Extension headers are skipped, but only the first fragment of a packet contains the ports
+		{"ip6 and udp port 53", []string{"udp6DNS", "udp6AH", "udp6FirstFrag"}},
+		{"ip6 and udp and not port 53", []string{"udp6Fragment"}},
+		{"src port 50005 or src port 50006 or src port 50007", []string{"tcp6Options", "udp6AH", "udp6FirstFrag"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			for name, packet := range packets {
+				want := 0
+				for _, match := range tt.matches {
+					if match == name {
+						want = bpfAcceptLen
+					}
+				}
+
+				if got := runBPFFilter(t, tt.filter, 0, packet); got != want {
+					t.Errorf("packet %v: got %v, want %v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCompileBPFFilterSnapLen(t *testing.T) {
+	if got := runBPFFilter(t, "tcp", 96, tcp4HTTP.bytes()); got != 96 {
+		t.Errorf("got %v, want 96", got)
+	}
+
+	if got := runBPFFilter(t, "", 128, arp); got != 128 {
+		t.Errorf("got %v, want 128", got)
+	}
+}
+
+func TestCompileBPFFilterErrors(t *testing.T) {
+	tests := []struct {
+		filter string
+		err    error
+	}{
+		{"ether host 00:11:22:33:44:55", ErrUnsupportedFilter},
+		{"port", ErrUnexpectedEndOfFilter},
+		{"tcp and", ErrUnexpectedEndOfFilter},
+		{"(tcp or udp", ErrUnexpectedEndOfFilter},
+		{"(tcp or udp]", ErrUnsupportedFilter},
+		{"tcp udp", ErrUnsupportedFilter},
+		{"icmp port 80", ErrUnsupportedFilter},
+		{"host example.com", ErrUnsupportedFilter},
+		{"portrange 80", ErrUnsupportedFilter},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			if _, err := CompileBPFFilter(tt.filter, 0); !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	for _, filter := range []string{"port 65536", "portrange 1-99999", "net 10.0.0.0/33"} {
+		if _, err := CompileBPFFilter(filter, 0); err == nil {
+			t.Errorf("%q: expected an error", filter)
+		}
+	}
+}
+
+func TestCompileBPFFilterLongJumps(t *testing.T) {
+	// Each port primitive skips IPv6 extension headers, so jumps past a few of them are longer than the
+	// 255 instructions conditional jumps can skip
+	terms := []string{}
+	for port := 1; port <= 10; port++ {
+		terms = append(terms, fmt.Sprintf("port %v", port))
+	}
+	filter := strings.Join(terms, " or ")
+
+	for _, tt := range []struct {
+		packet testPacket
+		want   int
+	}{
+		{testPacket{src: "10.0.0.1", dst: "10.0.0.2", proto: ipProtoTCP, srcPort: 50000, dstPort: 1}, bpfAcceptLen},
+		{testPacket{src: "10.0.0.1", dst: "10.0.0.2", proto: ipProtoUDP, srcPort: 50000, dstPort: 10}, bpfAcceptLen},
+		{testPacket{src: "10.0.0.1", dst: "10.0.0.2", proto: ipProtoUDP, srcPort: 50000, dstPort: 11}, 0},
+		{testPacket{src: "2001:db8::1", dst: "2001:db8::2", proto: ipProtoTCP, srcPort: 10, dstPort: 50000, extensions: []int{ipProtoHopByHop}}, bpfAcceptLen},
+		{testPacket{src: "2001:db8::1", dst: "2001:db8::2", proto: ipProtoTCP, srcPort: 11, dstPort: 50000, extensions: []int{ipProtoHopByHop}}, 0},
+	} {
+		if got := runBPFFilter(t, filter, 0, tt.packet.bytes()); got != tt.want {
+			t.Errorf("%+v: got %v, want %v", tt.packet, got, tt.want)
+		}
+	}
+}
+
+func TestCompileBPFFilterTooComplex(t *testing.T) {
+	terms := []string{}
+	for port := 1; port <= 100; port++ {
+		terms = append(terms, fmt.Sprintf("port %v", port))
+	}
+
+	if _, err := CompileBPFFilter(strings.Join(terms, " or "), 0); !errors.Is(err, ErrFilterTooComplex) {
+		t.Errorf("got %v, want %v", err, ErrFilterTooComplex)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os/exec"
 	"runtime"
+	"strings"
 )
 
 var (
@@ -17,7 +18,14 @@ const (
 	FlatpakSpawnCmd = "flatpak-spawn"
 )
 
+// QuoteShellArgument quotes `arg` so that a POSIX shell passes it to a command as a single argument
+func QuoteShellArgument(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
 // CreateElevatedCommand creates a command that runs with with elevated (e.g. administrator or root) permissions
+// `command` is run by a POSIX shell on Linux and macOS, so user-provided arguments in it must be quoted with
+// `QuoteShellArgument`; it is escaped for the AppleScript and terminal emulator strings it is embedded in
 // Note that `title` and `body` will be passed into the shell without validation or escapes, so make sure
 // to not enter any user-provided strings
 func CreateElevatedCommand(ctx context.Context, title, body, command string) (*exec.Cmd, error) {
@@ -35,7 +43,7 @@ func CreateElevatedCommand(ctx context.Context, title, body, command string) (*e
 			ctx,
 			"osascript",
 			"-e",
-			fmt.Sprintf(`do shell script "%v" with administrator privileges with prompt "%v: %v"`, command, title, body),
+			fmt.Sprintf(`do shell script "%v" with administrator privileges with prompt "%v: %v"`, strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(command), title, body),
 		), nil
 
 	default:
@@ -74,7 +82,8 @@ func CreateElevatedCommand(ctx context.Context, title, body, command string) (*e
 					}
 				}
 
-				command = terminal + " -T '" + title + `' -e "echo '` + body + `' && ` + suid + " " + command + `"`
+				// The command is embedded in a double-quoted string, in which these characters are still interpreted
+				command = terminal + " -T '" + title + `' -e "echo '` + body + `' && ` + suid + " " + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`").Replace(command) + `"`
 			}
 		}
 
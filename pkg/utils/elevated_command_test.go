@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestQuoteShellArgument(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no shell found:", err)
+	}
+
+	for _, arg := range []string{
+		"",
+		"eth0",
+		"tcp port 443 and not host 10.0.0.1",
+		"host 'example'",
+		`"quoted" \ back\slash`,
+		"$HOME `id` $(id) ; exit 1 | & > /dev/null",
+		"'",
+		"''\n'",
+	} {
+		output, err := exec.Command(sh, "-c", "printf %s "+QuoteShellArgument(arg)).Output()
+		if err != nil {
+			t.Fatalf("%q: %v", arg, err)
+		}
+
+		if string(output) != arg {
+			t.Errorf("got %q, want %q", output, arg)
+		}
+	}
+}
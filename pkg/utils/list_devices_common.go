@@ -4,4 +4,11 @@ type Device struct {
 	PcapName string
 	NetName  string
 	MTU      int
+
+	// BPF filter expression in `pcap-filter` syntax, empty to capture all packets.
+	// In the Flatpak, where we can't use libpcap, only this subset is supported: the `ip`, `ip6`, `tcp`, `udp`,
+	// `sctp`, `icmp` and `icmp6` protocols, the `host`, `net`, `port` and `portrange` primitives with an optional
+	// protocol and `src` or `dst` direction, and `and`, `or`, `not`, `&&`, `||`, `!` and parentheses.
+	// Protocol and port primitives skip up to 6 IPv6 extension headers
+	Filter string
 }
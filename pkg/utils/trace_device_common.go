@@ -1,19 +1,238 @@
 package utils
 
 import (
-	"github.com/gopacket/gopacket"
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
 	"github.com/gopacket/gopacket/layers"
 )
 
+var (
+	ErrUnknownFrameType   = errors.New("unknown frame type")
+	ErrInvalidFrameLength = errors.New("invalid frame length")
+)
+
 const (
 	TraceCommandHandshakeHandleAcquired         = "AQ"
 	TraceCommandHandshakeHandlePermissionDenied = "PD"
 	TraceCommandHandshakeHandleUnexpectedError  = "UE"
+	TraceCommandHandshakeInvalidFilter          = "IF"
+
+	// TraceCommandProtocolVersion is sent as a single byte after `TraceCommandHandshakeHandleAcquired`
+	// and must be incremented whenever the frame format changes
+	TraceCommandProtocolVersion = 2
+
+	FrameTypePacket FrameType = 1
+	FrameTypeStats  FrameType = 2
+
+	// StatsInterval is the interval in which the trace command sends capture statistics
+	StatsInterval = time.Second
+
+	// Frames are prefixed with their length (uint32) and type (uint8)
+	frameHeaderLen = 4 + 1
+	// Packet frames contain a timestamp (int64), the captured length (uint32), the length on the wire (uint32),
+	// the link type (uint16) and the captured bytes
+	packetFrameHeaderLen = 8 + 4 + 4 + 2
+	// Stats frames contain the packets received (uint64) and dropped (uint64) by the kernel or libpcap
+	statsFrameLen = 8 + 8
+
+	maxFrameLen = 1 << 24
+
+	// Frames are buffered so that writing a packet doesn't cost a syscall; the buffer is flushed with every stats frame
+	frameWriterBufferLen = 1 << 16
 )
 
+type FrameType byte
+
 type Packet struct {
-	Data          []byte                 `json:"data"`
-	Length        int                    `json:"length"`
-	LinkType      layers.LinkType        `json:"linkType"`
-	DecodeOptions gopacket.DecodeOptions `json:"decodeOptions"`
+	Timestamp     time.Time
+	CaptureLength int
+	Length        int
+	LinkType      layers.LinkType
+	Data          []byte
+}
+
+// Stats contains the capture statistics reported by the kernel or libpcap
+type Stats struct {
+	PacketsReceived uint64
+	PacketsDropped  uint64
+}
+
+// FrameWriter writes packets and capture statistics to the parent process. Frames are buffered until
+// the buffer is full or `Flush` is called
+type FrameWriter struct {
+	w    *bufio.Writer
+	buf  []byte
+	lock sync.Mutex
+}
+
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{w: bufio.NewWriterSize(w, frameWriterBufferLen)}
+}
+
+// WritePacket writes a packet frame
+func (f *FrameWriter) WritePacket(packet *Packet) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	frameLen := frameHeaderLen + packetFrameHeaderLen + len(packet.Data)
+	if cap(f.buf) < frameLen {
+		f.buf = make([]byte, frameLen)
+	}
+	buf := f.buf[:frameLen]
+
+	binary.BigEndian.PutUint32(buf[0:4], uint32(frameLen-4))
+	buf[4] = byte(FrameTypePacket)
+	binary.BigEndian.PutUint64(buf[5:13], uint64(packet.Timestamp.UnixNano()))
+	binary.BigEndian.PutUint32(buf[13:17], uint32(len(packet.Data)))
+	binary.BigEndian.PutUint32(buf[17:21], uint32(packet.Length))
+	binary.BigEndian.PutUint16(buf[21:23], uint16(packet.LinkType))
+	copy(buf[23:], packet.Data)
+
+	_, err := f.w.Write(buf)
+
+	return err
+}
+
+// Flush writes all buffered frames
+func (f *FrameWriter) Flush() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.w.Flush()
+}
+
+// WriteStats writes a stats frame
+func (f *FrameWriter) WriteStats(stats *Stats) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	buf := [frameHeaderLen + statsFrameLen]byte{}
+
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(buf)-4))
+	buf[4] = byte(FrameTypeStats)
+	binary.BigEndian.PutUint64(buf[5:13], stats.PacketsReceived)
+	binary.BigEndian.PutUint64(buf[13:21], stats.PacketsDropped)
+
+	_, err := f.w.Write(buf[:])
+
+	return err
+}
+
+// ReportStats sends the statistics returned by `getStats` and flushes the buffered frames every `StatsInterval`
+// until the returned function is called, which flushes the remaining frames
+func ReportStats(writer *FrameWriter, getStats func() (*Stats, error)) func() {
+	var (
+		ticker = time.NewTicker(StatsInterval)
+		done   = make(chan struct{})
+		wg     sync.WaitGroup
+	)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+
+			case <-ticker.C:
+				if stats, err := getStats(); err == nil {
+					if err := writer.WriteStats(stats); err != nil {
+						return
+					}
+				}
+
+				if err := writer.Flush(); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+
+		wg.Wait()
+
+		_ = writer.Flush()
+	}
+}
+
+// FrameReader reads packets and capture statistics sent by the trace command
+type FrameReader struct {
+	r      io.Reader
+	header [frameHeaderLen]byte
+	buf    []byte
+}
+
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: r}
+}
+
+// ReadFrame reads the next frame into either `packet` or `stats` and returns its type.
+// `packet.Data` is only valid until the next call
+func (f *FrameReader) ReadFrame(packet *Packet, stats *Stats) (FrameType, error) {
+	if _, err := io.ReadFull(f.r, f.header[:]); err != nil {
+		return 0, err
+	}
+
+	frameLen := int(binary.BigEndian.Uint32(f.header[0:4])) - 1
+	if frameLen < 0 || frameLen > maxFrameLen {
+		return 0, ErrInvalidFrameLength
+	}
+
+	if cap(f.buf) < frameLen {
+		f.buf = make([]byte, frameLen)
+	}
+	buf := f.buf[:frameLen]
+
+	if _, err := io.ReadFull(f.r, buf); err != nil {
+		// A frame which ends after its header is truncated, not the end of the stream
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+
+		return 0, err
+	}
+
+	frameType := FrameType(f.header[4])
+	switch frameType {
+	case FrameTypePacket:
+		if len(buf) < packetFrameHeaderLen {
+			return 0, io.ErrUnexpectedEOF
+		}
+
+		packet.Timestamp = time.Unix(0, int64(binary.BigEndian.Uint64(buf[0:8])))
+		packet.CaptureLength = int(binary.BigEndian.Uint32(buf[8:12]))
+		packet.Length = int(binary.BigEndian.Uint32(buf[12:16]))
+		packet.LinkType = layers.LinkType(binary.BigEndian.Uint16(buf[16:18]))
+		packet.Data = buf[packetFrameHeaderLen:]
+
+		if packet.CaptureLength != len(packet.Data) {
+			return 0, io.ErrUnexpectedEOF
+		}
+
+		return frameType, nil
+
+	case FrameTypeStats:
+		if len(buf) < statsFrameLen {
+			return 0, io.ErrUnexpectedEOF
+		}
+
+		stats.PacketsReceived = binary.BigEndian.Uint64(buf[0:8])
+		stats.PacketsDropped = binary.BigEndian.Uint64(buf[8:16])
+
+		return frameType, nil
+
+	default:
+		return 0, fmt.Errorf("%w: %v", ErrUnknownFrameType, frameType)
+	}
 }
@@ -0,0 +1,247 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket/layers"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	packets := []Packet{
+		{Timestamp: time.Unix(1700000000, 123456789), Length: 1514, LinkType: layers.LinkTypeEthernet, Data: bytes.Repeat([]byte{0xab}, 96)},
+		{Timestamp: time.Unix(0, 1), Length: 0, LinkType: layers.LinkTypeRaw, Data: []byte{}},
+		{Timestamp: time.Unix(1800000000, 0), Length: 65535, LinkType: layers.LinkTypeRaw, Data: bytes.Repeat([]byte{0x01, 0x02}, 32768)},
+	}
+	stats := Stats{PacketsReceived: 1 << 40, PacketsDropped: 42}
+
+	var b bytes.Buffer
+	writer := NewFrameWriter(&b)
+	for i := range packets {
+		if err := writer.WritePacket(&packets[i]); err != nil {
+			t.Fatal(err)
+		}
+
+		// Frames which fit into the buffer are only written once it is flushed
+		if i == 0 && b.Len() != 0 {
+			t.Fatalf("frame was written before flushing: %v bytes", b.Len())
+		}
+	}
+	if err := writer.WriteStats(&stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := NewFrameReader(&b)
+	for i, want := range packets {
+		var (
+			packet    Packet
+			gotStats  Stats
+			frameType FrameType
+			err       error
+		)
+		if frameType, err = reader.ReadFrame(&packet, &gotStats); err != nil {
+			t.Fatalf("packet %v: %v", i, err)
+		}
+
+		if frameType != FrameTypePacket {
+			t.Fatalf("packet %v: got frame type %v", i, frameType)
+		}
+
+		if !packet.Timestamp.Equal(want.Timestamp) || packet.Length != want.Length || packet.LinkType != want.LinkType || packet.CaptureLength != len(want.Data) || !bytes.Equal(packet.Data, want.Data) {
+			t.Errorf("packet %v: got %+v, want %+v", i, packet, want)
+		}
+	}
+
+	var gotStats Stats
+	if frameType, err := reader.ReadFrame(&Packet{}, &gotStats); err != nil || frameType != FrameTypeStats {
+		t.Fatalf("got frame type %v and error %v", frameType, err)
+	}
+	if gotStats != stats {
+		t.Errorf("got %+v, want %+v", gotStats, stats)
+	}
+
+	if _, err := reader.ReadFrame(&Packet{}, &Stats{}); err != io.EOF {
+		t.Errorf("got %v, want %v", err, io.EOF)
+	}
+}
+
+func TestFrameReaderRejectsInvalidFrames(t *testing.T) {
+	var b bytes.Buffer
+	writer := NewFrameWriter(&b)
+	if err := writer.WritePacket(&Packet{Timestamp: time.Now(), Length: 64, LinkType: layers.LinkTypeRaw, Data: make([]byte, 64)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	frame := b.Bytes()
+
+	corrupt := func(corrupt func(frame []byte)) []byte {
+		c := bytes.Clone(frame)
+		corrupt(c)
+
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		frame []byte
+		err   error
+	}{
+		{"truncated header", frame[:3], io.ErrUnexpectedEOF},
+		{"truncated body", frame[:len(frame)-1], io.ErrUnexpectedEOF},
+		{"missing body", frame[:frameHeaderLen], io.ErrUnexpectedEOF},
+		{"zero length", corrupt(func(c []byte) { binary.BigEndian.PutUint32(c[0:4], 0) }), ErrInvalidFrameLength},
+		{"oversized length", corrupt(func(c []byte) { binary.BigEndian.PutUint32(c[0:4], maxFrameLen+2) }), ErrInvalidFrameLength},
+		{"unknown type", corrupt(func(c []byte) { c[4] = 0xff }), ErrUnknownFrameType},
+		{"capture length mismatch", corrupt(func(c []byte) { binary.BigEndian.PutUint32(c[13:17], 65) }), io.ErrUnexpectedEOF},
+		{"short packet header", corrupt(func(c []byte) { binary.BigEndian.PutUint32(c[0:4], 1+packetFrameHeaderLen-1) }), io.ErrUnexpectedEOF},
+		{"short stats", corrupt(func(c []byte) {
+			c[4] = byte(FrameTypeStats)
+			binary.BigEndian.PutUint32(c[0:4], 1+statsFrameLen-1)
+		}), io.ErrUnexpectedEOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewFrameReader(bytes.NewReader(tt.frame)).ReadFrame(&Packet{}, &Stats{}); !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReportStatsFlushesOnExit(t *testing.T) {
+	var b bytes.Buffer
+	writer := NewFrameWriter(&b)
+
+	stopReportingStats := ReportStats(writer, func() (*Stats, error) {
+		return &Stats{}, nil
+	})
+
+	if err := writer.WritePacket(&Packet{Timestamp: time.Now(), LinkType: layers.LinkTypeRaw, Data: []byte{0x45}}); err != nil {
+		t.Fatal(err)
+	}
+
+	stopReportingStats()
+
+	if frameType, err := NewFrameReader(&b).ReadFrame(&Packet{}, &Stats{}); err != nil || frameType != FrameTypePacket {
+		t.Errorf("got frame type %v and error %v", frameType, err)
+	}
+}
+
+var benchmarkPacket = Packet{
+	Timestamp: time.Unix(1700000000, 0),
+	Length:    1514,
+	LinkType:  layers.LinkTypeEthernet,
+	Data:      bytes.Repeat([]byte{0xab}, 1514),
+}
+
+// BenchmarkFrameWriter measures the binary frames used by the trace command
+func BenchmarkFrameWriter(b *testing.B) {
+	writer := NewFrameWriter(io.Discard)
+
+	b.SetBytes(int64(len(benchmarkPacket.Data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := writer.WritePacket(&benchmarkPacket); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// BenchmarkJSONEncoder measures the JSON stream which the trace command used before the binary frames
+func BenchmarkJSONEncoder(b *testing.B) {
+	encoder := json.NewEncoder(io.Discard)
+
+	b.SetBytes(int64(len(benchmarkPacket.Data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := encoder.Encode(&benchmarkPacket); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFrameReader(b *testing.B) {
+	var frames bytes.Buffer
+	writer := NewFrameWriter(&frames)
+	for i := 0; i < 1000; i++ {
+		if err := writer.WritePacket(&benchmarkPacket); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(benchmarkPacket.Data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var (
+		r      = bytes.NewReader(frames.Bytes())
+		reader = NewFrameReader(r)
+		packet Packet
+		stats  Stats
+	)
+	for i := 0; i < b.N; i++ {
+		if _, err := reader.ReadFrame(&packet, &stats); err != nil {
+			if err != io.EOF {
+				b.Fatal(err)
+			}
+
+			r.Reset(frames.Bytes())
+			i--
+		}
+	}
+}
+
+// BenchmarkJSONDecoder measures the JSON stream which the backend read before the binary frames
+func BenchmarkJSONDecoder(b *testing.B) {
+	var stream bytes.Buffer
+	encoder := json.NewEncoder(&stream)
+	for i := 0; i < 1000; i++ {
+		if err := encoder.Encode(&benchmarkPacket); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.SetBytes(int64(len(benchmarkPacket.Data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var (
+		r       = bytes.NewReader(stream.Bytes())
+		decoder = json.NewDecoder(r)
+		packet  Packet
+	)
+	for i := 0; i < b.N; i++ {
+		if err := decoder.Decode(&packet); err != nil {
+			if err != io.EOF {
+				b.Fatal(err)
+			}
+
+			r.Reset(stream.Bytes())
+			decoder = json.NewDecoder(r)
+			i--
+		}
+	}
+}
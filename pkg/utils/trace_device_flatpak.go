@@ -4,17 +4,30 @@
 package utils
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/gopacket/gopacket"
 	"github.com/gopacket/gopacket/afpacket"
 	"github.com/gopacket/gopacket/layers"
+	"golang.org/x/net/bpf"
 )
 
-func TraceDevice(mtu int, device string) error {
+func TraceDevice(mtu int, device string, filter string, snapLen int) error {
+	// The BPF program's return value also truncates packets, so we use it to limit the capture length too
+	var program []bpf.RawInstruction
+	if strings.TrimSpace(filter) != "" || snapLen > 0 {
+		var err error
+		program, err = CompileBPFFilter(filter, snapLen)
+		if err != nil {
+			fmt.Print(TraceCommandHandshakeInvalidFilter)
+
+			return err
+		}
+	}
+
 	pageSize := os.Getpagesize()
 
 	var frameSize int
@@ -44,22 +57,43 @@ func TraceDevice(mtu int, device string) error {
 	}
 	defer handle.Close()
 
+	if program != nil {
+		if err := handle.SetBPF(program); err != nil {
+			fmt.Print(TraceCommandHandshakeInvalidFilter)
+
+			return err
+		}
+	}
+
 	fmt.Print(TraceCommandHandshakeHandleAcquired)
+	if _, err := os.Stdout.Write([]byte{TraceCommandProtocolVersion}); err != nil {
+		return err
+	}
 
 	source := gopacket.NewZeroCopyPacketSource(gopacket.ZeroCopyPacketDataSource(handle), layers.LinkTypeRaw)
 
-	encoder := json.NewEncoder(os.Stdout)
-	for packet := range source.Packets() {
-		rawPacket := &Packet{
-			Data:          packet.Data(),
-			Length:        packet.Metadata().Length,
-			LinkType:      layers.LinkTypeRaw,
-			DecodeOptions: source.DecodeOptions,
+	writer := NewFrameWriter(os.Stdout)
+
+	stopReportingStats := ReportStats(writer, func() (*Stats, error) {
+		_, stats, err := handle.SocketStats()
+		if err != nil {
+			return nil, err
 		}
 
-		if err := encoder.Encode(rawPacket); err != nil {
-			fmt.Print(TraceCommandHandshakeHandleUnexpectedError)
+		return &Stats{
+			PacketsReceived: uint64(stats.Packets()),
+			PacketsDropped:  uint64(stats.Drops()),
+		}, nil
+	})
+	defer stopReportingStats()
 
+	for packet := range source.Packets() {
+		if err := writer.WritePacket(&Packet{
+			Timestamp: packet.Metadata().Timestamp,
+			Length:    packet.Metadata().Length,
+			LinkType:  layers.LinkTypeRaw,
+			Data:      packet.Data(),
+		}); err != nil {
 			return err
 		}
 	}
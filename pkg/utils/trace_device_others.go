@@ -4,7 +4,6 @@
 package utils
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
@@ -13,8 +12,12 @@ import (
 	"github.com/gopacket/gopacket/pcap"
 )
 
-func TraceDevice(mtu int, device string) error {
-	handle, err := pcap.OpenLive(device, int32(mtu), true, pcap.BlockForever)
+func TraceDevice(mtu int, device string, filter string, snapLen int) error {
+	if snapLen <= 0 || snapLen > mtu {
+		snapLen = mtu
+	}
+
+	handle, err := pcap.OpenLive(device, int32(snapLen), true, pcap.BlockForever)
 	if err != nil {
 		// GoPacket doesn't export the permission error, so we need to compare error strings
 		if strings.HasSuffix(err.Error(), "(socket: Operation not permitted)") || // Linux
@@ -28,22 +31,43 @@ func TraceDevice(mtu int, device string) error {
 	}
 	defer handle.Close()
 
+	if strings.TrimSpace(filter) != "" {
+		if err := handle.SetBPFFilter(filter); err != nil {
+			fmt.Print(TraceCommandHandshakeInvalidFilter)
+
+			return err
+		}
+	}
+
 	fmt.Print(TraceCommandHandshakeHandleAcquired)
+	if _, err := os.Stdout.Write([]byte{TraceCommandProtocolVersion}); err != nil {
+		return err
+	}
 
 	source := gopacket.NewPacketSource(handle, handle.LinkType())
 
-	encoder := json.NewEncoder(os.Stdout)
-	for packet := range source.Packets() {
-		rawPacket := &Packet{
-			Data:          packet.Data(),
-			Length:        packet.Metadata().Length,
-			LinkType:      handle.LinkType(),
-			DecodeOptions: source.DecodeOptions,
+	writer := NewFrameWriter(os.Stdout)
+
+	stopReportingStats := ReportStats(writer, func() (*Stats, error) {
+		stats, err := handle.Stats()
+		if err != nil {
+			return nil, err
 		}
 
-		if err := encoder.Encode(rawPacket); err != nil {
-			fmt.Print(TraceCommandHandshakeHandleUnexpectedError)
+		return &Stats{
+			PacketsReceived: uint64(stats.PacketsReceived),
+			PacketsDropped:  uint64(stats.PacketsDropped + stats.PacketsIfDropped),
+		}, nil
+	})
+	defer stopReportingStats()
 
+	for packet := range source.Packets() {
+		if err := writer.WritePacket(&Packet{
+			Timestamp: packet.Metadata().Timestamp,
+			Length:    packet.Metadata().Length,
+			LinkType:  handle.LinkType(),
+			Data:      packet.Data(),
+		}); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+)
+
+var (
+	pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+)
+
+// CaptureFile reads packets from a pcap or pcapng file
+type CaptureFile struct {
+	pcap   *pcapgo.Reader
+	pcapng *pcapgo.NgReader
+}
+
+// OpenCaptureFile detects whether `r` is a pcap or pcapng file and prepares it for reading
+func OpenCaptureFile(r io.Reader) (*CaptureFile, error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(len(pcapngMagic))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(magic, pcapngMagic) {
+		pcapng, err := pcapgo.NewNgReader(br, pcapgo.NgReaderOptions{
+			WantMixedLinkType: true,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return &CaptureFile{pcapng: pcapng}, nil
+	}
+
+	pcap, err := pcapgo.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CaptureFile{pcap: pcap}, nil
+}
+
+// ReadPacket returns the next packet in the file and the link type of the interface it was captured on
+func (c *CaptureFile) ReadPacket() ([]byte, gopacket.CaptureInfo, layers.LinkType, error) {
+	if c.pcapng != nil {
+		data, ci, err := c.pcapng.ReadPacketData()
+		if err != nil {
+			return nil, ci, layers.LinkTypeNull, err
+		}
+
+		// pcapng files can contain packets from multiple interfaces with different link types
+		iface, err := c.pcapng.Interface(ci.InterfaceIndex)
+		if err != nil {
+			return nil, ci, layers.LinkTypeNull, err
+		}
+
+		return data, ci, iface.LinkType, nil
+	}
+
+	data, ci, err := c.pcap.ReadPacketData()
+	if err != nil {
+		return nil, ci, layers.LinkTypeNull, err
+	}
+
+	return data, ci, c.pcap.LinkType(), nil
+}